@@ -0,0 +1,206 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"torrent-client/peer"
+)
+
+const (
+	// DefaultUploadSlots is the default number of peers unchoked for their
+	// transfer rate, in addition to the optimistic unchoke.
+	DefaultUploadSlots = 4
+
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	// A peer we are interested in that sends no block for this long is
+	// snubbing us and only gets the optimistic unchoke.
+	snubTimeout = time.Minute
+)
+
+// peerInfo is what the tracker and the choker know about a connected peer.
+// The flags are copied from the peer's client by its worker, which owns the
+// client, and the worker applies the choker's decision in return.
+type peerInfo struct {
+	pipeline       *pipeline
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	unchoke        bool // choker's decision
+	optimistic     bool
+	pex            *pexPeer  // how the peer is announced to others, if at all
+	pexReceived    time.Time // when the peer's last PEX message was accepted
+	suggested      []int     // pieces the peer suggested, in order
+}
+
+func (info *peerInfo) snubbed(now time.Time) bool {
+	return info.amInterested && now.Sub(info.pipeline.idleSince()) > snubTimeout
+}
+
+// choker implements tit-for-tat: the interested peers that give us the best
+// download rate are unchoked, or while seeding the ones that take our uploads
+// fastest. One more peer is unchoked regardless of its rate and rotated
+// periodically so new peers get a chance to prove themselves.
+type choker struct {
+	tracker    *pieceTracker
+	slots      int
+	optimistic *peer.Client
+	rotated    time.Time
+}
+
+func newChoker(pt *pieceTracker, slots int) *choker {
+	if slots <= 0 {
+		slots = DefaultUploadSlots
+	}
+	return &choker{tracker: pt, slots: slots}
+}
+
+// run re-evaluates the unchoked peers every chokeInterval, and as soon as a
+// peer becomes interested, until the tracker is done.
+func (ch *choker) run(seeding func() bool) {
+	pt := ch.tracker
+	done := pt.stopped()
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		select {
+		case now = <-ticker.C:
+		case <-pt.rechoke:
+		case <-done:
+			return
+		}
+		ch.rechoke(now, seeding())
+	}
+}
+
+func (ch *choker) rechoke(now time.Time, seeding bool) {
+	pt := ch.tracker
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	type candidate struct {
+		client *peer.Client
+		rate   float64
+		wasOn  bool
+	}
+	var candidates []candidate
+	for c, info := range pt.peers {
+		wasOn := info.unchoke
+		info.unchoke = false
+		info.optimistic = false
+		if !info.peerInterested || info.snubbed(now) {
+			continue
+		}
+		download, upload := info.pipeline.rates()
+		rate := download
+		if seeding {
+			rate = upload
+		}
+		candidates = append(candidates, candidate{c, rate, wasOn})
+	}
+	// Ties go to peers that are already unchoked to avoid needless churn
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].rate != candidates[j].rate {
+			return candidates[i].rate > candidates[j].rate
+		}
+		return candidates[i].wasOn && !candidates[j].wasOn
+	})
+	for i := 0; i < len(candidates) && i < ch.slots; i++ {
+		pt.peers[candidates[i].client].unchoke = true
+	}
+
+	current, ok := pt.peers[ch.optimistic]
+	if !ok || !current.peerInterested || current.unchoke || now.Sub(ch.rotated) >= optimisticInterval {
+		ch.pickOptimistic(now)
+	} else {
+		current.unchoke = true
+		current.optimistic = true
+	}
+	pt.notify()
+}
+
+// pickOptimistic unchokes a random interested peer that did not earn a slot,
+// preferring a different one than last time. It must be called with the
+// tracker's lock held.
+func (ch *choker) pickOptimistic(now time.Time) {
+	var choices []*peer.Client
+	for c, info := range ch.tracker.peers {
+		if info.peerInterested && !info.unchoke && c != ch.optimistic {
+			choices = append(choices, c)
+		}
+	}
+	if len(choices) == 0 {
+		if info, ok := ch.tracker.peers[ch.optimistic]; ok && info.peerInterested && !info.unchoke {
+			choices = append(choices, ch.optimistic)
+		}
+	}
+	ch.optimistic = nil
+	ch.rotated = now
+	if len(choices) == 0 {
+		return
+	}
+	ch.optimistic = choices[rand.Intn(len(choices))]
+	info := ch.tracker.peers[ch.optimistic]
+	info.unchoke = true
+	info.optimistic = true
+}
+
+// syncPeer records the current state of c for the choker and returns whether
+// c should be unchoked. A peer that just became interested triggers a
+// rechoke so it does not wait for the next round.
+func (pt *pieceTracker) syncPeer(c *peer.Client) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	info, ok := pt.peers[c]
+	if !ok {
+		return false
+	}
+	if c.PeerInterested && !info.peerInterested {
+		select {
+		case pt.rechoke <- struct{}{}:
+		default:
+		}
+	}
+	info.amChoking = c.AmChoking
+	info.amInterested = c.AmInterested
+	info.peerChoking = c.Choked
+	info.peerInterested = c.PeerInterested
+	return info.unchoke
+}
+
+// updateChoke publishes the peer's state and applies the choker's decision.
+// Requests queued by a peer that we choke are discarded. With the fast
+// extension they are rejected explicitly, except for allowed fast pieces,
+// which are still served.
+func (state *peerState) updateChoke() error {
+	c := state.client
+	unchoke := state.tracker.syncPeer(c)
+	if unchoke && c.AmChoking {
+		return c.SendUnchoke()
+	}
+	if unchoke || c.AmChoking {
+		return nil
+	}
+	if err := c.SendChoke(); err != nil {
+		return err
+	}
+	if !c.SupportsFast() {
+		state.uploads = nil
+		return nil
+	}
+	kept := state.uploads[:0]
+	for _, req := range state.uploads {
+		if state.allowedFast[req.index] {
+			kept = append(kept, req)
+		} else if err := c.SendReject(req.index, req.begin, req.length); err != nil {
+			return err
+		}
+	}
+	state.uploads = kept
+	return nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+)
+
+// newChokerPeer connects a peer with the given rates to pt.
+func newChokerPeer(pt *pieceTracker, interested bool, download, upload float64) *peer.Client {
+	c := newTestClient(0)
+	c.PeerInterested = interested
+	p := newPipeline(time.Now())
+	p.rate, p.uploadRate = download, upload
+	pt.addPeer(c, p)
+	pt.syncPeer(c)
+	return c
+}
+
+func unchoked(pt *pieceTracker, c *peer.Client) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.peers[c].unchoke
+}
+
+func optimistic(pt *pieceTracker, c *peer.Client) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.peers[c].optimistic
+}
+
+func TestChokerUnchokesFastestPeers(t *testing.T) {
+	pt := newPieceTracker(nil)
+	fast := newChokerPeer(pt, true, 300, 0)
+	medium := newChokerPeer(pt, true, 200, 0)
+	slow := newChokerPeer(pt, true, 100, 0)
+	uninterested := newChokerPeer(pt, false, 1000, 0)
+
+	ch := newChoker(pt, 2)
+	ch.rechoke(time.Now(), false)
+
+	if !unchoked(pt, fast) || !unchoked(pt, medium) {
+		t.Error("Expected the two fastest peers to be unchoked")
+	}
+	if !unchoked(pt, slow) || !optimistic(pt, slow) {
+		t.Error("Expected the remaining interested peer to get the optimistic unchoke")
+	}
+	if unchoked(pt, uninterested) {
+		t.Error("Expected the uninterested peer to stay choked")
+	}
+}
+
+func TestChokerUsesUploadRateWhenSeeding(t *testing.T) {
+	pt := newPieceTracker(nil)
+	givesUs := newChokerPeer(pt, true, 1000, 10)
+	takesMost := newChokerPeer(pt, true, 0, 500)
+	newChokerPeer(pt, true, 0, 100)
+	newChokerPeer(pt, true, 0, 50)
+
+	ch := newChoker(pt, 1)
+	ch.rechoke(time.Now(), true)
+
+	if !unchoked(pt, takesMost) || optimistic(pt, takesMost) {
+		t.Error("Expected the peer we upload to fastest to hold the regular slot")
+	}
+	if unchoked(pt, givesUs) && !optimistic(pt, givesUs) {
+		t.Error("Expected the download rate to be ignored while seeding")
+	}
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	pt := newPieceTracker(nil)
+	newChokerPeer(pt, true, 100, 0)
+	a := newChokerPeer(pt, true, 0, 0)
+	b := newChokerPeer(pt, true, 0, 0)
+
+	ch := newChoker(pt, 1)
+	now := time.Now()
+	ch.rechoke(now, false)
+	first := ch.optimistic
+	if first != a && first != b {
+		t.Fatalf("Expected one of the slow peers to be unchoked optimistically")
+	}
+
+	ch.rechoke(now.Add(chokeInterval), false)
+	if ch.optimistic != first {
+		t.Error("Expected the optimistic unchoke to last until the next rotation")
+	}
+
+	ch.rechoke(now.Add(optimisticInterval), false)
+	if ch.optimistic == first {
+		t.Error("Expected the optimistic unchoke to rotate to the other peer")
+	}
+	if unchoked(pt, first) {
+		t.Error("Expected the previous optimistic peer to be choked again")
+	}
+}
+
+func TestChokerSkipsSnubbingPeers(t *testing.T) {
+	pt := newPieceTracker(nil)
+	snubber := newChokerPeer(pt, true, 1000, 0)
+	snubber.AmInterested = true
+	pt.syncPeer(snubber)
+	other := newChokerPeer(pt, true, 10, 0)
+
+	ch := newChoker(pt, 1)
+	ch.rechoke(time.Now().Add(2*snubTimeout), false)
+
+	if !unchoked(pt, other) || optimistic(pt, other) {
+		t.Error("Expected the responsive peer to take the regular slot")
+	}
+	if unchoked(pt, snubber) && !optimistic(pt, snubber) {
+		t.Error("Expected the snubbing peer to lose its regular slot")
+	}
+}
@@ -1,34 +1,143 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
-	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"torrent-client/dht"
+	"torrent-client/lsd"
+	"torrent-client/mse"
 	"torrent-client/peer"
+	"torrent-client/proxy"
+	"torrent-client/ratelimit"
 	"torrent-client/torrent"
+	"torrent-client/utp"
 )
 
 const Port uint16 = 6881
 
+// clientVersion identifies us in the extended handshake.
+const clientVersion = "torrent-client"
+
+// DefaultMaxConns is the default per-torrent connection limit.
+const DefaultMaxConns = 50
+
+// MaxLocalConns is the number of connections to local peers allowed beyond
+// the connection limit.
+const MaxLocalConns = 10
+
 type Torrent struct {
-	Peers       []torrent.Peer
-	PeerID      [20]byte
-	InfoHash    [20]byte
+	Peers    []torrent.Peer
+	PeerID   [20]byte
+	InfoHash [20]byte
+	// PieceHashes are the SHA-1 hashes of the pieces of v1 and hybrid
+	// torrents, and PiecesV2 verifies the pieces of v2 and hybrid torrents
+	// with merkle trees (BEP 52).
 	PieceHashes [][20]byte
+	PiecesV2    []torrent.PieceV2
+	// InfoHashV2 is the SHA-256 infohash of v2 and hybrid torrents. Hybrid
+	// torrents join the swarm of its first 20 bytes besides that of
+	// InfoHash.
+	InfoHashV2  [32]byte
 	PieceLength int
 	Length      int
 	Name        string
+	// Files lists the files of a multi-file torrent, nil for a single file.
+	Files []torrent.File
+	// WebSeeds are HTTP URLs serving the content (BEP 19). Download fetches
+	// pieces from them next to peers.
+	WebSeeds []string
+	// HTTPSeeds are HTTP seeds serving pieces by index (BEP 17), used like
+	// WebSeeds.
+	HTTPSeeds []string
+	// Private torrents only use peers from the tracker, so peer exchange is
+	// disabled for them.
+	Private bool
+	// Sequential downloads pieces in order instead of rarest first, for
+	// consuming the content while it downloads. It must be set before
+	// Download or NewReader is called.
+	Sequential bool
+	// ListenPort is the port peers can reach us on, as announced to
+	// trackers, the DHT, LSD and peers. Defaults to the port of the
+	// Listener the torrent is added to, or Port. It must be set before
+	// Download is called.
+	ListenPort uint16
+	// MaxRequestLength is the largest block peers may request from us.
+	// Defaults to MaxBlockSize.
+	MaxRequestLength int
+	// MaxConns limits the number of connections to peers of this torrent,
+	// incoming and outgoing. Defaults to DefaultMaxConns.
+	MaxConns int
+	// UploadSlots is the number of peers unchoked for their transfer rate,
+	// besides one optimistic unchoke. Defaults to DefaultUploadSlots.
+	UploadSlots int
+	// DHT, if set, is used to find peers besides the tracker. It is not
+	// used for private torrents.
+	DHT *dht.Server
+	// LSD, if set, announces the torrent on the local network and connects
+	// to local peers, up to MaxLocalConns past the connection limit. It is
+	// not used for private torrents.
+	LSD *lsd.Service
+	// Encryption decides whether outgoing connections are encrypted.
+	// Incoming connections follow the policy of the Listener.
+	Encryption mse.Policy
+	// UTP, if set, carries outgoing uTP connections, and Transport decides
+	// whether they are tried before or after TCP. Without a socket only
+	// TCP is used.
+	UTP       *utp.Socket
+	Transport utp.Policy
+	// Dialer, if set, opens outgoing connections instead, ignoring UTP and
+	// Transport.
+	Dialer peer.Dialer
+	// Proxy, if set, carries outgoing peer connections and tracker
+	// requests. A Dialer takes precedence for peers.
+	Proxy *proxy.Proxy
+	// ProxyOnly refuses every connection that would bypass Proxy: direct
+	// peer and tracker connections, incoming connections, the DHT and LSD.
+	ProxyOnly bool
+
+	file       *torrent.TorrentFile
+	session    *Session // nil unless the torrent runs in a Session
+	files      *fileSet // where a Session keeps the content, nil to keep it in memory
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+
+	downloadLimit    ratelimit.Limiter
+	uploadLimit      ratelimit.Limiter
+	limitMu          sync.Mutex
+	peerDownloadRate int64
+	peerUploadRate   int64
+	peerLimits       map[*peer.Client]*connLimits
+
+	peersV2 []torrent.Peer // peers of the v2 swarm of a hybrid torrent
+	peersMu sync.Mutex
+	dialing map[string]bool // peers we are connecting or connected to
+
+	hashMu        sync.Mutex
+	blockHashes   map[int][][32]byte // verified block hashes of v2 pieces that failed
+	hashRequested map[int]bool
+
+	initOnce   sync.Once
+	extensions *peer.Extensions
+	tracker    *pieceTracker
+	store      *pieceStore
+	results    chan *pieceResult
+	conns      atomic.Int32
 }
 
 type pieceWork struct {
 	index  int
-	hash   [20]byte
 	length int
 }
 
@@ -37,24 +146,31 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *peer.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+type peerState struct {
+	torrent   *Torrent
+	client    *peer.Client
+	tracker   *pieceTracker
+	pipeline  *pipeline
+	lastBlock time.Time
+	uploads   []blockRequest  // requests from the peer waiting to be served
+	stored    <-chan struct{} // closed when we complete another piece
+	idleSince time.Time       // since when neither side has been interested
+	lastPex   time.Time
+	pexSent   map[string]*pexPeer // peers the last PEX messages announced
+	// allowedFast holds the pieces the peer may request while we choke it.
+	allowedFast map[int]bool
 }
 
 const MaxBlockSize = 16384
-const MaxBacklog = 5
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
-	if err != nil {
-		return err
-	}
+// A peer with outstanding requests that sends no blocks for this long is
+// considered unresponsive and disconnected.
+const requestTimeout = 30 * time.Second
+
+// Connections on which neither side is interested for this long are closed.
+const idleTimeout = 2 * time.Minute
 
+func (state *peerState) handleMessage(msg *peer.Message) error {
 	if msg == nil { // keep-alive
 		return nil
 	}
@@ -64,126 +180,448 @@ func (state *pieceProgress) readMessage() error {
 		state.client.Choked = false
 	case peer.MsgChoke:
 		state.client.Choked = true
+		// Choking discards all pending requests, unless the peer rejects
+		// them one by one with the fast extension
+		if !state.client.SupportsFast() {
+			state.tracker.release(state.client)
+		}
+	case peer.MsgInterested:
+		if !state.client.PeerInterested && state.client.SupportsFast() {
+			if err := state.suggestPieces(); err != nil {
+				return err
+			}
+		}
+		state.client.PeerInterested = true
+	case peer.MsgNotInterested:
+		state.client.PeerInterested = false
+	case peer.MsgRequest:
+		index, begin, length, err := peer.ParseRequestMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		return state.queueUpload(index, begin, length)
+	case peer.MsgCancel:
+		index, begin, length, err := peer.ParseRequestMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		state.cancelUpload(index, begin, length)
 	case peer.MsgHave:
 		index, err := peer.ParseHaveMessage(msg.Payload)
 		if err != nil {
 			return err
 		}
+		if state.client.Bitfield.HasPiece(index) {
+			return nil
+		}
 		state.client.Bitfield.SetPiece(index)
+		if !state.client.Bitfield.HasPiece(index) {
+			return nil
+		}
+		state.tracker.peerHas(state.client, index)
+		if !state.client.AmInterested && !state.torrent.store.has(index) {
+			return state.client.SendInterested()
+		}
+	case peer.MsgBitfield:
+		return state.addPieces(msg.Payload)
+	case peer.MsgHaveAll:
+		state.client.HasAll = true
+		return state.addPieces(state.torrent.allPieces())
+	case peer.MsgHaveNone:
+	case peer.MsgReject:
+		index, begin, length, err := peer.ParseRequestMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		state.tracker.reject(state.client, blockRequest{index, begin, length})
+	case peer.MsgAllowedFast:
+		index, err := peer.ParseHaveMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if index >= state.torrent.NumPieces() || len(state.client.AllowedFast) >= maxAllowedFast {
+			return nil
+		}
+		if state.client.AllowedFast == nil {
+			state.client.AllowedFast = make(map[int]bool)
+		}
+		state.client.AllowedFast[index] = true
+	case peer.MsgSuggest:
+		index, err := peer.ParseHaveMessage(msg.Payload)
+		if err != nil {
+			return err
+		}
+		state.tracker.suggest(state.client, index)
+	case peer.MsgExtended:
+		return state.client.HandleExtended(msg.Payload)
+	case peer.MsgHashRequest, peer.MsgHashes, peer.MsgHashReject:
+		if state.client.SupportsV2() {
+			return state.handleHashMessage(msg)
+		}
 	case peer.MsgPiece:
-		n, err := state.copyPieceData(state.index, msg.Payload)
+		if len(msg.Payload) < 4 {
+			return fmt.Errorf("payload too short. %d < 4", len(msg.Payload))
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin, block, err := peer.ParsePieceMessage(index, msg.Payload)
 		if err != nil {
 			return err
 		}
-		state.downloaded += n
-		state.backlog--
+		state.lastBlock = time.Now()
+		if sent, ok := state.tracker.sentAt(state.client, index, begin, len(block)); ok {
+			state.pipeline.onBlock(len(block), state.lastBlock.Sub(sent))
+		}
+		return state.receiveBlock(index, begin, block)
 	}
 	return nil
 }
 
-func (state *pieceProgress) copyPieceData(index int, buf []byte) (int, error) {
-	begin, block, err := peer.ParsePieceMessage(index, buf)
+func (state *peerState) receiveBlock(index, begin int, block []byte) error {
+	return state.torrent.receiveBlock(state.client, index, begin, block)
+}
+
+// receiveBlock stores a block delivered by src. When it completes a piece
+// that passes its integrity check, the piece is handed to Download.
+func (t *Torrent) receiveBlock(src source, index, begin int, block []byte) error {
+	if !t.verifyBlock(index, begin, block) {
+		log.Printf("Block %d of piece #%d from %s failed its merkle check\n", begin/MaxBlockSize, index, src)
+		t.tracker.badBlock(src, blockRequest{index, begin, len(block)})
+		return nil
+	}
+	cancels, piece, err := t.tracker.receive(src, index, begin, block)
 	if err != nil {
-		return 0, err
+		return err
 	}
-
-	if begin >= len(state.buf) {
-		return 0, fmt.Errorf("begin offset too high. %d >= %d", begin, len(state.buf))
+	for _, cancel := range cancels {
+		// Requests to web seeds are already on their way
+		if c, ok := cancel.client.(*peer.Client); ok {
+			c.SendCancel(cancel.req.index, cancel.req.begin, cancel.req.length)
+		}
+	}
+	if piece == nil {
+		return nil
 	}
 
-	if begin+len(block) > len(state.buf) {
-		return 0, fmt.Errorf("data too long [%d] for offset %d with length %d", len(block), begin, len(state.buf))
+	pw := piece.pw
+	err = t.checkIntegrity(pw.index, piece.buf)
+	if err != nil {
+		sources := t.tracker.fail(piece)
+		log.Printf("Piece #%d failed integrity check (blocks from %v)\n", pw.index, sources)
+		t.requestBlockHashes(pw.index)
+		return nil
 	}
+	t.downloaded.Add(int64(len(piece.buf)))
 
-	copy(state.buf[begin:], block)
-	return len(block), nil
+	select {
+	case t.results <- &pieceResult{pw.index, piece.buf}:
+	case <-t.tracker.stopped():
+	}
+	return nil
 }
 
-func attemptDownloadPiece(c *peer.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// updateInterest tells the peer whether it has any piece we are missing.
+func (state *peerState) updateInterest() error {
+	c := state.client
+	wanted := state.torrent.store.wants(c.Bitfield)
+	if wanted && !c.AmInterested {
+		return c.SendInterested()
+	}
+	if !wanted && c.AmInterested {
+		return c.SendNotInterested()
 	}
+	return nil
+}
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	// 30 seconds is more than enough time to download a 262 KB piece
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+// refreshInterest re-evaluates interest if we completed pieces since the
+// last check.
+func (state *peerState) refreshInterest() error {
+	select {
+	case <-state.stored:
+	default:
+		return nil
+	}
+	state.stored = state.torrent.store.wait()
+	return state.updateInterest()
+}
 
-	for state.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
+// fillRequests sends requests until there are enough unfulfilled requests.
+// While the peer chokes us, only allowed fast pieces are requested.
+func (state *peerState) fillRequests() error {
+	c := state.client
+	if !c.AmInterested || (c.Choked && len(c.AllowedFast) == 0) {
+		return nil
+	}
+	depth := state.pipeline.depth(state.client.MaxRequests)
+	for state.tracker.backlog(state.client) < depth {
+		req, ok := state.tracker.reserve(state.client)
+		if !ok {
+			break
+		}
+		if state.tracker.backlog(state.client) == 1 {
+			state.lastBlock = time.Now() // Start the timeout when the pipeline fills up again
+		}
 
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
+		err := state.client.SendRequest(req.index, req.begin, req.length)
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// checkIntegrity verifies a piece against its SHA-1 hash and, for v2 and
+// hybrid torrents, its merkle tree.
+func (t *Torrent) checkIntegrity(index int, buf []byte) error {
+	if index < len(t.PieceHashes) && sha1.Sum(buf) != t.PieceHashes[index] {
+		return fmt.Errorf("index %d failed integrity check", index)
+	}
+	if index < len(t.PiecesV2) && !verifyV2(t.PiecesV2[index], buf) {
+		return fmt.Errorf("index %d failed merkle check", index)
+	}
+	return nil
+}
 
-		err := state.readMessage()
+// readMessages reads from c until an error occurs or quit is closed.
+// Messages read ahead of the loop of runPeer. While the loop is blocked
+// writing to a peer that is itself blocked writing to us, this holds all
+// the requests we accept and the blocks we requested, so two peers
+// uploading to each other do not deadlock when the connection has no
+// buffer of its own.
+const readAhead = maxUploadQueue + MaxQueueDepth
+
+func readMessages(c *peer.Client, msgs chan<- *peer.Message, errs chan<- error, quit <-chan struct{}) {
+	for {
+		msg, err := c.Read() // this call blocks
 		if err != nil {
-			return nil, err
+			select {
+			case errs <- err:
+			case <-quit:
+			}
+			return
+		}
+		select {
+		case msgs <- msg:
+		case <-quit:
+			return
 		}
 	}
+}
 
-	return state.buf, nil
+// AddPeers connects to the given peers, skipping the ones we are already
+// connected or connecting to. Peers learned after the download finished are
+// ignored.
+func (t *Torrent) AddPeers(peers []torrent.Peer) {
+	t.addPeers(peers, t.InfoHash, false)
 }
 
-func checkIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", pw.index)
+// addPeers connects to peers of the swarm of infoHash. Local peers are
+// connected to even when the connection limit is reached, up to
+// MaxLocalConns more, since peers on the same network are fast and cost no
+// upstream bandwidth.
+func (t *Torrent) addPeers(peers []torrent.Peer, infoHash [20]byte, local bool) {
+	t.init()
+	select {
+	case <-t.tracker.stopped():
+		return
+	default:
+	}
+
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.dialing == nil {
+		t.dialing = make(map[string]bool)
+	}
+	for _, p := range peers {
+		key := p.String()
+		if t.dialing[key] {
+			continue
+		}
+		t.dialing[key] = true
+		go func(p torrent.Peer) {
+			t.startDownloadWorker(p, infoHash, local)
+			t.peersMu.Lock()
+			defer t.peersMu.Unlock()
+			delete(t.dialing, key)
+		}(p)
 	}
-	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peerAddr torrent.Peer, workQueue chan *pieceWork, results chan *pieceResult) {
+func (t *Torrent) startDownloadWorker(peerAddr torrent.Peer, infoHash [20]byte, local bool) {
+	if !t.reserveConn(local) {
+		log.Printf("Not connecting to %s: connection limit reached\n", peerAddr)
+		return
+	}
+	defer t.releaseConn()
+
 	peerStruct := &peer.Peer{IP: peerAddr.IP, Port: peerAddr.Port}
-	c, err := peer.New(peerStruct, t.InfoHash, t.PeerID)
+	c, err := peer.New(context.Background(), peerStruct, infoHash, t.PeerID, peer.Options{
+		Dialer:     t.dialer(),
+		Extensions: t.extensions,
+		Encryption: t.Encryption,
+	})
 	if err != nil {
 		log.Printf("Could not handshake with %s. Disconnecting\n", peerAddr)
 		return
 	}
-	defer c.Close()
 	log.Printf("Completed handshake with %s\n", peerAddr)
 
-	c.SendUnchoke()
-	c.SendInterested()
+	t.runPeer(c)
+}
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
-			continue
+func (t *Torrent) dialer() peer.Dialer {
+	if t.Dialer != nil {
+		return t.Dialer
+	}
+	if t.Proxy != nil {
+		return t.Proxy
+	}
+	if t.ProxyOnly {
+		return peer.DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+			return nil, errNoProxy
+		})
+	}
+	return &utp.Dialer{Socket: t.UTP, Policy: t.Transport}
+}
+
+var errNoProxy = errors.New("direct connections are refused in proxy-only mode")
+
+// How long a tracker request through the proxy may take.
+const trackerTimeout = 15 * time.Second
+
+// trackerClient returns the client for announcing to the tracker, which
+// goes through the proxy if there is one. HTTP proxies cannot carry UDP, so
+// UDP trackers are then reached directly unless ProxyOnly is set.
+func (t *Torrent) trackerClient() (*torrent.TrackerClient, error) {
+	if t.Proxy == nil {
+		if t.ProxyOnly {
+			return nil, errNoProxy
 		}
+		return &torrent.TrackerClient{}, nil
+	}
+	c := &torrent.TrackerClient{HTTP: t.Proxy.HTTPClient(trackerTimeout)}
+	if t.Proxy.Type == proxy.SOCKS5 || t.ProxyOnly {
+		c.DialUDP = t.Proxy.DialUDP
+	}
+	return c, nil
+}
+
+// runPeer exchanges messages with a connected peer until the connection
+// fails or the download finishes, and closes the connection.
+func (t *Torrent) runPeer(c *peer.Client) {
+	defer c.Close()
+	defer t.limitConn(c)()
+
+	pt := t.tracker
+	done := pt.stopped()
+	now := time.Now()
+	state := peerState{torrent: t, client: c, tracker: pt, pipeline: newPipeline(now), idleSince: now}
+
+	// The bitfield the peer sent while connecting, if any, is sized to the
+	// torrent so later Have messages can be recorded
+	bf := make(peer.Bitfield, (t.NumPieces()+7)/8)
+	copy(bf, c.Bitfield)
+	if c.HasAll {
+		bf = t.allPieces()
+	}
+	c.Bitfield = bf
+	pt.addPeer(c, state.pipeline)
+	defer pt.removePeer(c)
+
+	// Reading starts first: on an unbuffered connection such as net.Pipe
+	// the peer may be blocked writing until we do
+	msgs := make(chan *peer.Message, readAhead)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go readMessages(c, msgs, errs, quit)
+
+	state.stored = t.store.wait()
+	if err := state.sendAvailability(); err != nil {
+		log.Println("Exiting", err)
+		return
+	}
+	state.updateInterest()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
+	for {
+		err := state.refreshInterest()
+		if err == nil {
+			err = state.updateChoke()
+		}
+		if err == nil {
+			err = state.fillRequests()
+		}
 		if err != nil {
 			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
 			return
 		}
 
-		err = checkIntegrity(pw, buf)
+		if len(state.uploads) > 0 {
+			// Serve a queued block, but handle what is already waiting
+			// first so a Cancel, the periodic checks and stopping can
+			// still take effect
+			select {
+			case msg := <-msgs:
+				err = state.handleMessage(msg)
+			case err = <-errs:
+			case now := <-ticker.C:
+				err = state.tick(now)
+			case <-done:
+				return
+			default:
+				err = state.sendUpload()
+			}
+		} else {
+			select {
+			case msg := <-msgs:
+				err = state.handleMessage(msg)
+			case err = <-errs:
+			case <-pt.wait():
+			case <-state.stored:
+			case now := <-ticker.C:
+				err = state.tick(now)
+			case <-done:
+				return
+			}
+		}
 		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
-			continue
+			log.Println("Exiting", err)
+			return
 		}
+		if pt.banned(c) {
+			log.Printf("Disconnecting %s after %d failed pieces\n", c, maxHashFailures)
+			return
+		}
+	}
+}
+
+// tick samples the peer's rates, sends PEX and drops the peer if it stopped
+// sending requested blocks or neither side has been interested for long.
+func (state *peerState) tick(now time.Time) error {
+	c, pt := state.client, state.tracker
+	state.pipeline.sample(now)
+	pt.setPex(c, state.pexInfo())
+	err := state.sendPex(now)
+	if err == nil && pt.backlog(c) > 0 && time.Since(state.lastBlock) > requestTimeout {
+		err = fmt.Errorf("no block received from %s for %s", c, requestTimeout)
+	}
+	if c.AmInterested || c.PeerInterested {
+		state.idleSince = now
+	} else if err == nil && now.Sub(state.idleSince) > idleTimeout {
+		err = fmt.Errorf("neither we nor %s have been interested for %s", c, idleTimeout)
+	}
+	return err
+}
 
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+// PeerStats returns the current transfer state of every connected peer
+// while a download is running.
+func (t *Torrent) PeerStats() []PeerStats {
+	if t.tracker == nil {
+		return nil
 	}
+	return t.tracker.stats()
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -200,88 +638,250 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
+func (t *Torrent) listenPort() uint16 {
+	if t.ListenPort != 0 {
+		return t.ListenPort
+	}
+	return Port
+}
+
+// init sets up the download state shared by Download and readers.
+func (t *Torrent) init() {
+	t.initOnce.Do(func() {
+		queue := make([]*pieceWork, 0, t.NumPieces())
+		for index := range t.NumPieces() {
+			queue = append(queue, &pieceWork{index, t.calculatePieceSize(index)})
+		}
+
+		t.extensions = &peer.Extensions{
+			Version:     clientVersion,
+			Port:        int(t.listenPort()),
+			MaxRequests: maxUploadQueue,
+			V2:          len(t.PiecesV2) > 0,
+		}
+		if !t.Private {
+			t.extensions.Register(&pexExtension{torrent: t})
+		}
+		t.tracker = newPieceTracker(queue)
+		t.tracker.sequential = t.Sequential
+		t.store = newPieceStore(t.Length, t.NumPieces(), t.files)
+		t.results = make(chan *pieceResult)
+
+		go t.runChoker()
+	})
+}
+
+func (t *Torrent) runChoker() {
+	newChoker(t.tracker, t.UploadSlots).run(func() bool {
+		return t.store.count() == t.NumPieces()
+	})
+}
+
+// startRun begins downloading or seeding, after an earlier run if there
+// was one. It returns the channel closed when the run stops.
+func (t *Torrent) startRun() <-chan struct{} {
+	t.init()
+	if t.tracker.restart() {
+		go t.runChoker() // the last one stopped with its run
+	}
+	return t.tracker.stopped()
+}
+
+// reserveConn claims one of the torrent's connection slots. Local peers
+// may take MaxLocalConns slots past the limit.
+func (t *Torrent) reserveConn(local bool) bool {
+	limit := int32(t.MaxConns)
+	if limit == 0 {
+		limit = DefaultMaxConns
+	}
+	if local {
+		limit += MaxLocalConns
+	}
+	for {
+		n := t.conns.Load()
+		if n >= limit {
+			return false
+		}
+		if t.conns.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (t *Torrent) releaseConn() {
+	t.conns.Add(-1)
+}
+
 func (t *Torrent) Download() ([]byte, error) {
-	log.Println("Starting download for", t.Name)
+	return t.DownloadContext(context.Background())
+}
 
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- &pieceWork{index, hash, length}
+// DownloadContext is like Download but gives up when ctx is done,
+// disconnecting from every peer. The verified pieces are kept.
+func (t *Torrent) DownloadContext(ctx context.Context) ([]byte, error) {
+	if err := t.download(ctx); err != nil {
+		return nil, err
 	}
+	return t.store.bytes()
+}
+
+// download runs until every piece is stored or ctx is done.
+func (t *Torrent) download(ctx context.Context) error {
+	log.Println("Starting download for", t.Name)
+
+	t.startRun()
+	pt := t.tracker
+	defer pt.stop()
+	defer t.startLSD()()
 
 	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+	t.AddPeers(t.Peers)
+	if hashes := t.infoHashes(); len(hashes) > 1 {
+		t.addPeers(t.peersV2, hashes[1], false)
 	}
-
-	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		res := <-results
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
+	go t.runDHT()
+	go t.runWebSeeds()
+
+	// Collect results until every piece is stored
+	donePieces := t.store.count()
+	complete := donePieces == t.NumPieces()
+	for donePieces < t.NumPieces() {
+		var res *pieceResult
+		select {
+		case res = <-t.results:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		begin, _ := t.calculateBoundsForPiece(res.index)
+		if err := t.store.put(res.index, begin, res.buf); err != nil {
+			return fmt.Errorf("failed to store piece #%d: %w", res.index, err)
+		}
+		pt.broadcastHave(res.index)
 		donePieces++
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+		percent := float64(donePieces) / float64(t.NumPieces()) * 100
+		log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, pt.numPeers())
 	}
-	close(workQueue)
 
-	return buf, nil
+	if !complete {
+		// Trackers count completions, so only a finished download reports one
+		go func() {
+			if _, err := t.announce("completed"); err != nil {
+				log.Printf("Announce failed: %v", err)
+			}
+		}()
+	}
+	return nil
 }
 
 func Open(path string) (*Torrent, error) {
-	file, err := torrent.Open(path)
+	t, err := Load(path)
 	if err != nil {
 		return nil, err
 	}
 
-	peerID, err := generatePeerID()
+	if err := t.RequestPeers(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// RequestPeers asks the tracker for peers and stores them in t.Peers.
+func (t *Torrent) RequestPeers() error {
+	c, err := t.trackerClient()
+	if err != nil {
+		return err
+	}
+	resp, peersV2, err := t.announceSwarms(c, torrent.Announce{Left: int64(t.Length), IPv6: t.announcedIPv6()})
+	if err != nil {
+		return err
+	}
+	t.Peers = resp.Peers
+	t.peersV2 = peersV2
+	return nil
+}
+
+// announcedIPv6 returns the address reported to trackers so IPv6 peers can
+// reach us: a global IPv6 address of this host, if it has one. Nothing is
+// reported through a proxy, which is meant to hide our addresses.
+func (t *Torrent) announcedIPv6() net.IP {
+	if t.Proxy != nil || t.ProxyOnly {
+		return nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip := ipnet.IP; ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Load reads a torrent file without contacting the tracker.
+func Load(path string) (*Torrent, error) {
+	return LoadWith(path, nil)
+}
+
+// LoadWith is like Load but downloads torrent files given by URL with
+// httpClient, so they can be fetched through a proxy.
+func LoadWith(path string, httpClient *http.Client) (*Torrent, error) {
+	file, err := torrent.OpenWith(path, httpClient)
 	if err != nil {
 		return nil, err
 	}
 
-	peers, err := requestPeers(file, peerID, Port)
+	peerID, err := generatePeerID()
 	if err != nil {
 		return nil, err
 	}
 
 	torrent := Torrent{
-		Peers:       peers,
 		PeerID:      peerID,
 		InfoHash:    file.InfoHash,
 		PieceHashes: file.PieceHashes,
+		PiecesV2:    file.PiecesV2,
+		InfoHashV2:  file.InfoHashV2,
 		PieceLength: file.PieceLength,
 		Length:      file.Length,
 		Name:        file.Name,
+		Private:     file.Private,
+		Files:       file.Files,
+		WebSeeds:    file.URLList,
+		HTTPSeeds:   file.HTTPSeeds,
+		file:        file,
 	}
 
 	return &torrent, nil
 }
 
-func requestPeers(t *torrent.TorrentFile, peerID [20]byte, port uint16) ([]torrent.Peer, error) {
-	resp, err := torrent.RequestPeers(t, peerID, port)
-	if err != nil {
-		return nil, err
-	}
-
-	return resp.Peers, nil
-}
-
 func generatePeerID() ([20]byte, error) {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	return peerID, err
 }
 
+// DownloadToFile downloads the content to path, or to standard output if
+// path is empty. The files of a multi-file torrent are stored in the
+// directory path.
 func (t *Torrent) DownloadToFile(path string) error {
 	var f *os.File
 	var err error
 
+	if path != "" && len(t.Files) > 0 {
+		buf, err := t.Download()
+		if err != nil {
+			return err
+		}
+		return t.writeFiles(path, buf)
+	}
+
 	if path == "" {
 		f = os.Stdout
 	} else {
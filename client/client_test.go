@@ -0,0 +1,267 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+// testSeeder is a minimal peer listening on loopback that has every piece of
+// data and answers requests after an optional delay.
+type testSeeder struct {
+	ln           net.Listener
+	data         []byte
+	pieceLength  int
+	infoHash     [20]byte
+	connectDelay time.Duration
+	replyDelay   time.Duration
+	pieceDelay   map[int]time.Duration // overrides replyDelay for some pieces
+
+	mu       sync.Mutex
+	requests []*peer.Message
+	cancels  []*peer.Message
+}
+
+func newTestSeeder(t *testing.T, data []byte, pieceLength int, infoHash [20]byte) *testSeeder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &testSeeder{ln: ln, data: data, pieceLength: pieceLength, infoHash: infoHash}
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *testSeeder) start() {
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+}
+
+func (s *testSeeder) addr() torrent.Peer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := peer.ReadHandshake(conn); err != nil {
+		return
+	}
+	time.Sleep(s.connectDelay)
+
+	var peerID [20]byte
+	copy(peerID[:], "-TS0001-testseeder00")
+	var writeMu sync.Mutex
+	write := func(buf []byte) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.Write(buf)
+	}
+
+	numPieces := (len(s.data) + s.pieceLength - 1) / s.pieceLength
+	bitfield := make(peer.Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bitfield.SetPiece(i)
+	}
+	write(peer.NewHandshake(s.infoHash, peerID).Serialize())
+	write((&peer.Message{ID: peer.MsgBitfield, Payload: bitfield}).Serialize())
+	write((&peer.Message{ID: peer.MsgUnchoke}).Serialize())
+
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case peer.MsgRequest:
+			s.mu.Lock()
+			s.requests = append(s.requests, msg)
+			s.mu.Unlock()
+
+			index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+			begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+			length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+			offset := index*s.pieceLength + begin
+			block := s.data[offset : offset+length]
+			delay, ok := s.pieceDelay[index]
+			if !ok {
+				delay = s.replyDelay
+			}
+			go func() {
+				time.Sleep(delay)
+				write(peer.NewPieceMessage(index, begin, block).Serialize())
+			}()
+		case peer.MsgCancel:
+			s.mu.Lock()
+			s.cancels = append(s.cancels, msg)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *testSeeder) numRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func (s *testSeeder) numCancels() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cancels)
+}
+
+func newTestTorrent(data []byte, pieceLength int) *Torrent {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+
+	t := &Torrent{
+		PieceHashes: hashes,
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Name:        "test",
+	}
+	copy(t.InfoHash[:], "test-info-hash-12345")
+	copy(t.PeerID[:], "-TC0001-testclient00")
+	return t
+}
+
+func newTestData(length int) []byte {
+	data := make([]byte, length)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestEndgameSlowPeerDoesNotDelayCompletion(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3*pieceLength + 1000)
+	tor := newTestTorrent(data, pieceLength)
+
+	// The slow peer connects first so it is guaranteed to hold a piece, but
+	// would not deliver it before the 30 second piece deadline.
+	slow := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	slow.replyDelay = time.Minute
+	fast := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	fast.connectDelay = 200 * time.Millisecond
+	slow.start()
+	fast.start()
+	tor.Peers = []torrent.Peer{slow.addr(), fast.addr()}
+
+	type result struct {
+		buf []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buf, err := tor.Download()
+		done <- result{buf, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			t.Fatalf("Download failed: %v", res.err)
+		}
+		if !bytes.Equal(res.buf, data) {
+			t.Errorf("Downloaded data does not match")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download was held up by the slow peer")
+	}
+
+	if slow.numRequests() == 0 {
+		t.Fatal("Expected the slow peer to be asked for a piece")
+	}
+
+	// Cancels are sent as soon as the fast peer delivers the duplicate blocks
+	deadline := time.Now().Add(time.Second)
+	for slow.numCancels() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if slow.numCancels() == 0 {
+		t.Error("Expected the slow peer to receive Cancel messages")
+	}
+	if fast.numCancels() != 0 {
+		t.Errorf("Expected no Cancel messages for the fast peer, got %d", fast.numCancels())
+	}
+}
+
+// waitForMessage reads from conn until a message with the given ID arrives
+// or timeout passes.
+func waitForMessage(conn net.Conn, id peer.MessageID, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			return false
+		}
+		if msg != nil && msg.ID == id {
+			return true
+		}
+	}
+}
+
+func TestInterestFollowsMissingPieces(t *testing.T) {
+	data := newTestData(2 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	l := newTestListener(t, tor)
+	tor.store.put(0, 0, data[:MaxBlockSize])
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// The peer only has the piece we already have
+	var peerID [20]byte
+	copy(peerID[:], "-TR0001-remotepeer00")
+	conn.Write(peer.NewHandshake(tor.InfoHash, peerID).Serialize())
+	bitfield := make(peer.Bitfield, 1)
+	bitfield.SetPiece(0)
+	conn.Write((&peer.Message{ID: peer.MsgBitfield, Payload: bitfield}).Serialize())
+	if _, err := peer.ReadHandshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if waitForMessage(conn, peer.MsgInterested, 200*time.Millisecond) {
+		t.Fatal("Expected no interest in a peer without missing pieces")
+	}
+
+	conn.Write(peer.NewHaveMessage(1).Serialize())
+	if !waitForMessage(conn, peer.MsgInterested, time.Second) {
+		t.Fatal("Expected interest after the peer announced a missing piece")
+	}
+
+	tor.store.put(1, MaxBlockSize, data[MaxBlockSize:])
+	if !waitForMessage(conn, peer.MsgNotInterested, time.Second) {
+		t.Error("Expected NotInterested once the peer has nothing left for us")
+	}
+}
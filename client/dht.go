@@ -0,0 +1,37 @@
+package client
+
+import (
+	"log"
+	"time"
+)
+
+// How often the torrent is announced to the DHT while downloading or
+// seeding.
+const dhtAnnounceInterval = 15 * time.Minute
+
+// runDHT announces the torrent to the DHT and connects to the peers found
+// there, until the download or seeding stops.
+func (t *Torrent) runDHT() {
+	if t.DHT == nil || t.Private || t.ProxyOnly {
+		return
+	}
+	done := t.tracker.stopped()
+	for {
+		for _, infoHash := range t.infoHashes() {
+			peers, err := t.DHT.Announce(infoHash, int(t.listenPort()))
+			if err != nil {
+				log.Printf("DHT announce failed: %v", err)
+			}
+			if len(peers) > 0 {
+				log.Printf("Found %d peers in the DHT", len(peers))
+				t.addPeers(peers, infoHash, false)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(dhtAnnounceInterval):
+		}
+	}
+}
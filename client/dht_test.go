@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"torrent-client/dht"
+)
+
+func newTestDHTNode(t *testing.T, bootstrap ...string) *dht.Server {
+	s, err := dht.Listen("127.0.0.1:0", dht.Config{BootstrapNodes: bootstrap, QueryTimeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("DHT Listen failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if len(bootstrap) > 0 {
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestDownloadFindsPeersInDHT(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.start()
+
+	root := newTestDHTNode(t)
+	announcer := newTestDHTNode(t, root.Addr().String())
+	if _, err := announcer.Announce(tor.InfoHash, int(seeder.addr().Port)); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+
+	// The torrent has no tracker peers, only the DHT
+	tor.DHT = newTestDHTNode(t, root.Addr().String())
+	done := make(chan []byte, 1)
+	go func() {
+		buf, _ := tor.Download()
+		done <- buf
+	}()
+
+	select {
+	case buf := <-done:
+		if !bytes.Equal(buf, data) {
+			t.Error("Downloaded data does not match")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download did not complete")
+	}
+}
+
+func TestPrivateTorrentSkipsDHT(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.Private = true
+	root := newTestDHTNode(t)
+	tor.DHT = newTestDHTNode(t, root.Addr().String())
+	tor.init()
+
+	finished := make(chan struct{})
+	go func() {
+		tor.runDHT()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Expected runDHT to return at once for a private torrent")
+	}
+	if peers := root.GetPeers(tor.InfoHash); len(peers) != 0 {
+		t.Errorf("Expected no announced peers, got %d", len(peers))
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"sort"
+
+	"torrent-client/peer"
+)
+
+const (
+	// Number of pieces a peer may request while we choke it, if it
+	// supports the fast extension.
+	allowedFastCount = 10
+	// Number of allowed fast pieces accepted from a peer. Any more are
+	// ignored, so a peer cannot have us track every piece.
+	maxAllowedFast = 2 * allowedFastCount
+	// Number of pieces suggested to a peer when it becomes interested.
+	maxSuggestions = 3
+)
+
+// sendAvailability announces our pieces. With the fast extension a complete
+// or empty store is announced with HaveAll or HaveNone, and the peer is told
+// which pieces it may request while choked.
+func (state *peerState) sendAvailability() error {
+	c := state.client
+	t := state.torrent
+	if !c.SupportsFast() {
+		return c.SendBitfield(t.store.bitfield())
+	}
+
+	var err error
+	switch t.store.count() {
+	case t.NumPieces():
+		err = c.SendHaveAll()
+	case 0:
+		err = c.SendHaveNone()
+	default:
+		err = c.SendBitfield(t.store.bitfield())
+	}
+	if err != nil {
+		return err
+	}
+
+	addr := c.Addr()
+	state.allowedFast = make(map[int]bool)
+	for _, index := range peer.AllowedFastSet(addr.IP, t.InfoHash, t.NumPieces(), allowedFastCount) {
+		state.allowedFast[index] = true
+		if t.store.has(index) {
+			if err := c.SendAllowedFast(index); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addPieces records pieces the peer announced with a bitfield or HaveAll,
+// and re-evaluates our interest.
+func (state *peerState) addPieces(bf peer.Bitfield) error {
+	c := state.client
+	var added []int
+	for index := range state.torrent.NumPieces() {
+		if bf.HasPiece(index) && !c.Bitfield.HasPiece(index) {
+			c.Bitfield.SetPiece(index)
+			added = append(added, index)
+		}
+	}
+	state.tracker.peerHas(c, added...)
+	return state.updateInterest()
+}
+
+// allPieces returns a bitfield with every piece of the torrent set.
+func (t *Torrent) allPieces() peer.Bitfield {
+	bf := make(peer.Bitfield, (t.NumPieces()+7)/8)
+	for index := range t.NumPieces() {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+// suggestPieces points a newly interested peer to pieces we have that it
+// lacks and that are rarest among our peers, to spread them in the swarm.
+func (state *peerState) suggestPieces() error {
+	c := state.client
+	t := state.torrent
+	var candidates []int
+	for index := range t.NumPieces() {
+		if t.store.has(index) && !c.Bitfield.HasPiece(index) {
+			candidates = append(candidates, index)
+		}
+	}
+	for _, index := range state.tracker.rarest(candidates, maxSuggestions) {
+		if err := c.SendSuggest(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rarest returns up to n of the given pieces that the fewest connected peers
+// have.
+func (pt *pieceTracker) rarest(pieces []int, n int) []int {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	sort.SliceStable(pieces, func(i, j int) bool {
+		return pt.availability[pieces[i]] < pt.availability[pieces[j]]
+	})
+	if len(pieces) > n {
+		pieces = pieces[:n]
+	}
+	return pieces
+}
+
+// suggest records that c suggested we download a piece from it. Suggested
+// pieces are started before the rarest ones.
+func (pt *pieceTracker) suggest(c *peer.Client, index int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	info, ok := pt.peers[c]
+	if !ok || index < 0 || index >= len(pt.availability) {
+		return
+	}
+	for _, suggested := range info.suggested {
+		if suggested == index {
+			return
+		}
+	}
+	info.suggested = append(info.suggested, index)
+}
+
+// reject releases a request that c refused to serve, so the block can be
+// requested again right away.
+func (pt *pieceTracker) reject(c source, req blockRequest) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if _, ok := pt.requests[c][req]; !ok {
+		return
+	}
+	delete(pt.requests[c], req)
+	if ap, ok := pt.active[req.index]; ok {
+		delete(ap.blocks[req.begin/MaxBlockSize].requested, c)
+	}
+	pt.notify()
+}
+
+// mayRequest reports whether blocks of index can be requested from c: a
+// peer must have the piece and, while it chokes us, allow it to be
+// requested fast. Web seeds have every piece.
+func mayRequest(c source, index int) bool {
+	p, ok := c.(*peer.Client)
+	if !ok {
+		return true
+	}
+	return p.Bitfield.HasPiece(index) && (!p.Choked || p.AllowedFast[index])
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+func TestRejectReleasesBlock(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(2, MaxBlockSize))
+	a, b := newTestClient(2), newTestClient(2)
+
+	req := mustReserve(t, pt, a)
+	pt.reject(a, req)
+	if pt.backlog(a) != 0 {
+		t.Errorf("Expected no requests left on a, got %d", pt.backlog(a))
+	}
+	// Outside of endgame, the block is only handed out again once released
+	if got := mustReserve(t, pt, b); got != req {
+		t.Errorf("Expected the rejected block %v, got %v", req, got)
+	}
+}
+
+func TestSuggestedPieceStartsFirst(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(4, MaxBlockSize))
+	c := newTestClient(4)
+	pt.addPeer(c, newPipeline(time.Now()))
+
+	pt.suggest(c, 3)
+	if req := mustReserve(t, pt, c); req.index != 3 {
+		t.Errorf("Expected the suggested piece 3, got %d", req.index)
+	}
+}
+
+func TestChokedPeerOnlyServesAllowedFastPieces(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(4, MaxBlockSize))
+	c := newTestClient(4)
+	c.Choked = true
+	if _, ok := pt.reserve(c); ok {
+		t.Fatal("Expected nothing to be requested from a choking peer")
+	}
+
+	c.AllowedFast = map[int]bool{2: true}
+	if req := mustReserve(t, pt, c); req.index != 2 {
+		t.Errorf("Expected allowed fast piece 2, got %d", req.index)
+	}
+	if _, ok := pt.reserve(c); ok {
+		t.Error("Expected only the allowed fast piece to be requested")
+	}
+}
+
+func TestAllowedFastPiecesAreCapped(t *testing.T) {
+	tor := newTestTorrent(newTestData(100*MaxBlockSize), MaxBlockSize)
+	state := peerState{torrent: tor, client: &peer.Client{}}
+	for index := range tor.NumPieces() + 1 {
+		msg := peer.NewHaveMessage(index)
+		msg.ID = peer.MsgAllowedFast
+		if err := state.handleMessage(msg); err != nil {
+			t.Fatalf("handleMessage failed: %v", err)
+		}
+	}
+	if n := len(state.client.AllowedFast); n != maxAllowedFast {
+		t.Errorf("Expected %d allowed fast pieces, got %d", maxAllowedFast, n)
+	}
+}
+
+func TestChokingSeederServesAllowedFastPieces(t *testing.T) {
+	data := newTestData(20 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	if _, err := tor.LoadData(writeTestData(t, tor.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l := newTestListener(t, tor)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var peerID [20]byte
+	copy(peerID[:], "-TF0001-fastpeer0000")
+	hs := peer.NewHandshake(tor.InfoHash, peerID)
+	hs.Reserved.SetBit(peer.BitFast)
+	conn.Write(hs.Serialize())
+	conn.Write((&peer.Message{ID: peer.MsgHaveNone}).Serialize())
+	if _, err := peer.ReadHandshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	expected := peer.AllowedFastSet(net.IPv4(127, 0, 0, 1), tor.InfoHash, len(tor.PieceHashes), allowedFastCount)
+	allowed := make(map[int]bool)
+	haveAll := false
+	for len(allowed) < len(expected) {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		switch {
+		case msg == nil:
+		case msg.ID == peer.MsgHaveAll:
+			haveAll = true
+		case msg.ID == peer.MsgAllowedFast:
+			index, _ := peer.ParseHaveMessage(msg.Payload)
+			allowed[index] = true
+		}
+	}
+	if !haveAll {
+		t.Error("Expected a complete seeder to send HaveAll")
+	}
+	for _, index := range expected {
+		if !allowed[index] {
+			t.Errorf("Expected piece %d to be allowed fast", index)
+		}
+	}
+
+	notAllowed := 0
+	for allowed[notAllowed] {
+		notAllowed++
+	}
+	conn.Write(peer.NewRequestMessage(notAllowed, 0, MaxBlockSize).Serialize())
+	conn.Write(peer.NewRequestMessage(expected[0], 0, MaxBlockSize).Serialize())
+
+	gotReject, gotPiece := false, false
+	for !gotReject || !gotPiece {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		switch {
+		case msg == nil:
+		case msg.ID == peer.MsgReject:
+			index, _, _, _ := peer.ParseRequestMessage(msg.Payload)
+			if index != notAllowed {
+				t.Errorf("Expected piece %d to be rejected, got %d", notAllowed, index)
+			}
+			gotReject = true
+		case msg.ID == peer.MsgPiece:
+			_, block, err := peer.ParsePieceMessage(expected[0], msg.Payload)
+			if err != nil {
+				t.Fatalf("Unexpected piece: %v", err)
+			}
+			if !bytes.Equal(block, data[expected[0]*MaxBlockSize:(expected[0]+1)*MaxBlockSize]) {
+				t.Error("Allowed fast block does not match")
+			}
+			gotPiece = true
+		case msg.ID == peer.MsgUnchoke:
+			t.Fatal("Expected the peer to stay choked")
+		}
+	}
+}
+
+func TestClientsConnectWithoutWaitingForBitfield(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3 * pieceLength)
+	seeder := newTestTorrent(data, pieceLength)
+	if _, err := seeder.LoadData(writeTestData(t, seeder.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l := newTestListener(t, seeder)
+
+	leecher := newTestTorrent(data, pieceLength)
+	copy(leecher.PeerID[:], "-TC0001-testclient01")
+	addr := l.Addr().(*net.TCPAddr)
+	leecher.Peers = []torrent.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+
+	start := time.Now()
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	// Waiting for each other's bitfield would stall for availabilityTimeout
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Download took %s", elapsed)
+	}
+}
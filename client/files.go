@@ -0,0 +1,217 @@
+package client
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileRange is the part of one file covered by a span of the content.
+type fileRange struct {
+	file   int
+	offset int64
+	length int
+}
+
+// fileLengths returns the length of each file of the torrent. A single-file
+// torrent is one file.
+func (t *Torrent) fileLengths() []int {
+	if len(t.Files) == 0 {
+		return []int{t.Length}
+	}
+	lengths := make([]int, len(t.Files))
+	for i, f := range t.Files {
+		lengths[i] = f.Length
+	}
+	return lengths
+}
+
+// fileRanges maps length bytes of content starting at off onto the files
+// they are stored in. Pieces may span several files.
+func (t *Torrent) fileRanges(off, length int) []fileRange {
+	var ranges []fileRange
+	start := 0
+	for i, size := range t.fileLengths() {
+		end := start + size
+		if length > 0 && off < end {
+			n := min(end-off, length)
+			ranges = append(ranges, fileRange{i, int64(off - start), n})
+			off += n
+			length -= n
+		}
+		start = end
+	}
+	return ranges
+}
+
+// filePath returns where file i of a multi-file torrent is stored below dir.
+func (t *Torrent) filePath(dir string, i int) string {
+	return filepath.Join(append([]string{dir}, t.Files[i].Path...)...)
+}
+
+// writeFiles stores the content of a multi-file torrent as its files below
+// dir, leaving out padding files.
+func (t *Torrent) writeFiles(dir string, content []byte) error {
+	off := 0
+	for i, f := range t.Files {
+		if f.Padding {
+			off += f.Length
+			continue
+		}
+		path := t.filePath(dir, i)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content[off:off+f.Length], 0644); err != nil {
+			return err
+		}
+		off += f.Length
+	}
+	return nil
+}
+
+// fileSet reads and writes the content of a torrent in its files: the file
+// root for a single file, or the files below root. Missing files read as if
+// the content ended there, so only the pieces they are part of fail to
+// verify. Padding files read as zeros and are never written. Files are
+// opened when first used.
+type fileSet struct {
+	t    *Torrent
+	root string
+	disk func(func() error) error // runs each access, if set
+
+	mu      sync.Mutex
+	readers []*os.File
+	writers []*os.File
+	closed  bool
+}
+
+func (t *Torrent) openFiles(root string) *fileSet {
+	n := len(t.fileLengths())
+	return &fileSet{t: t, root: root, readers: make([]*os.File, n), writers: make([]*os.File, n)}
+}
+
+func (fs *fileSet) padding(i int) bool {
+	return len(fs.t.Files) > 0 && fs.t.Files[i].Padding
+}
+
+func (fs *fileSet) path(i int) string {
+	if len(fs.t.Files) == 0 {
+		return fs.root
+	}
+	return fs.t.filePath(fs.root, i)
+}
+
+// reader returns file i for reading, or nil if it cannot be opened.
+func (fs *fileSet) reader(i int) *os.File {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f := fs.writers[i]; f != nil || fs.closed {
+		return f
+	}
+	if fs.readers[i] == nil {
+		f, err := os.Open(fs.path(i))
+		if err != nil {
+			return nil
+		}
+		fs.readers[i] = f
+	}
+	return fs.readers[i]
+}
+
+// writer returns file i for writing, creating it if needed.
+func (fs *fileSet) writer(i int) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return nil, os.ErrClosed
+	}
+	if fs.writers[i] == nil {
+		path := fs.path(i)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		fs.writers[i] = f
+	}
+	return fs.writers[i], nil
+}
+
+func (fs *fileSet) run(f func() error) error {
+	if fs.disk == nil {
+		return f()
+	}
+	return fs.disk(f)
+}
+
+func (fs *fileSet) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := fs.run(func() error {
+		for _, r := range fs.t.fileRanges(int(off), len(p)) {
+			if fs.padding(r.file) {
+				clear(p[n : n+r.length])
+				n += r.length
+				continue
+			}
+			f := fs.reader(r.file)
+			if f == nil {
+				return io.EOF
+			}
+			read, err := f.ReadAt(p[n:n+r.length], r.offset)
+			n += read
+			if err != nil {
+				return err
+			}
+		}
+		if n < len(p) {
+			return io.EOF
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (fs *fileSet) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	err := fs.run(func() error {
+		for _, r := range fs.t.fileRanges(int(off), len(p)) {
+			if fs.padding(r.file) {
+				n += r.length
+				continue
+			}
+			f, err := fs.writer(r.file)
+			if err != nil {
+				return err
+			}
+			written, err := f.WriteAt(p[n:n+r.length], r.offset)
+			n += written
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (fs *fileSet) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closed = true
+	var err error
+	for _, files := range [][]*os.File{fs.readers, fs.writers} {
+		for i, f := range files {
+			if f != nil {
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				files[i] = nil
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"torrent-client/torrent"
+)
+
+// newTestMultiFileTorrent splits data into files of the given lengths.
+func newTestMultiFileTorrent(data []byte, pieceLength int, lengths ...int) *Torrent {
+	tor := newTestTorrent(data, pieceLength)
+	for i, length := range lengths {
+		tor.Files = append(tor.Files, torrent.File{
+			Length: length,
+			Path:   []string{"dir", string(rune('a' + i))},
+		})
+	}
+	return tor
+}
+
+func TestFileRanges(t *testing.T) {
+	tor := newTestMultiFileTorrent(newTestData(100), 50, 30, 0, 50, 20)
+
+	tests := []struct {
+		off, length int
+		expected    []fileRange
+	}{
+		{0, 10, []fileRange{{0, 0, 10}}},
+		{20, 30, []fileRange{{0, 20, 10}, {2, 0, 20}}},
+		{50, 50, []fileRange{{2, 20, 30}, {3, 0, 20}}},
+		{0, 100, []fileRange{{0, 0, 30}, {2, 0, 50}, {3, 0, 20}}},
+	}
+	for _, tt := range tests {
+		ranges := tor.fileRanges(tt.off, tt.length)
+		if !reflect.DeepEqual(ranges, tt.expected) {
+			t.Errorf("fileRanges(%d, %d): expected %v, got %v", tt.off, tt.length, tt.expected, ranges)
+		}
+	}
+
+	single := newTestTorrent(newTestData(100), 50)
+	if ranges := single.fileRanges(40, 20); !reflect.DeepEqual(ranges, []fileRange{{0, 40, 20}}) {
+		t.Errorf("Expected a single-file torrent to be one file, got %v", ranges)
+	}
+}
+
+func TestWriteAndLoadFiles(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data := newTestData(3*pieceLength + 100)
+	lengths := []int{1000, pieceLength, 0, 2*pieceLength - 900}
+	tor := newTestMultiFileTorrent(data, pieceLength, lengths...)
+
+	dir := filepath.Join(t.TempDir(), tor.Name)
+	if err := tor.writeFiles(dir, data); err != nil {
+		t.Fatalf("writeFiles failed: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "dir", "b"))
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !bytes.Equal(got, data[1000:1000+pieceLength]) {
+		t.Error("File b does not hold its part of the content")
+	}
+
+	// Both the torrent's directory and its parent can be loaded
+	for _, path := range []string{dir, filepath.Dir(dir)} {
+		seeder := newTestMultiFileTorrent(data, pieceLength, lengths...)
+		verified, err := seeder.LoadData(path)
+		if err != nil {
+			t.Fatalf("LoadData failed: %v", err)
+		}
+		if verified != 4 {
+			t.Errorf("Expected 4 verified pieces, got %d", verified)
+		}
+	}
+
+	// A missing file only fails the pieces it is part of
+	if err := os.Remove(filepath.Join(dir, "dir", "b")); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	seeder := newTestMultiFileTorrent(data, pieceLength, lengths...)
+	verified, err := seeder.LoadData(dir)
+	if err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	if verified != 2 {
+		t.Errorf("Expected 2 verified pieces, got %d", verified)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// httpFile is a file of the torrent as served over HTTP.
+type httpFile struct {
+	name   string
+	off    int64
+	length int64
+}
+
+// Handler returns an HTTP handler that serves the content of the torrent at
+// /<name>, or each file of a multi-file torrent at /<name>/<path>, with a
+// listing at /. Range requests are supported and only the pieces needed for
+// a response are waited for, so content can be fetched while the torrent is
+// still downloading.
+func (t *Torrent) Handler() http.Handler {
+	return http.HandlerFunc(t.serveHTTP)
+}
+
+// httpFiles returns the files served by Handler. Padding files are left
+// out.
+func (t *Torrent) httpFiles() []httpFile {
+	if len(t.Files) == 0 {
+		return []httpFile{{name: t.Name, length: int64(t.Length)}}
+	}
+	var files []httpFile
+	var off int64
+	for _, f := range t.Files {
+		if !f.Padding {
+			name := path.Join(append([]string{t.Name}, f.Path...)...)
+			files = append(files, httpFile{name, off, int64(f.Length)})
+		}
+		off += int64(f.Length)
+	}
+	return files
+}
+
+func (t *Torrent) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	files := t.httpFiles()
+	if name == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintln(w, "<pre>")
+		for _, f := range files {
+			fmt.Fprintf(w, "<a href=\"/%s\">%s</a> %d\n",
+				escapePath(f.name), html.EscapeString(f.name), f.length)
+		}
+		fmt.Fprintln(w, "</pre>")
+		return
+	}
+	for i, f := range files {
+		if f.name != name {
+			continue
+		}
+		content := t.newReader()
+		defer content.Close()
+
+		// The content never changes, so the infohash makes a strong ETag
+		w.Header().Set("ETag", fmt.Sprintf("\"%x-%d\"", t.InfoHash, i))
+		http.ServeContent(w, r, path.Base(f.name), time.Time{},
+			io.NewSectionReader(content, f.off, f.length))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// escapePath escapes each element of a slash-separated path.
+func escapePath(name string) string {
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		elems[i] = url.PathEscape(e)
+	}
+	return strings.Join(elems, "/")
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"torrent-client/torrent"
+)
+
+func newTestServer(t *testing.T, name string) (*httptest.Server, []byte) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(4*pieceLength + 77)
+	tor := newTestTorrent(data, pieceLength)
+	tor.Name = name
+
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.start()
+	tor.Peers = []torrent.Peer{seeder.addr()}
+	go tor.Download()
+
+	server := httptest.NewServer(tor.Handler())
+	t.Cleanup(server.Close)
+	return server, data
+}
+
+func TestHandlerServesWholeFile(t *testing.T) {
+	server, data := newTestServer(t, "index.html")
+
+	resp, err := http.Get(server.URL + "/index.html")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected text/html content type, got %q", ct)
+	}
+	if resp.ContentLength != int64(len(data)) {
+		t.Errorf("Expected Content-Length %d, got %d", len(data), resp.ContentLength)
+	}
+	if !bytes.Equal(body, data) {
+		t.Error("Body does not match")
+	}
+}
+
+func TestHandlerServesRange(t *testing.T) {
+	server, data := newTestServer(t, "movie.bin")
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/movie.bin", nil)
+	req.Header.Set("Range", "bytes=40000-70000")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, got %d", resp.StatusCode)
+	}
+	expectedRange := fmt.Sprintf("bytes 40000-70000/%d", len(data))
+	if cr := resp.Header.Get("Content-Range"); cr != expectedRange {
+		t.Errorf("Expected Content-Range %q, got %q", expectedRange, cr)
+	}
+	if !bytes.Equal(body, data[40000:70001]) {
+		t.Error("Body does not match requested range")
+	}
+}
+
+func TestHandlerListingAndNotFound(t *testing.T) {
+	server, _ := newTestServer(t, "my file.iso")
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `href="/my%20file.iso"`) {
+		t.Errorf("Expected listing to link the file, got %s", body)
+	}
+
+	resp, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerServesFilesOfMultiFileTorrent(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3*pieceLength + 50)
+	tor := newTestMultiFileTorrent(data, pieceLength, 40000, 0, len(data)-50000, 10000)
+	tor.Name = "album"
+	tor.Files[1] = torrent.File{Length: 10000, Path: []string{".pad", "10000"}, Padding: true}
+	tor.Files[2].Path = []string{"dir", "c.txt"}
+	tor.Files[2].Length -= 10000
+
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.start()
+	tor.Peers = []torrent.Peer{seeder.addr()}
+	go tor.Download()
+	server := httptest.NewServer(tor.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/album/dir/c.txt")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	expected := data[50000 : len(data)-10000]
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text/plain content type, got %q", ct)
+	}
+	if resp.ContentLength != int64(len(expected)) {
+		t.Errorf("Expected Content-Length %d, got %d", len(expected), resp.ContentLength)
+	}
+	if !bytes.Equal(body, expected) {
+		t.Error("Body does not match the file")
+	}
+
+	resp, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, link := range []string{`href="/album/dir/a"`, `href="/album/dir/c.txt"`, `href="/album/dir/d"`} {
+		if !strings.Contains(string(body), link) {
+			t.Errorf("Expected listing to contain %s, got %s", link, body)
+		}
+	}
+	if strings.Contains(string(body), ".pad") {
+		t.Errorf("Expected padding files not to be listed, got %s", body)
+	}
+
+	for _, name := range []string{"/album", "/album/.pad/10000"} {
+		resp, err = http.Get(server.URL + name)
+		if err != nil {
+			t.Fatalf("GET failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", name, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"torrent-client/ratelimit"
+)
+
+// busyError is returned for an HTTP seed that asked us to come back later.
+type busyError struct {
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("HTTP seed is busy for %v", e.retryAfter)
+}
+
+// getPiece downloads the requested blocks, which must be of one piece and
+// in order, from an HTTP seed (BEP 17). The seed returns the given ranges of
+// the piece one after the other.
+func (ws *webSeed) getPiece(reqs []blockRequest) ([]byte, error) {
+	u, err := url.Parse(ws.url)
+	if err != nil {
+		return nil, err
+	}
+	t := ws.torrent
+	q := u.Query()
+	q.Set("info_hash", string(t.InfoHash[:]))
+	q.Set("piece", strconv.Itoa(reqs[0].index))
+
+	// Adjacent blocks are merged into one inclusive range
+	var ranges []string
+	start, length := reqs[0].begin, 0
+	for i, req := range reqs {
+		if i > 0 {
+			if prevEnd := reqs[i-1].begin + reqs[i-1].length; prevEnd != req.begin {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", start, prevEnd-1))
+				start = req.begin
+			}
+		}
+		length += req.length
+	}
+	last := reqs[len(reqs)-1]
+	ranges = append(ranges, fmt.Sprintf("%d-%d", start, last.begin+last.length-1))
+	begin, end := t.calculateBoundsForPiece(reqs[0].index)
+	if length < end-begin {
+		q.Set("ranges", strings.Join(ranges, ","))
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ws.ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		if after, ok := retryAfter(resp); ok {
+			return nil, &busyError{after}
+		}
+		return nil, fmt.Errorf("HTTP error: %s", resp.Status)
+	default:
+		return nil, fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	buf := make([]byte, length)
+	download, _ := t.sharedLimits()
+	body := &limitedReader{resp.Body, []*ratelimit.Limiter{&t.downloadLimit, download}}
+	if _, err := io.ReadFull(body, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// retryAfter reads how long a busy HTTP seed wants us to wait: a number of
+// seconds in the body, or else in the Retry-After header.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 32))
+	for _, s := range []string{string(body), resp.Header.Get("Retry-After")} {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
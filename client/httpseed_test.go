@@ -0,0 +1,129 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// httpSeedServer serves pieces of a torrent as a BEP 17 HTTP seed.
+type httpSeedServer struct {
+	*httptest.Server
+	busy atomic.Int32 // number of requests still to answer as busy
+
+	mu       sync.Mutex
+	ranges   []string
+	requests []time.Time
+}
+
+func newHTTPSeedServer(t *testing.T, tor *Torrent, data []byte) *httpSeedServer {
+	s := &httpSeedServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		s.mu.Lock()
+		s.ranges = append(s.ranges, q.Get("ranges"))
+		s.requests = append(s.requests, time.Now())
+		s.mu.Unlock()
+
+		if s.busy.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "2")
+			return
+		}
+		index, err := strconv.Atoi(q.Get("piece"))
+		if q.Get("info_hash") != string(tor.InfoHash[:]) || err != nil || index >= len(tor.PieceHashes) {
+			http.Error(w, "unknown piece", http.StatusNotFound)
+			return
+		}
+		begin, end := tor.calculateBoundsForPiece(index)
+		piece := data[begin:end]
+		if q.Get("ranges") == "" {
+			w.Write(piece)
+			return
+		}
+		for _, rng := range strings.Split(q.Get("ranges"), ",") {
+			var first, last int
+			if _, err := fmt.Sscanf(rng, "%d-%d", &first, &last); err != nil || last >= len(piece) {
+				http.Error(w, "bad range", http.StatusBadRequest)
+				return
+			}
+			w.Write(piece[first : last+1])
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestHTTPSeedDownload(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(5*pieceLength + 123)
+	tor := newTestTorrent(data, pieceLength)
+	server := newHTTPSeedServer(t, tor, data)
+	tor.HTTPSeeds = []string{server.URL + "/seed?type=bep17"}
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.requests) != len(tor.PieceHashes) {
+		t.Errorf("Expected one request per piece, got %d", len(server.requests))
+	}
+}
+
+func TestHTTPSeedRanges(t *testing.T) {
+	pieceLength := 3 * MaxBlockSize
+	data := newTestData(2 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+	server := newHTTPSeedServer(t, tor, data)
+	ws := &webSeed{url: server.URL, torrent: tor, client: server.Client(), httpSeed: true, ctx: context.Background()}
+
+	reqs := []blockRequest{
+		{1, 0, MaxBlockSize},
+		{1, 2 * MaxBlockSize, MaxBlockSize},
+	}
+	buf, err := ws.getPiece(reqs)
+	if err != nil {
+		t.Fatalf("getPiece failed: %v", err)
+	}
+	expected := append(append([]byte(nil), data[pieceLength:pieceLength+MaxBlockSize]...), data[2*pieceLength-MaxBlockSize:]...)
+	if !bytes.Equal(buf, expected) {
+		t.Error("Expected the two blocks one after the other")
+	}
+	if ranges := server.ranges[0]; ranges != "0-16383,32768-49151" {
+		t.Errorf("Expected ranges 0-16383,32768-49151, got %q", ranges)
+	}
+}
+
+func TestHTTPSeedRetryAfter(t *testing.T) {
+	data := newTestData(2 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	server := newHTTPSeedServer(t, tor, data)
+	server.busy.Store(1)
+	tor.HTTPSeeds = []string{server.URL}
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if wait := server.requests[1].Sub(server.requests[0]); wait < 2*time.Second {
+		t.Errorf("Expected the seed to be asked again after 2s, got %v", wait)
+	}
+}
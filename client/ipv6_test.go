@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"torrent-client/torrent"
+	"torrent-client/utp"
+)
+
+func skipWithoutIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	ln.Close()
+}
+
+func TestDualStackDownload(t *testing.T) {
+	skipWithoutIPv6(t)
+	data := newTestData(3 * MaxBlockSize)
+	seeder := newTestTorrent(data, MaxBlockSize)
+	if _, err := seeder.LoadData(writeTestData(t, seeder.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l, err := Listen(":0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	l.Add(seeder)
+	go l.Serve()
+	port := uint16(l.Addr().(*net.TCPAddr).Port)
+
+	s, err := utp.Listen(":0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer s.Close()
+	go l.ServeUTP(s)
+	utpPort := uint16(s.Addr().(*net.UDPAddr).Port)
+
+	tests := []struct {
+		name string
+		peer torrent.Peer
+		utp  bool
+	}{
+		{"IPv4", torrent.Peer{IP: net.IPv4(127, 0, 0, 1), Port: port}, false},
+		{"IPv6", torrent.Peer{IP: net.IPv6loopback, Port: port}, false},
+		{"IPv6 uTP", torrent.Peer{IP: net.IPv6loopback, Port: utpPort}, true},
+	}
+
+	for i, tt := range tests {
+		leecher := newTestTorrent(data, MaxBlockSize)
+		copy(leecher.PeerID[:], "-TC0001-testclient0")
+		leecher.PeerID[19] = byte('a' + i)
+		if tt.utp {
+			socket, err := utp.Listen("[::1]:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			defer socket.Close()
+			leecher.UTP = socket
+			leecher.Transport = utp.UTPOnly
+		}
+		leecher.Peers = []torrent.Peer{tt.peer}
+
+		buf, err := leecher.Download()
+		if err != nil {
+			t.Fatalf("%s: Download failed: %v", tt.name, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Errorf("%s: downloaded data does not match", tt.name)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"torrent-client/peer"
+	"torrent-client/ratelimit"
+)
+
+// Limits shared by every torrent in the process.
+var globalDownload, globalUpload ratelimit.Limiter
+
+// SetGlobalRateLimit caps the combined download and upload rates of all
+// torrents in bytes per second. 0 means unlimited.
+func SetGlobalRateLimit(download, upload int64) {
+	globalDownload.SetRate(download)
+	globalUpload.SetRate(upload)
+}
+
+// sharedLimits returns the download and upload limits the torrent shares
+// with other torrents: those of its Session, or else the process-wide ones.
+func (t *Torrent) sharedLimits() (*ratelimit.Limiter, *ratelimit.Limiter) {
+	if t.session != nil {
+		return &t.session.downloadLimit, &t.session.uploadLimit
+	}
+	return &globalDownload, &globalUpload
+}
+
+// SetRateLimit caps the download and upload rates of the torrent in bytes per
+// second. 0 means unlimited.
+func (t *Torrent) SetRateLimit(download, upload int64) {
+	t.downloadLimit.SetRate(download)
+	t.uploadLimit.SetRate(upload)
+}
+
+// SetPeerRateLimit caps the rates of each connection of the torrent,
+// including the ones already open.
+func (t *Torrent) SetPeerRateLimit(download, upload int64) {
+	t.limitMu.Lock()
+	defer t.limitMu.Unlock()
+	t.peerDownloadRate, t.peerUploadRate = download, upload
+	for _, l := range t.peerLimits {
+		l.download.SetRate(download)
+		l.upload.SetRate(upload)
+	}
+}
+
+type connLimits struct {
+	download, upload ratelimit.Limiter
+}
+
+// limitConn subjects the connection of c to the peer, torrent and global
+// limits. The returned function must be called when the connection closes.
+func (t *Torrent) limitConn(c *peer.Client) func() {
+	t.limitMu.Lock()
+	defer t.limitMu.Unlock()
+
+	l := &connLimits{}
+	l.download.SetRate(t.peerDownloadRate)
+	l.upload.SetRate(t.peerUploadRate)
+	if t.peerLimits == nil {
+		t.peerLimits = make(map[*peer.Client]*connLimits)
+	}
+	t.peerLimits[c] = l
+
+	download, upload := t.sharedLimits()
+	c.Conn = ratelimit.NewConn(c.Conn,
+		[]*ratelimit.Limiter{&l.download, &t.downloadLimit, download},
+		[]*ratelimit.Limiter{&l.upload, &t.uploadLimit, upload})
+
+	return func() {
+		t.limitMu.Lock()
+		defer t.limitMu.Unlock()
+		delete(t.peerLimits, c)
+	}
+}
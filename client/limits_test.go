@@ -0,0 +1,55 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+func TestRateLimitSlowsDownload(t *testing.T) {
+	data := newTestData(4 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	seeder := newTestSeeder(t, data, MaxBlockSize, tor.InfoHash)
+	seeder.start()
+	tor.Peers = []torrent.Peer{seeder.addr()}
+
+	// The first block fits in the burst, the other three take a second
+	tor.SetRateLimit(3*MaxBlockSize, 0)
+	start := time.Now()
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected the download to take about a second, took %s", elapsed)
+	}
+}
+
+func TestSetPeerRateLimitUpdatesOpenConnections(t *testing.T) {
+	data := newTestData(MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	tor.SetPeerRateLimit(1000, 2000)
+	l := newTestListener(t, tor)
+	if _, err := dialTestListener(t, l, tor.InfoHash, 1); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	waitForPeers(t, tor, 1)
+
+	tor.SetPeerRateLimit(5000, 0)
+
+	tor.limitMu.Lock()
+	defer tor.limitMu.Unlock()
+	if len(tor.peerLimits) != 1 {
+		t.Fatalf("Expected limits for 1 connection, got %d", len(tor.peerLimits))
+	}
+	for _, l := range tor.peerLimits {
+		if l.download.Rate() != 5000 || l.upload.Rate() != 0 {
+			t.Errorf("Expected rates 5000 and 0, got %d and %d", l.download.Rate(), l.upload.Rate())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"torrent-client/mse"
+	"torrent-client/peer"
+	"torrent-client/utp"
+)
+
+// DefaultMaxListenerConns is the default number of connections across all
+// torrents served by a Listener past which it accepts no more.
+const DefaultMaxListenerConns = 200
+
+const handshakeTimeout = 10 * time.Second
+
+// Listener accepts incoming peer connections on a single port and hands each
+// of them to the torrent whose infohash the peer asks for.
+type Listener struct {
+	// MaxConns stops the listener from accepting connections while the
+	// torrents added to it have this many, incoming and outgoing
+	// together. Outgoing connections are only bound by each torrent's
+	// MaxConns. Defaults to DefaultMaxListenerConns.
+	MaxConns int
+	// Encryption decides which incoming connections are accepted: plaintext,
+	// encrypted (MSE) or both.
+	Encryption mse.Policy
+
+	ln       net.Listener
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listen opens a TCP listener on addr, e.g. ":6881". Without a host it
+// accepts both IPv4 and IPv6 connections.
+func Listen(addr string) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, torrents: make(map[[20]byte]*Torrent)}, nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// port returns the TCP port the listener is bound to, or 0 if it has none.
+func (l *Listener) port() uint16 {
+	if l.ln == nil {
+		return 0
+	}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// Add makes the listener accept connections for t. Unless t has a
+// ListenPort already, it announces the listener's port from now on.
+func (l *Listener) Add(t *Torrent) {
+	if t.ListenPort == 0 {
+		t.ListenPort = l.port()
+	}
+	t.init()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, infoHash := range t.infoHashes() {
+		l.torrents[infoHash] = t
+	}
+}
+
+// Remove stops accepting new connections for t. It does nothing if another
+// torrent with the same infohash was added since.
+func (l *Listener) Remove(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, infoHash := range t.infoHashes() {
+		if l.torrents[infoHash] == t {
+			delete(l.torrents, infoHash)
+		}
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *Listener) Serve() error {
+	return l.serve(l.ln)
+}
+
+// ServeUTP accepts uTP connections on s until it is closed, handling them
+// like those on the TCP port. s is not closed along with the listener.
+func (l *Listener) ServeUTP(s *utp.Socket) error {
+	return l.serve(s)
+}
+
+func (l *Listener) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	conn, hs, err := l.readHandshake(conn)
+	if err != nil {
+		log.Printf("Rejecting connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	t, err := l.admit(hs)
+	if err != nil {
+		log.Printf("Rejecting connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	defer t.releaseConn()
+
+	c, err := peer.Accept(conn, hs, t.PeerID, t.extensions)
+	if err != nil {
+		log.Printf("Could not handshake with %s. Disconnecting\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	log.Printf("Accepted connection from %s\n", c)
+
+	t.runPeer(c)
+}
+
+// readHandshake reads the peer's handshake, first answering its encryption
+// handshake if it starts with one. It returns the connection to continue
+// on, which is conn itself if that fails.
+func (l *Listener) readHandshake(conn net.Conn) (net.Conn, *peer.Handshake, error) {
+	sniffed, plaintext, err := mse.Sniff(conn)
+	if err != nil {
+		return conn, nil, err
+	}
+	var skey [20]byte
+	switch {
+	case plaintext && l.Encryption == mse.Required:
+		return conn, nil, errors.New("plaintext connections are not allowed")
+	case !plaintext && l.Encryption == mse.Disabled:
+		return conn, nil, errors.New("encrypted connections are disabled")
+	case !plaintext:
+		sniffed, skey, _, err = mse.Receive(sniffed, l.infoHashes(), l.Encryption.Select)
+		if err != nil {
+			return conn, nil, fmt.Errorf("encryption handshake failed: %w", err)
+		}
+	}
+
+	hs, err := peer.ReadHandshake(sniffed)
+	if err != nil {
+		return conn, nil, err
+	}
+	if !plaintext && hs.InfoHash != skey {
+		return conn, nil, fmt.Errorf("handshake for %x on a connection encrypted for %x", hs.InfoHash, skey)
+	}
+	return sniffed, hs, nil
+}
+
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	infoHashes := make([][20]byte, 0, len(l.torrents))
+	for infoHash := range l.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+// admit finds the torrent a handshake asks for and claims a connection slot
+// on it.
+func (l *Listener) admit(hs *peer.Handshake) (*Torrent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	t, ok := l.torrents[hs.InfoHash]
+	if !ok {
+		return nil, fmt.Errorf("unknown infohash %x", hs.InfoHash)
+	}
+	if hs.PeerID == t.PeerID {
+		return nil, errors.New("connection to ourselves")
+	}
+	if t.ProxyOnly {
+		return nil, errors.New("torrent is in proxy-only mode")
+	}
+
+	limit := l.MaxConns
+	if limit == 0 {
+		limit = DefaultMaxListenerConns
+	}
+	total := 0
+	for infoHash, other := range l.torrents {
+		// Hybrid torrents are listed for both their swarms
+		if infoHash == other.InfoHash {
+			total += int(other.conns.Load())
+		}
+	}
+	if total >= limit {
+		return nil, fmt.Errorf("global connection limit of %d reached", limit)
+	}
+
+	if !t.reserveConn(false) {
+		return nil, fmt.Errorf("connection limit reached for %s", t.Name)
+	}
+	return t, nil
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/mse"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+func newTestListener(t *testing.T, torrents ...*Torrent) *Listener {
+	return newEncryptedTestListener(t, mse.Disabled, torrents...)
+}
+
+func newEncryptedTestListener(t *testing.T, policy mse.Policy, torrents ...*Torrent) *Listener {
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	l.Encryption = policy
+	for _, tor := range torrents {
+		l.Add(tor)
+	}
+	go l.Serve()
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// dialTestListener connects to l as a peer asking for infoHash and returns
+// the handshake it answers with.
+func dialTestListener(t *testing.T, l *Listener, infoHash [20]byte, numPieces int) (*peer.Handshake, error) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var peerID [20]byte
+	copy(peerID[:], "-TR0001-remotepeer00")
+	conn.Write(peer.NewHandshake(infoHash, peerID).Serialize())
+	conn.Write((&peer.Message{ID: peer.MsgBitfield, Payload: make([]byte, (numPieces+7)/8)}).Serialize())
+
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return peer.ReadHandshake(conn)
+}
+
+func waitForPeers(t *testing.T, tor *Torrent, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for tor.tracker.numPeers() != n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := tor.tracker.numPeers(); got != n {
+		t.Fatalf("Expected %d connected peers, got %d", n, got)
+	}
+}
+
+func TestListenerRoutesByInfoHash(t *testing.T) {
+	a := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	b := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	copy(b.InfoHash[:], "other-info-hash-6789")
+	l := newTestListener(t, a, b)
+
+	hs, err := dialTestListener(t, l, b.InfoHash, 1)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if hs.InfoHash != b.InfoHash {
+		t.Errorf("Expected infohash %x, got %x", b.InfoHash, hs.InfoHash)
+	}
+	if hs.PeerID != b.PeerID {
+		t.Errorf("Expected peer ID %x, got %x", b.PeerID, hs.PeerID)
+	}
+
+	waitForPeers(t, b, 1)
+	waitForPeers(t, a, 0)
+}
+
+func TestListenerRejectsUnknownInfoHash(t *testing.T) {
+	l := newTestListener(t, newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize))
+
+	var unknown [20]byte
+	copy(unknown[:], "unknown-info-hash-00")
+	if _, err := dialTestListener(t, l, unknown, 1); err == nil {
+		t.Error("Expected the connection to be rejected")
+	}
+}
+
+func TestListenerTorrentConnectionLimit(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.MaxConns = 1
+	l := newTestListener(t, tor)
+
+	if _, err := dialTestListener(t, l, tor.InfoHash, 1); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	waitForPeers(t, tor, 1)
+
+	if _, err := dialTestListener(t, l, tor.InfoHash, 1); err == nil {
+		t.Error("Expected the second connection to be rejected")
+	}
+}
+
+func TestListenerGlobalConnectionLimit(t *testing.T) {
+	a := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	b := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	copy(b.InfoHash[:], "other-info-hash-6789")
+	l := newTestListener(t, a, b)
+	l.MaxConns = 1
+
+	if _, err := dialTestListener(t, l, a.InfoHash, 1); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	waitForPeers(t, a, 1)
+
+	if _, err := dialTestListener(t, l, b.InfoHash, 1); err == nil {
+		t.Error("Expected the connection to exceed the global limit")
+	}
+}
+
+// newTestSeedTorrent returns a torrent with all of data loaded, served by a
+// listener with the given encryption policy, and a leecher for it.
+func newTestSeedTorrent(t *testing.T, data []byte, pieceLength int, policy mse.Policy) (*Torrent, *Torrent) {
+	seeder := newTestTorrent(data, pieceLength)
+	if _, err := seeder.LoadData(writeTestData(t, seeder.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l := newEncryptedTestListener(t, policy, seeder)
+
+	leecher := newTestTorrent(data, pieceLength)
+	copy(leecher.PeerID[:], "-TC0001-testclient01")
+	addr := l.Addr().(*net.TCPAddr)
+	leecher.Peers = []torrent.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	return seeder, leecher
+}
+
+func TestEncryptedDownload(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	_, leecher := newTestSeedTorrent(t, data, MaxBlockSize, mse.Required)
+	leecher.Encryption = mse.Required
+
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+}
+
+func TestPreferredEncryptionFallsBackToPlaintext(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	_, leecher := newTestSeedTorrent(t, data, MaxBlockSize, mse.Disabled)
+	leecher.Encryption = mse.Preferred
+
+	start := time.Now()
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Falling back to plaintext took %s", elapsed)
+	}
+}
+
+func TestListenerEncryptionPolicy(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	l := newEncryptedTestListener(t, mse.Required, tor)
+	if _, err := dialTestListener(t, l, tor.InfoHash, 1); err == nil {
+		t.Error("Expected a plaintext connection to be rejected")
+	}
+
+	l = newTestListener(t, tor)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := mse.Initiate(conn, tor.InfoHash, mse.CryptoRC4); err == nil {
+		t.Error("Expected an encrypted connection to be rejected")
+	}
+}
@@ -0,0 +1,26 @@
+package client
+
+import (
+	"log"
+
+	"torrent-client/torrent"
+)
+
+// startLSD announces the torrent on the local network and connects to the
+// local peers announcing it. The returned function stops announcing it.
+func (t *Torrent) startLSD() func() {
+	if t.LSD == nil || t.Private || t.ProxyOnly {
+		return func() {}
+	}
+	for _, infoHash := range t.infoHashes() {
+		t.LSD.Add(infoHash, t.listenPort(), func(p torrent.Peer) {
+			log.Printf("Found local peer %s", p)
+			t.addPeers([]torrent.Peer{p}, infoHash, true)
+		})
+	}
+	return func() {
+		for _, infoHash := range t.infoHashes() {
+			t.LSD.Remove(infoHash)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/lsd"
+	"torrent-client/torrent"
+)
+
+func TestDownloadConnectsToLocalPeersPastLimit(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(2 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+	tor.MaxConns = 1
+	tor.conns.Add(1) // the only slot is taken
+
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.start()
+
+	// Two sockets sending to each other stand in for the multicast group
+	a, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	b, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	remote := lsd.New(lsd.Group{Conn: a, Addr: b.LocalAddr().(*net.UDPAddr)})
+	defer remote.Close()
+	tor.LSD = lsd.New(lsd.Group{Conn: b, Addr: a.LocalAddr().(*net.UDPAddr)})
+	defer tor.LSD.Close()
+
+	done := make(chan []byte, 1)
+	go func() {
+		buf, _ := tor.Download()
+		done <- buf
+	}()
+	// Wait for the torrent to be registered before announcing the seeder
+	time.Sleep(100 * time.Millisecond)
+	remote.Add(tor.InfoHash, seeder.addr().Port, func(p torrent.Peer) {})
+
+	select {
+	case buf := <-done:
+		if !bytes.Equal(buf, data) {
+			t.Error("Downloaded data does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download did not complete")
+	}
+}
+
+func TestLocalPeersAreBounded(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.MaxConns = 1
+	if !tor.reserveConn(false) {
+		t.Fatal("Expected the first connection to be allowed")
+	}
+	if tor.reserveConn(false) {
+		t.Error("Expected the connection limit to be reached")
+	}
+	for i := 0; i < MaxLocalConns; i++ {
+		if !tor.reserveConn(true) {
+			t.Fatalf("Expected local connection %d to be allowed", i+1)
+		}
+	}
+	if tor.reserveConn(true) {
+		t.Errorf("Expected at most %d local connections past the limit", MaxLocalConns)
+	}
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"torrent-client/bencode"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+// Peer exchange messages are sent at most this often, and name at most
+// maxPexPeers added and dropped peers each, as BEP 11 requires. Messages
+// that arrive sooner than pexInterval less pexSlack after the last one are
+// ignored, as are the added peers past maxPexPeers.
+const (
+	pexInterval = time.Minute
+	pexSlack    = 5 * time.Second
+	maxPexPeers = 50
+)
+
+// Flags describing a peer in a PEX message.
+const (
+	pexEncryption byte = 0x01 // prefers encrypted connections
+	pexSeed       byte = 0x02 // has every piece
+	pexUTP        byte = 0x04 // supports uTP
+	pexOutgoing   byte = 0x10 // accepted our connection, so it is reachable
+)
+
+// pexPeer is a connected peer as announced to others.
+type pexPeer struct {
+	addr  torrent.Peer
+	flags byte
+}
+
+// pexExtension learns about new peers from the peers we are connected to
+// (ut_pex, BEP 11).
+type pexExtension struct {
+	torrent *Torrent
+}
+
+func (e *pexExtension) Name() string {
+	return "ut_pex"
+}
+
+func (e *pexExtension) Handle(c *peer.Client, payload []byte) error {
+	msg, err := parsePex(payload)
+	if err != nil {
+		return err
+	}
+	if !e.torrent.tracker.acceptPex(c, time.Now()) {
+		return nil
+	}
+	if len(msg.added) > maxPexPeers {
+		msg.added = msg.added[:maxPexPeers]
+	}
+	// The peers are in the swarm the message arrived on
+	e.torrent.addPeers(msg.added, c.InfoHash(), false)
+	return nil
+}
+
+type pexMessage struct {
+	added   []torrent.Peer
+	flags   []byte // flags of each added peer
+	dropped []torrent.Peer
+}
+
+func (m *pexMessage) serialize() ([]byte, error) {
+	var flags4, flags6 []byte
+	for i, p := range m.added {
+		if p.IP.To4() != nil {
+			flags4 = append(flags4, m.flags[i])
+		} else {
+			flags6 = append(flags6, m.flags[i])
+		}
+	}
+	return bencode.Encode(map[string]interface{}{
+		"added":    torrent.CompactPeers(m.added, net.IPv4len),
+		"added.f":  flags4,
+		"dropped":  torrent.CompactPeers(m.dropped, net.IPv4len),
+		"added6":   torrent.CompactPeers(m.added, net.IPv6len),
+		"added6.f": flags6,
+		"dropped6": torrent.CompactPeers(m.dropped, net.IPv6len),
+	})
+}
+
+func parsePex(buf []byte) (*pexMessage, error) {
+	decoded, err := bencode.Decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PEX message: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("PEX message is not a dictionary")
+	}
+
+	msg := &pexMessage{}
+	for _, family := range []struct {
+		added, flags, dropped string
+		ipLen                 int
+	}{
+		{"added", "added.f", "dropped", net.IPv4len},
+		{"added6", "added6.f", "dropped6", net.IPv6len},
+	} {
+		added, err := parsePexPeers(dict, family.added, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		flags, _ := dict[family.flags].(string)
+		for i := range added {
+			var f byte
+			if i < len(flags) {
+				f = flags[i]
+			}
+			msg.flags = append(msg.flags, f)
+		}
+		msg.added = append(msg.added, added...)
+
+		dropped, err := parsePexPeers(dict, family.dropped, family.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		msg.dropped = append(msg.dropped, dropped...)
+	}
+	return msg, nil
+}
+
+func parsePexPeers(dict map[string]interface{}, key string, ipLen int) ([]torrent.Peer, error) {
+	data, _ := dict[key].(string)
+	peers, err := torrent.ParseCompactPeers([]byte(data), ipLen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s in PEX message: %w", key, err)
+	}
+	return peers, nil
+}
+
+// pexInfo describes the peer for PEX messages to others, or returns nil if
+// its listen address is unknown: the port of an incoming connection is only
+// known if the peer told us in its extended handshake.
+func (state *peerState) pexInfo() *pexPeer {
+	c := state.client
+	addr := c.Addr()
+	p := &pexPeer{addr: torrent.Peer{IP: addr.IP, Port: addr.Port}}
+	if c.Outgoing() {
+		p.flags |= pexOutgoing
+	} else if c.Extended != nil && c.Extended.P > 0 && c.Extended.P <= 65535 {
+		p.addr.Port = uint16(c.Extended.P)
+	} else {
+		return nil
+	}
+
+	seed := true
+	for i := range state.torrent.NumPieces() {
+		if !c.Bitfield.HasPiece(i) {
+			seed = false
+			break
+		}
+	}
+	if seed {
+		p.flags |= pexSeed
+	}
+	if c.Encrypted {
+		p.flags |= pexEncryption
+	}
+	if c.Conn.RemoteAddr().Network() == "utp" {
+		p.flags |= pexUTP
+	}
+	return p
+}
+
+// sendPex tells the peer which peers we connected to and lost since the last
+// message. Nothing is sent for private torrents.
+func (state *peerState) sendPex(now time.Time) error {
+	c := state.client
+	if state.torrent.Private || !c.SupportsExtension("ut_pex") || now.Sub(state.lastPex) < pexInterval {
+		return nil
+	}
+	if state.pexSent == nil {
+		state.pexSent = make(map[string]*pexPeer)
+	}
+
+	current := state.tracker.pexPeers(c)
+	msg := &pexMessage{}
+	for key, p := range current {
+		if _, ok := state.pexSent[key]; !ok && len(msg.added) < maxPexPeers {
+			msg.added = append(msg.added, p.addr)
+			msg.flags = append(msg.flags, p.flags)
+			state.pexSent[key] = p
+		}
+	}
+	for key, p := range state.pexSent {
+		if _, ok := current[key]; !ok && len(msg.dropped) < maxPexPeers {
+			msg.dropped = append(msg.dropped, p.addr)
+			delete(state.pexSent, key)
+		}
+	}
+	if len(msg.added) == 0 && len(msg.dropped) == 0 {
+		return nil
+	}
+
+	state.lastPex = now
+	payload, err := msg.serialize()
+	if err != nil {
+		return err
+	}
+	return c.SendExtended("ut_pex", payload)
+}
+
+// setPex records how c is announced to other peers.
+func (pt *pieceTracker) setPex(c *peer.Client, p *pexPeer) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if info, ok := pt.peers[c]; ok {
+		info.pex = p
+	}
+}
+
+// acceptPex reports whether a PEX message from c arriving at now is far
+// enough from the last one, and records it if so.
+func (pt *pieceTracker) acceptPex(c *peer.Client, now time.Time) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	info, ok := pt.peers[c]
+	if !ok || (!info.pexReceived.IsZero() && now.Sub(info.pexReceived) < pexInterval-pexSlack) {
+		return false
+	}
+	info.pexReceived = now
+	return true
+}
+
+// pexPeers returns the announceable peers other than c by address.
+func (pt *pieceTracker) pexPeers(c *peer.Client) map[string]*pexPeer {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	peers := make(map[string]*pexPeer)
+	for other, info := range pt.peers {
+		if other != c && info.pex != nil {
+			peers[info.pex.addr.String()] = info.pex
+		}
+	}
+	return peers
+}
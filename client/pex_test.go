@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+// dialExtendedPeer connects to l as a peer that supports ut_pex and listens
+// on port 7000, and returns the connection and our extended handshake.
+func dialExtendedPeer(t *testing.T, l *Listener, tor *Torrent) (net.Conn, *peer.ExtendedHandshake) {
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var peerID [20]byte
+	copy(peerID[:], "-TR0001-remotepeer00")
+	hs := peer.NewHandshake(tor.InfoHash, peerID)
+	hs.Reserved.SetBit(peer.BitExtension)
+	conn.Write(hs.Serialize())
+	conn.Write((&peer.Message{ID: peer.MsgBitfield, Payload: make([]byte, (len(tor.PieceHashes)+7)/8)}).Serialize())
+	ext, _ := (&peer.ExtendedHandshake{M: map[string]int{"ut_pex": 1}, P: 7000}).Serialize()
+	conn.Write(peer.NewExtendedMessage(0, ext).Serialize())
+
+	if _, err := peer.ReadHandshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read extended handshake: %v", err)
+		}
+		if msg == nil || msg.ID != peer.MsgExtended {
+			continue
+		}
+		id, payload, _ := peer.ParseExtendedMessage(msg.Payload)
+		if id != 0 {
+			continue
+		}
+		h, err := peer.ParseExtendedHandshake(payload)
+		if err != nil {
+			t.Fatalf("Invalid extended handshake: %v", err)
+		}
+		return conn, h
+	}
+}
+
+func TestPexMessageRoundTrip(t *testing.T) {
+	msg := &pexMessage{
+		added: []torrent.Peer{
+			{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+			{IP: net.ParseIP("2001:db8::1"), Port: 6882},
+			{IP: net.ParseIP("10.0.0.2"), Port: 6883},
+		},
+		flags:   []byte{pexSeed, pexOutgoing, pexUTP},
+		dropped: []torrent.Peer{{IP: net.ParseIP("10.0.0.3"), Port: 6884}},
+	}
+	buf, err := msg.serialize()
+	if err != nil {
+		t.Fatalf("serialize failed: %v", err)
+	}
+	parsed, err := parsePex(buf)
+	if err != nil {
+		t.Fatalf("parsePex failed: %v", err)
+	}
+
+	// IPv4 peers come before IPv6 peers
+	expected := []pexPeer{
+		{msg.added[0], pexSeed},
+		{msg.added[2], pexUTP},
+		{msg.added[1], pexOutgoing},
+	}
+	if len(parsed.added) != len(expected) {
+		t.Fatalf("Expected %d added peers, got %d", len(expected), len(parsed.added))
+	}
+	for i, want := range expected {
+		got := parsed.added[i]
+		if !got.IP.Equal(want.addr.IP) || got.Port != want.addr.Port || parsed.flags[i] != want.flags {
+			t.Errorf("Added peer %d: expected %s with flags %x, got %s with flags %x", i, want.addr, want.flags, got, parsed.flags[i])
+		}
+	}
+	if len(parsed.dropped) != 1 || !parsed.dropped[0].IP.Equal(msg.dropped[0].IP) {
+		t.Errorf("Expected dropped %v, got %v", msg.dropped, parsed.dropped)
+	}
+}
+
+func TestPexConnectsToLearnedPeersAndAnnouncesThem(t *testing.T) {
+	data := newTestData(MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	seeder := newTestSeeder(t, data, MaxBlockSize, tor.InfoHash)
+	seeder.replyDelay = 2 * time.Second // keep the download running
+	seeder.start()
+	l := newTestListener(t, tor)
+
+	done := make(chan []byte, 1)
+	go func() {
+		buf, _ := tor.Download()
+		done <- buf
+	}()
+
+	conn, ours := dialExtendedPeer(t, l, tor)
+	id := ours.M["ut_pex"]
+	if id == 0 {
+		t.Fatal("Expected ut_pex in our extended handshake")
+	}
+	msg := &pexMessage{added: []torrent.Peer{seeder.addr()}, flags: []byte{pexSeed}}
+	payload, _ := msg.serialize()
+	conn.Write(peer.NewExtendedMessage(id, payload).Serialize())
+
+	// The seeder we connected to is announced back with its flags
+	for {
+		m, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Expected a PEX message: %v", err)
+		}
+		if m == nil || m.ID != peer.MsgExtended {
+			continue
+		}
+		extID, payload, _ := peer.ParseExtendedMessage(m.Payload)
+		if extID != 1 {
+			continue
+		}
+		pex, err := parsePex(payload)
+		if err != nil {
+			t.Fatalf("Invalid PEX message: %v", err)
+		}
+		if len(pex.added) != 1 || pex.added[0].String() != seeder.addr().String() {
+			t.Fatalf("Expected the seeder to be added, got %v", pex.added)
+		}
+		if pex.flags[0] != pexSeed|pexOutgoing {
+			t.Errorf("Expected flags %x, got %x", pexSeed|pexOutgoing, pex.flags[0])
+		}
+		break
+	}
+
+	select {
+	case buf := <-done:
+		if !bytes.Equal(buf, data) {
+			t.Error("Downloaded data does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Download from the peer learned through PEX did not finish")
+	}
+}
+
+func TestPrivateTorrentDisablesPex(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.Private = true
+	l := newTestListener(t, tor)
+
+	_, ours := dialExtendedPeer(t, l, tor)
+	if _, ok := ours.M["ut_pex"]; ok {
+		t.Error("Expected no ut_pex for a private torrent")
+	}
+}
+
+func TestPexLimitsAddedPeers(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	copy(tor.InfoHash[:], "v1 swarm")
+	tor.MaxConns = 2 * maxPexPeers
+	dialed := make(chan [20]byte, 2*maxPexPeers)
+	tor.Dialer = peer.DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+		ours, theirs := net.Pipe()
+		go func() {
+			defer theirs.Close()
+			if hs, err := peer.ReadHandshake(theirs); err == nil {
+				dialed <- hs.InfoHash
+			}
+		}()
+		return ours, nil
+	})
+	tor.init()
+
+	// The connection of newTestClient is for the zero infohash, standing in
+	// for another swarm of the torrent
+	c := newTestClient(1)
+	tor.tracker.addPeer(c, newPipeline(time.Now()))
+	ext := &pexExtension{torrent: tor}
+	send := func(first, n int) {
+		msg := &pexMessage{}
+		for i := first; i < first+n; i++ {
+			msg.added = append(msg.added, torrent.Peer{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 6881})
+			msg.flags = append(msg.flags, 0)
+		}
+		payload, _ := msg.serialize()
+		if err := ext.Handle(c, payload); err != nil {
+			t.Fatalf("Handle failed: %v", err)
+		}
+	}
+	send(0, maxPexPeers+10)
+	// Sent too soon after the first message
+	send(maxPexPeers+10, 5)
+
+	for i := 0; i < maxPexPeers; i++ {
+		select {
+		case infoHash := <-dialed:
+			if infoHash != c.InfoHash() {
+				t.Fatalf("Expected peers to be dialed for %x, got %x", c.InfoHash(), infoHash)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected %d peers to be dialed, got %d", maxPexPeers, i)
+		}
+	}
+	select {
+	case <-dialed:
+		t.Errorf("Expected at most %d peers to be dialed", maxPexPeers)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if !tor.tracker.acceptPex(c, time.Now().Add(pexInterval)) {
+		t.Error("Expected a message a minute later to be accepted")
+	}
+}
@@ -0,0 +1,523 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"torrent-client/peer"
+)
+
+// A peer that supplied blocks for this many pieces that failed their
+// integrity check is disconnected.
+const maxHashFailures = 3
+
+// pieceTracker schedules individual blocks across all connected peers and
+// web seeds. Blocks of a piece can come from any peer that has it, and
+// blocks that were already received survive the loss of the peer that was
+// downloading the rest. Once every remaining block has been requested, idle
+// peers request blocks that are already outstanding elsewhere (endgame mode)
+// so a single slow peer cannot hold up completion.
+//
+// New pieces are started rarest first, or in index order in sequential mode.
+// Pieces that a reader is waiting for are always picked before anything else.
+type pieceTracker struct {
+	mu           sync.Mutex
+	queue        []*pieceWork // pieces no block has been requested for yet
+	active       map[int]*activePiece
+	sequential   bool
+	availability []int                                 // number of connected peers that have each piece
+	urgent       map[int]int                           // number of readers waiting for each piece
+	requests     map[source]map[blockRequest]time.Time // outstanding requests per source and when they were made
+	strikes      map[source]int
+	peers        map[*peer.Client]*peerInfo
+	wake         chan struct{}
+	done         chan struct{} // closed when the current run stops, see stopped
+	rechoke      chan struct{} // asks the choker to run before its next round
+}
+
+// source is where blocks are requested from: a connected peer or a web
+// seed.
+type source interface {
+	String() string
+}
+
+type activePiece struct {
+	pw     *pieceWork
+	buf    []byte
+	blocks []blockState
+	left   int
+}
+
+type blockState struct {
+	received  bool
+	source    source // where the data came from
+	requested map[source]bool
+}
+
+// blockRequest identifies a single block of a piece.
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// blockCancel is an outstanding request on another source that is no
+// longer needed.
+type blockCancel struct {
+	client source
+	req    blockRequest
+}
+
+func newPieceTracker(queue []*pieceWork) *pieceTracker {
+	return &pieceTracker{
+		queue:        queue,
+		active:       make(map[int]*activePiece),
+		availability: make([]int, len(queue)),
+		urgent:       make(map[int]int),
+		requests:     make(map[source]map[blockRequest]time.Time),
+		strikes:      make(map[source]int),
+		peers:        make(map[*peer.Client]*peerInfo),
+		wake:         make(chan struct{}),
+		done:         make(chan struct{}),
+		rechoke:      make(chan struct{}, 1),
+	}
+}
+
+// stopped returns a channel that is closed when the current download or
+// seeding run stops.
+func (pt *pieceTracker) stopped() <-chan struct{} {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.done
+}
+
+// stop ends the current run. It may be called more than once.
+func (pt *pieceTracker) stop() {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	select {
+	case <-pt.done:
+	default:
+		close(pt.done)
+	}
+}
+
+// restart begins a new run if the last one was stopped, and reports
+// whether it did.
+func (pt *pieceTracker) restart() bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	select {
+	case <-pt.done:
+		pt.done = make(chan struct{})
+		return true
+	default:
+		return false
+	}
+}
+
+func numBlocks(length int) int {
+	return (length + MaxBlockSize - 1) / MaxBlockSize
+}
+
+func blockLength(pieceLength, block int) int {
+	begin := block * MaxBlockSize
+	if pieceLength-begin < MaxBlockSize {
+		return pieceLength - begin
+	}
+	return MaxBlockSize
+}
+
+func newActivePiece(pw *pieceWork) *activePiece {
+	ap := &activePiece{
+		pw:     pw,
+		buf:    make([]byte, pw.length),
+		blocks: make([]blockState, numBlocks(pw.length)),
+		left:   numBlocks(pw.length),
+	}
+	for i := range ap.blocks {
+		ap.blocks[i].requested = make(map[source]bool)
+	}
+	return ap
+}
+
+func (ap *activePiece) request(block int) blockRequest {
+	return blockRequest{ap.pw.index, block * MaxBlockSize, blockLength(ap.pw.length, block)}
+}
+
+// sources returns the distinct sources that supplied blocks of ap.
+func (ap *activePiece) sources() []source {
+	seen := make(map[source]bool)
+	var sources []source
+	for _, b := range ap.blocks {
+		if b.source != nil && !seen[b.source] {
+			seen[b.source] = true
+			sources = append(sources, b.source)
+		}
+	}
+	return sources
+}
+
+// wait returns a channel that is closed the next time blocks become
+// available for requesting again.
+func (pt *pieceTracker) wait() <-chan struct{} {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.wake
+}
+
+// notify must be called with pt.mu held.
+func (pt *pieceTracker) notify() {
+	close(pt.wake)
+	pt.wake = make(chan struct{})
+}
+
+func (pt *pieceTracker) addPeer(c *peer.Client, p *pipeline) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.peers[c] = &peerInfo{pipeline: p, amChoking: true, peerChoking: true}
+	for i := range pt.availability {
+		if c.Bitfield.HasPiece(i) {
+			pt.availability[i]++
+		}
+	}
+}
+
+// peerHas records that c announced pieces it did not have before.
+func (pt *pieceTracker) peerHas(c *peer.Client, pieces ...int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for _, index := range pieces {
+		if index >= 0 && index < len(pt.availability) {
+			pt.availability[index]++
+		}
+	}
+	pt.notify()
+}
+
+// prioritize marks the pieces from first to last (inclusive) as wanted by a
+// reader, or releases them again if delta is negative.
+func (pt *pieceTracker) prioritize(first, last, delta int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i := first; i <= last && i < len(pt.availability); i++ {
+		pt.urgent[i] += delta
+		if pt.urgent[i] <= 0 {
+			delete(pt.urgent, i)
+		}
+	}
+	pt.notify()
+}
+
+// peerInfo returns the state of c if it is a connected peer.
+func (pt *pieceTracker) peerInfo(c source) (*peerInfo, bool) {
+	p, ok := c.(*peer.Client)
+	if !ok {
+		return nil, false
+	}
+	info, ok := pt.peers[p]
+	return info, ok
+}
+
+func (pt *pieceTracker) numPeers() int {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return len(pt.peers)
+}
+
+// complete removes a piece that is already available from the queue.
+func (pt *pieceTracker) complete(index int) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for i, pw := range pt.queue {
+		if pw.index == index {
+			pt.queue = append(pt.queue[:i], pt.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// broadcastHave announces a newly verified piece to every connected peer.
+func (pt *pieceTracker) broadcastHave(index int) {
+	for _, c := range pt.connected() {
+		c.SendHave(index)
+	}
+}
+
+func (pt *pieceTracker) connected() []*peer.Client {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	peers := make([]*peer.Client, 0, len(pt.peers))
+	for c := range pt.peers {
+		peers = append(peers, c)
+	}
+	return peers
+}
+
+// removePeer forgets c and makes its outstanding requests available to other
+// peers. Blocks it already delivered are kept.
+func (pt *pieceTracker) removePeer(c *peer.Client) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if _, ok := pt.peers[c]; !ok {
+		return
+	}
+	delete(pt.peers, c)
+	for i := range pt.availability {
+		if c.Bitfield.HasPiece(i) {
+			pt.availability[i]--
+		}
+	}
+	pt.releaseLocked(c)
+}
+
+// release forgets the outstanding requests of c, e.g. after being choked.
+func (pt *pieceTracker) release(c source) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.releaseLocked(c)
+}
+
+func (pt *pieceTracker) releaseLocked(c source) {
+	if len(pt.requests[c]) == 0 {
+		return
+	}
+	for req := range pt.requests[c] {
+		if ap, ok := pt.active[req.index]; ok {
+			delete(ap.blocks[req.begin/MaxBlockSize].requested, c)
+		}
+	}
+	delete(pt.requests, c)
+	pt.notify()
+}
+
+func (pt *pieceTracker) backlog(c source) int {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return len(pt.requests[c])
+}
+
+func (pt *pieceTracker) stats() []PeerStats {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]PeerStats, 0, len(pt.peers))
+	for c, info := range pt.peers {
+		p := info.pipeline
+		_, rtt := p.stats()
+		download, upload := p.rates()
+		stats = append(stats, PeerStats{
+			Addr:           c.String(),
+			QueueDepth:     p.depth(c.MaxRequests),
+			Outstanding:    len(pt.requests[c]),
+			DownloadRate:   download,
+			UploadRate:     upload,
+			RTT:            rtt,
+			AmChoking:      info.amChoking,
+			AmInterested:   info.amInterested,
+			PeerChoking:    info.peerChoking,
+			PeerInterested: info.peerInterested,
+			Optimistic:     info.optimistic,
+			Snubbed:        info.snubbed(now),
+			Encrypted:      c.Encrypted,
+		})
+	}
+	return stats
+}
+
+// sentAt returns when the given block was requested from c.
+func (pt *pieceTracker) sentAt(c source, index, begin, length int) (time.Time, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	sent, ok := pt.requests[c][blockRequest{index, begin, length}]
+	return sent, ok
+}
+
+func (pt *pieceTracker) banned(c source) bool {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.strikes[c] >= maxHashFailures
+}
+
+// reserve picks the next block to request from c. Pieces wanted by a reader
+// come first. Otherwise blocks of pieces that are already in progress are
+// preferred so partially downloaded pieces complete first, and after that a
+// new piece is started. Outside of endgame a block is only ever requested
+// from one peer at a time.
+func (pt *pieceTracker) reserve(c source) (blockRequest, bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	select {
+	case <-pt.done:
+		return blockRequest{}, false // the run stopped
+	default:
+	}
+
+	active := make([]int, 0, len(pt.active))
+	for index := range pt.active {
+		if mayRequest(c, index) {
+			active = append(active, index)
+		}
+	}
+	sort.Ints(active)
+
+	for _, urgent := range []bool{true, false} {
+		for _, index := range active {
+			if urgent && pt.urgent[index] == 0 {
+				continue
+			}
+			ap := pt.active[index]
+			for i, b := range ap.blocks {
+				if !b.received && len(b.requested) == 0 {
+					return pt.reserveLocked(c, ap, i), true
+				}
+			}
+		}
+
+		if i := pt.pickQueued(c, urgent); i >= 0 {
+			pw := pt.queue[i]
+			pt.queue = append(pt.queue[:i], pt.queue[i+1:]...)
+			ap := newActivePiece(pw)
+			pt.active[pw.index] = ap
+			return pt.reserveLocked(c, ap, 0), true
+		}
+	}
+
+	// Endgame: every remaining block has been requested from some peer
+	if len(pt.queue) > 0 {
+		return blockRequest{}, false
+	}
+	var dup *activePiece
+	dupBlock := -1
+	for _, index := range active {
+		ap := pt.active[index]
+		for i, b := range ap.blocks {
+			if b.received || b.requested[c] {
+				continue
+			}
+			if dup == nil || len(b.requested) < len(dup.blocks[dupBlock].requested) {
+				dup, dupBlock = ap, i
+			}
+		}
+	}
+	if dup == nil {
+		return blockRequest{}, false
+	}
+	return pt.reserveLocked(c, dup, dupBlock), true
+}
+
+// pickQueued returns the position in the queue of the next piece to start
+// on c, or -1 if there is none. With urgent set only pieces wanted by a
+// reader are considered, in index order. Otherwise pieces that c suggested
+// come first, unless downloading in order.
+func (pt *pieceTracker) pickQueued(c source, urgent bool) int {
+	if info, ok := pt.peerInfo(c); ok && !urgent && !pt.sequential {
+		for _, index := range info.suggested {
+			for i, pw := range pt.queue {
+				if pw.index == index && mayRequest(c, index) {
+					return i
+				}
+			}
+		}
+	}
+
+	best := -1
+	for i, pw := range pt.queue {
+		if !mayRequest(c, pw.index) || (urgent && pt.urgent[pw.index] == 0) {
+			continue
+		}
+		if best == -1 {
+			best = i
+			continue
+		}
+		if urgent || pt.sequential {
+			if pw.index < pt.queue[best].index {
+				best = i
+			}
+		} else if pt.availability[pw.index] < pt.availability[pt.queue[best].index] {
+			best = i
+		}
+	}
+	return best
+}
+
+func (pt *pieceTracker) reserveLocked(c source, ap *activePiece, block int) blockRequest {
+	req := ap.request(block)
+	ap.blocks[block].requested[c] = true
+	if pt.requests[c] == nil {
+		pt.requests[c] = make(map[blockRequest]time.Time)
+	}
+	pt.requests[c][req] = time.Now()
+	return req
+}
+
+// receive stores a block delivered by c. It returns the requests for the same
+// block that are still outstanding on other peers so they can be cancelled,
+// and the piece if this block completed it. Blocks that were not requested
+// from c or are no longer needed are ignored.
+func (pt *pieceTracker) receive(c source, index, begin int, data []byte) ([]blockCancel, *activePiece, error) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	req := blockRequest{index, begin, len(data)}
+	if _, ok := pt.requests[c][req]; !ok {
+		return nil, nil, nil // Late block for a request that was cancelled
+	}
+	delete(pt.requests[c], req)
+
+	ap, ok := pt.active[index]
+	if !ok {
+		return nil, nil, fmt.Errorf("received block for inactive piece %d", index)
+	}
+	block := &ap.blocks[begin/MaxBlockSize]
+	delete(block.requested, c)
+	if block.received {
+		return nil, nil, nil
+	}
+
+	copy(ap.buf[begin:], data)
+	block.received = true
+	block.source = c
+	ap.left--
+
+	var cancels []blockCancel
+	for other := range block.requested {
+		delete(pt.requests[other], req)
+		cancels = append(cancels, blockCancel{other, req})
+	}
+	block.requested = make(map[source]bool)
+
+	if ap.left > 0 {
+		return cancels, nil, nil
+	}
+	delete(pt.active, index)
+	return cancels, ap, nil
+}
+
+// badBlock records a strike against c for a block that failed its own
+// check, and makes the block available for requesting again.
+func (pt *pieceTracker) badBlock(c source, req blockRequest) {
+	pt.reject(c, req)
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.strikes[c]++
+}
+
+// fail records a strike against every peer that supplied a block of a piece
+// that did not pass its integrity check, and puts the piece back on the
+// queue. It returns the sources that were blamed.
+func (pt *pieceTracker) fail(ap *activePiece) []source {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	sources := ap.sources()
+	for _, c := range sources {
+		pt.strikes[c]++
+	}
+	pt.queue = append([]*pieceWork{ap.pw}, pt.queue...)
+	pt.notify()
+	return sources
+}
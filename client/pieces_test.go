@@ -0,0 +1,201 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+)
+
+func newTestClient(numPieces int) *peer.Client {
+	bf := make(peer.Bitfield, (numPieces+7)/8)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return &peer.Client{Bitfield: bf}
+}
+
+func newTestQueue(numPieces, pieceLength int) []*pieceWork {
+	var queue []*pieceWork
+	for i := 0; i < numPieces; i++ {
+		queue = append(queue, &pieceWork{index: i, length: pieceLength})
+	}
+	return queue
+}
+
+func mustReserve(t *testing.T, pt *pieceTracker, c *peer.Client) blockRequest {
+	t.Helper()
+	req, ok := pt.reserve(c)
+	if !ok {
+		t.Fatal("Expected a block to be reserved")
+	}
+	return req
+}
+
+func TestPieceTrackerSharesPieceBetweenPeers(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(2, 3*MaxBlockSize))
+	a, b := newTestClient(2), newTestClient(2)
+
+	reqA := mustReserve(t, pt, a)
+	reqB := mustReserve(t, pt, b)
+
+	if reqA.index != reqB.index {
+		t.Fatalf("Expected both peers to work on the same piece, got %d and %d", reqA.index, reqB.index)
+	}
+	if reqA.begin == reqB.begin {
+		t.Errorf("Expected different blocks, both got offset %d", reqA.begin)
+	}
+}
+
+func TestPieceTrackerKeepsProgressOnPeerLoss(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(1, 3*MaxBlockSize))
+	a, b := newTestClient(1), newTestClient(1)
+
+	first := mustReserve(t, pt, a)
+	mustReserve(t, pt, a)
+	if _, _, err := pt.receive(a, first.index, first.begin, make([]byte, first.length)); err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+
+	pt.removePeer(a)
+
+	var piece *activePiece
+	for i := 0; i < 2; i++ {
+		req := mustReserve(t, pt, b)
+		if req.begin == first.begin {
+			t.Fatalf("Block at offset %d was requested again after the peer was lost", req.begin)
+		}
+		_, done, err := pt.receive(b, req.index, req.begin, make([]byte, req.length))
+		if err != nil {
+			t.Fatalf("receive failed: %v", err)
+		}
+		piece = done
+	}
+	if piece == nil {
+		t.Fatal("Expected the piece to be complete")
+	}
+	if sources := piece.sources(); len(sources) != 2 {
+		t.Errorf("Expected blocks from 2 peers, got %d", len(sources))
+	}
+}
+
+func TestPieceTrackerEndgameCancelsDuplicates(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(1, MaxBlockSize))
+	slow, fast := newTestClient(1), newTestClient(1)
+
+	req := mustReserve(t, pt, slow)
+	dup := mustReserve(t, pt, fast)
+	if dup != req {
+		t.Fatalf("Expected endgame to duplicate %v, got %v", req, dup)
+	}
+
+	cancels, piece, err := pt.receive(fast, dup.index, dup.begin, make([]byte, dup.length))
+	if err != nil {
+		t.Fatalf("receive failed: %v", err)
+	}
+	if piece == nil {
+		t.Fatal("Expected the piece to be complete")
+	}
+	if len(cancels) != 1 || cancels[0].client != slow || cancels[0].req != req {
+		t.Errorf("Expected a cancel for the slow peer, got %v", cancels)
+	}
+	if pt.backlog(slow) != 0 {
+		t.Errorf("Expected cancelled request to be dropped, backlog is %d", pt.backlog(slow))
+	}
+
+	// A late answer from the slow peer is ignored
+	_, piece, err = pt.receive(slow, req.index, req.begin, make([]byte, req.length))
+	if err != nil || piece != nil {
+		t.Errorf("Expected late block to be ignored, got piece %v, err %v", piece, err)
+	}
+}
+
+func TestPieceTrackerAttributesHashFailures(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(1, 2*MaxBlockSize))
+	good, bad := newTestClient(1), newTestClient(1)
+
+	// A piece assembled from both peers blames both
+	reqGood := mustReserve(t, pt, good)
+	reqBad := mustReserve(t, pt, bad)
+	pt.receive(good, reqGood.index, reqGood.begin, make([]byte, reqGood.length))
+	_, piece, err := pt.receive(bad, reqBad.index, reqBad.begin, make([]byte, reqBad.length))
+	if err != nil || piece == nil {
+		t.Fatalf("Expected the piece to be complete, err %v", err)
+	}
+	if blamed := pt.fail(piece); len(blamed) != 2 {
+		t.Fatalf("Expected both peers to be blamed, got %d", len(blamed))
+	}
+
+	// Pieces supplied by the bad peer alone only blame it
+	for i := 1; i < maxHashFailures; i++ {
+		var piece *activePiece
+		for piece == nil {
+			req := mustReserve(t, pt, bad)
+			_, piece, _ = pt.receive(bad, req.index, req.begin, make([]byte, req.length))
+		}
+		blamed := pt.fail(piece)
+		if len(blamed) != 1 || blamed[0] != bad {
+			t.Fatalf("Expected only the bad peer to be blamed, got %v", blamed)
+		}
+	}
+
+	if !pt.banned(bad) {
+		t.Error("Expected the bad peer to be banned after repeated hash failures")
+	}
+	if pt.banned(good) {
+		t.Error("Expected the good peer not to be banned")
+	}
+
+	// The failed piece is available again
+	if _, ok := pt.reserve(good); !ok {
+		t.Error("Expected the failed piece to be requeued")
+	}
+}
+
+func TestPieceTrackerRarestFirst(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(3, MaxBlockSize))
+	common := newTestClient(3)
+	other := &peer.Client{Bitfield: peer.Bitfield{0b11000000}} // pieces 0 and 1
+	pt.addPeer(common, newPipeline(time.Now()))
+	pt.addPeer(other, newPipeline(time.Now()))
+
+	if req := mustReserve(t, pt, common); req.index != 2 {
+		t.Errorf("Expected the rarest piece 2 first, got %d", req.index)
+	}
+}
+
+func TestPieceTrackerSequential(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(3, MaxBlockSize))
+	pt.sequential = true
+	common := newTestClient(3)
+	other := &peer.Client{Bitfield: peer.Bitfield{0b11000000}}
+	pt.addPeer(common, newPipeline(time.Now()))
+	pt.addPeer(other, newPipeline(time.Now()))
+
+	for want := 0; want < 3; want++ {
+		if req := mustReserve(t, pt, common); req.index != want {
+			t.Errorf("Expected piece %d, got %d", want, req.index)
+		}
+	}
+}
+
+func TestPieceTrackerPrioritizesReaderWindow(t *testing.T) {
+	pt := newPieceTracker(newTestQueue(4, 2*MaxBlockSize))
+	pt.sequential = true
+	c := newTestClient(4)
+
+	// A piece already in progress is normally finished first
+	mustReserve(t, pt, c)
+	pt.prioritize(2, 3, 1)
+
+	for _, want := range []int{2, 2, 3, 3, 0} {
+		if req := mustReserve(t, pt, c); req.index != want {
+			t.Fatalf("Expected piece %d, got %d", want, req.index)
+		}
+	}
+
+	pt.prioritize(2, 3, -1)
+	if len(pt.urgent) != 0 {
+		t.Errorf("Expected no prioritized pieces after release, got %v", pt.urgent)
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+// pipeDialer connects every peer address to serve over net.Pipe and records
+// the addresses dialed.
+type pipeDialer struct {
+	serve  func(conn net.Conn)
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+	local, remote := net.Pipe()
+	go d.serve(remote)
+	return local, nil
+}
+
+func testPeers(n int) []torrent.Peer {
+	var peers []torrent.Peer
+	for i := 0; i < n; i++ {
+		peers = append(peers, torrent.Peer{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 6881})
+	}
+	return peers
+}
+
+func TestDownloadFromSimulatedPeersOverPipe(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3*pieceLength + 100)
+	tor := newTestTorrent(data, pieceLength)
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	dialer := &pipeDialer{serve: seeder.serve}
+	tor.Dialer = dialer
+	tor.Peers = testPeers(2)
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if len(dialer.dialed) != 2 {
+		t.Errorf("Expected both peers to be dialed, got %v", dialer.dialed)
+	}
+}
+
+func TestDownloadBetweenTorrentsOverPipe(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(4 * pieceLength)
+	seeder := newTestTorrent(data, pieceLength)
+	if _, err := seeder.LoadData(writeTestData(t, seeder.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	// The listener's accept loop is not needed to handle a connection
+	l := &Listener{torrents: make(map[[20]byte]*Torrent)}
+	l.Add(seeder)
+
+	leecher := newTestTorrent(data, pieceLength)
+	copy(leecher.PeerID[:], "-TC0001-testclient01")
+	leecher.Dialer = peer.DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+		local, remote := net.Pipe()
+		go l.handle(remote)
+		return local, nil
+	})
+	leecher.Peers = testPeers(1)
+
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	// The seeder counts a block once it is sent, which may be after the
+	// leecher got it
+	deadline := time.Now().Add(time.Second)
+	for seeder.uploaded.Load() != int64(len(data)) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := seeder.uploaded.Load(); got != int64(len(data)) {
+		t.Errorf("Expected the seeder to upload %d bytes, got %d", len(data), got)
+	}
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// The request queue of each peer holds this many round trips of transfer at
+// the peer's measured download rate. One round trip is the bandwidth-delay
+// product; the second absorbs jitter and lets a queue that limits the rate
+// keep growing until the link is full. The RTT used is the shortest seen,
+// since later requests also wait behind the ones queued before them and
+// would keep a slowing peer's queue from shrinking.
+const requestQueueRTTs = 2
+
+// MaxBacklog is the number of requests kept outstanding on a peer before its
+// rate is known.
+const MaxBacklog = 5
+
+// Bounds for the number of outstanding requests per peer.
+const (
+	MinBacklog    = MaxBacklog
+	MaxQueueDepth = 500
+)
+
+// Weight of a new sample in the smoothed rate and RTT.
+const rateSmoothing = 0.2
+
+// PeerStats is a snapshot of the transfer state of a connected peer.
+type PeerStats struct {
+	Addr         string
+	QueueDepth   int           // target number of outstanding requests
+	Outstanding  int           // requests currently outstanding
+	DownloadRate float64       // bytes per second
+	UploadRate   float64       // bytes per second
+	RTT          time.Duration // smoothed request round-trip time
+
+	AmChoking      bool // we refuse to upload to the peer
+	AmInterested   bool // we want to download from the peer
+	PeerChoking    bool // the peer refuses to upload to us
+	PeerInterested bool // the peer wants to download from us
+	Optimistic     bool // the peer holds the optimistic unchoke
+	Snubbed        bool // the peer has not sent us a block in a while
+	Encrypted      bool // the connection is encrypted (MSE)
+}
+
+// pipeline measures the transfer rates and request round-trip time of a peer
+// and derives how many requests to keep outstanding on it.
+type pipeline struct {
+	mu         sync.Mutex
+	rate       float64
+	uploadRate float64
+	rtt        time.Duration
+	minRTT     time.Duration
+	received   int
+	sent       int
+	lastSample time.Time
+	lastBlock  time.Time // when the peer last sent a block, or connected
+}
+
+func newPipeline(now time.Time) *pipeline {
+	return &pipeline{lastSample: now, lastBlock: now}
+}
+
+// onBlock records a block of n bytes that took rtt from request to arrival.
+func (p *pipeline) onBlock(n int, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.received += n
+	p.lastBlock = time.Now()
+	if p.minRTT == 0 || rtt < p.minRTT {
+		p.minRTT = rtt
+	}
+	if p.rtt == 0 {
+		p.rtt = rtt
+	} else {
+		p.rtt += time.Duration(rateSmoothing * float64(rtt-p.rtt))
+	}
+}
+
+// onUpload records a block of n bytes sent to the peer.
+func (p *pipeline) onUpload(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent += n
+}
+
+// sample folds the bytes transferred since the last sample into the smoothed
+// download and upload rates.
+func (p *pipeline) sample(now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	elapsed := now.Sub(p.lastSample).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	p.rate += rateSmoothing * (float64(p.received)/elapsed - p.rate)
+	p.uploadRate += rateSmoothing * (float64(p.sent)/elapsed - p.uploadRate)
+	p.received = 0
+	p.sent = 0
+	p.lastSample = now
+}
+
+// depth returns the number of requests to keep outstanding. limit is the
+// maximum the peer advertised (reqq), or 0 if unknown.
+func (p *pipeline) depth(limit int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	depth := int(math.Ceil(p.rate * requestQueueRTTs * p.minRTT.Seconds() / MaxBlockSize))
+	if depth < MinBacklog {
+		depth = MinBacklog
+	}
+	if depth > MaxQueueDepth {
+		depth = MaxQueueDepth
+	}
+	if limit > 0 && depth > limit {
+		depth = limit
+	}
+	return depth
+}
+
+func (p *pipeline) stats() (rate float64, rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate, p.rtt
+}
+
+func (p *pipeline) rates() (download, upload float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate, p.uploadRate
+}
+
+// idleSince returns when the peer last sent us a block.
+func (p *pipeline) idleSince() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastBlock
+}
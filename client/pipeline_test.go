@@ -0,0 +1,124 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPipelineDepthStartsAtMinimum(t *testing.T) {
+	p := newPipeline(time.Now())
+	if depth := p.depth(0); depth != MinBacklog {
+		t.Errorf("Expected initial depth %d, got %d", MinBacklog, depth)
+	}
+}
+
+func TestPipelineDepthFollowsRate(t *testing.T) {
+	start := time.Now()
+	p := newPipeline(start)
+
+	// 1 MiB/s sustained for long enough for the average to settle
+	now := start
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 64; j++ {
+			p.onBlock(MaxBlockSize, 200*time.Millisecond)
+		}
+		now = now.Add(time.Second)
+		p.sample(now)
+	}
+
+	rate, rtt := p.stats()
+	if rate < 0.99*(1<<20) || rate > 1.01*(1<<20) {
+		t.Errorf("Expected rate of about 1 MiB/s, got %.0f", rate)
+	}
+	if rtt != 200*time.Millisecond {
+		t.Errorf("Expected RTT 200ms, got %s", rtt)
+	}
+
+	// Two round trips worth of 16 KiB blocks at 1 MiB/s
+	if depth := p.depth(0); depth < 25 || depth > 26 {
+		t.Errorf("Expected depth of about 26, got %d", depth)
+	}
+
+	// The peer's reqq caps the queue
+	if depth := p.depth(20); depth != 20 {
+		t.Errorf("Expected depth capped at 20, got %d", depth)
+	}
+}
+
+func TestPipelineDepthCoversLongRTT(t *testing.T) {
+	start := time.Now()
+	p := newPipeline(start)
+
+	now := start
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 8; j++ {
+			p.onBlock(MaxBlockSize, 6*time.Second)
+		}
+		now = now.Add(time.Second)
+		p.sample(now)
+	}
+
+	// 128 KiB/s over two 6 second round trips
+	if depth := p.depth(0); depth < 95 || depth > 96 {
+		t.Errorf("Expected depth of about 96, got %d", depth)
+	}
+}
+
+func TestPipelineDepthStaysShallowOnShortRTT(t *testing.T) {
+	start := time.Now()
+	p := newPipeline(start)
+
+	now := start
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 64; j++ {
+			p.onBlock(MaxBlockSize, 20*time.Millisecond)
+		}
+		now = now.Add(time.Second)
+		p.sample(now)
+	}
+
+	// 1 MiB/s over 20ms needs fewer than MinBacklog requests
+	if depth := p.depth(0); depth != MinBacklog {
+		t.Errorf("Expected depth %d, got %d", MinBacklog, depth)
+	}
+}
+
+func TestPipelineDepthIsBounded(t *testing.T) {
+	start := time.Now()
+	p := newPipeline(start)
+	for j := 0; j < 100000; j++ {
+		p.onBlock(MaxBlockSize, 100*time.Millisecond)
+	}
+	p.sample(start.Add(time.Second))
+
+	if depth := p.depth(0); depth != MaxQueueDepth {
+		t.Errorf("Expected depth capped at %d, got %d", MaxQueueDepth, depth)
+	}
+}
+
+func TestPipelineDepthShrinksWhenPeerSlowsDown(t *testing.T) {
+	start := time.Now()
+	p := newPipeline(start)
+
+	// A fast peer gets a deep queue
+	now := start
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 64; j++ {
+			p.onBlock(MaxBlockSize, 200*time.Millisecond)
+		}
+		now = now.Add(time.Second)
+		p.sample(now)
+	}
+	deep := p.depth(0)
+
+	// At 16 KiB/s every block now waits behind the whole queue, which
+	// must not count as round-trip time
+	for i := 0; i < 50; i++ {
+		p.onBlock(MaxBlockSize, time.Duration(deep)*time.Second)
+		now = now.Add(time.Second)
+		p.sample(now)
+	}
+	if depth := p.depth(0); depth > 5 {
+		t.Errorf("Expected the queue to shrink from %d to the minimum, got %d", deep, depth)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"torrent-client/peer"
+	"torrent-client/proxy"
+	"torrent-client/proxy/proxytest"
+	"torrent-client/torrent"
+)
+
+func TestDownloadThroughProxy(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	seeder := newTestSeeder(t, data, MaxBlockSize, tor.InfoHash)
+	seeder.start()
+
+	server := proxytest.NewSOCKS5(t, "user", "secret")
+	tor.Proxy = &proxy.Proxy{Type: proxy.SOCKS5, Addr: server.Addr, Username: "user", Password: "secret"}
+	tor.ProxyOnly = true
+	tor.Peers = []torrent.Peer{seeder.addr()}
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if targets := server.Targets(); len(targets) != 1 || targets[0] != seeder.addr().String() {
+		t.Errorf("Expected the proxy to connect to %s, got %v", seeder.addr(), targets)
+	}
+}
+
+func TestAnnounceThroughProxy(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "d8:intervali900e5:peers6:\xc0\x00\x02\x01\x1a\xe1e")
+	}))
+	defer tracker.Close()
+
+	for _, typ := range []string{proxy.SOCKS5, proxy.HTTP} {
+		server := proxytest.NewSOCKS5(t, "", "")
+		if typ == proxy.HTTP {
+			server = proxytest.NewHTTP(t, "", "")
+		}
+		tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+		tor.file = &torrent.TorrentFile{Announce: tracker.URL + "/announce", InfoHash: tor.InfoHash, Length: tor.Length}
+		tor.Proxy = &proxy.Proxy{Type: typ, Addr: server.Addr}
+		tor.ProxyOnly = true
+
+		if err := tor.RequestPeers(); err != nil {
+			t.Fatalf("RequestPeers through %s failed: %v", typ, err)
+		}
+		if len(tor.Peers) != 1 || tor.Peers[0].String() != "192.0.2.1:6881" {
+			t.Errorf("Expected peer 192.0.2.1:6881, got %v", tor.Peers)
+		}
+		if len(server.Targets()) != 1 {
+			t.Errorf("Expected the %s proxy to carry the announce, got %v", typ, server.Targets())
+		}
+	}
+}
+
+func TestProxyOnlyRefusesDirectConnections(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.ProxyOnly = true
+	tor.init()
+
+	if _, err := tor.dialer().DialContext(context.Background(), "127.0.0.1:6881"); !errors.Is(err, errNoProxy) {
+		t.Errorf("Expected dialing without a proxy to be refused, got %v", err)
+	}
+	tor.file = &torrent.TorrentFile{Announce: "http://127.0.0.1:1/announce"}
+	if err := tor.RequestPeers(); !errors.Is(err, errNoProxy) {
+		t.Errorf("Expected announcing without a proxy to be refused, got %v", err)
+	}
+
+	l := &Listener{torrents: make(map[[20]byte]*Torrent)}
+	l.Add(tor)
+	if _, err := l.admit(peer.NewHandshake(tor.InfoHash, [20]byte{1})); err == nil {
+		t.Error("Expected incoming connections to be refused in proxy-only mode")
+	}
+
+	// Dialing through a proxy ignores UTP and Transport
+	tor.Proxy = &proxy.Proxy{Type: proxy.SOCKS5, Addr: "127.0.0.1:1080"}
+	if d, ok := tor.dialer().(*proxy.Proxy); !ok || d != tor.Proxy {
+		t.Errorf("Expected peers to be dialed through the proxy, got %T", tor.dialer())
+	}
+}
+
+func TestTrackerClientUDPThroughHTTPProxy(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	tor.Proxy = &proxy.Proxy{Type: proxy.HTTP, Addr: "127.0.0.1:3128"}
+
+	c, err := tor.trackerClient()
+	if err != nil {
+		t.Fatalf("trackerClient failed: %v", err)
+	}
+	if c.DialUDP != nil {
+		t.Error("Expected UDP trackers to be reached directly through an HTTP proxy")
+	}
+
+	// In proxy-only mode they are refused instead
+	tor.ProxyOnly = true
+	c, err = tor.trackerClient()
+	if err != nil {
+		t.Fatalf("trackerClient failed: %v", err)
+	}
+	if c.DialUDP == nil {
+		t.Fatal("Expected UDP trackers to go through the proxy")
+	}
+	if _, err := c.DialUDP(context.Background(), "127.0.0.1:6969"); err == nil {
+		t.Error("Expected an HTTP proxy to refuse UDP")
+	}
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Pieces within this many bytes ahead of a reader's position are downloaded
+// before anything else.
+const readahead = 4 << 20
+
+type reader struct {
+	t   *Torrent
+	pos int64
+
+	mu          sync.Mutex
+	first, last int // pieces currently prioritized for this reader
+	closed      chan struct{}
+}
+
+// NewReader returns a reader for the content of the torrent. Reads block
+// until the pieces covering the requested range have been downloaded and
+// verified, and the pieces just ahead of the read position, or of the
+// position sought to, are downloaded first. Reads only make progress while
+// Download is running.
+func (t *Torrent) NewReader() io.ReadSeekCloser {
+	return t.newReader()
+}
+
+func (t *Torrent) newReader() *reader {
+	t.init()
+	return &reader{t: t, first: 0, last: -1, closed: make(chan struct{})}
+}
+
+// ReadAt reads len(p) bytes at off by seeking there, so it moves the read
+// position like Read does. It serves one io.SectionReader at a time.
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.pos >= int64(r.t.Length) {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	index := int(r.pos / int64(r.t.PieceLength))
+	if err := r.prioritize(index); err != nil {
+		return 0, err
+	}
+
+	// Only read up to the end of the piece
+	_, end := r.t.calculateBoundsForPiece(index)
+	if remaining := int64(end) - r.pos; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	for {
+		n, changed, err := r.t.store.readAt(p, r.pos, index)
+		if err != nil {
+			return 0, err
+		}
+		if changed == nil {
+			r.pos += int64(n)
+			return n, nil
+		}
+		select {
+		case <-changed:
+		case <-r.closed:
+			return 0, os.ErrClosed
+		}
+	}
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = int64(r.t.Length) + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = pos
+	if pos < int64(r.t.Length) {
+		if err := r.prioritize(int(pos / int64(r.t.PieceLength))); err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
+
+// prioritize moves the window of prioritized pieces to start at index.
+func (r *reader) prioritize(index int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.closed:
+		return os.ErrClosed
+	default:
+	}
+
+	if index == r.first && r.last >= r.first {
+		return nil
+	}
+
+	window := readahead / r.t.PieceLength
+	if window < 1 {
+		window = 1
+	}
+	last := index + window - 1
+	if last >= r.t.NumPieces() {
+		last = r.t.NumPieces() - 1
+	}
+
+	if r.last >= r.first {
+		r.t.tracker.prioritize(r.first, r.last, -1)
+	}
+	r.first, r.last = index, last
+	r.t.tracker.prioritize(r.first, r.last, 1)
+	return nil
+}
+
+func (r *reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+
+	if r.last >= r.first {
+		r.t.tracker.prioritize(r.first, r.last, -1)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+func TestReaderStreamsWhileDownloading(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(5*pieceLength + 123)
+	tor := newTestTorrent(data, pieceLength)
+	tor.Sequential = true
+
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.start()
+	tor.Peers = []torrent.Peer{seeder.addr()}
+
+	r := tor.NewReader()
+	defer r.Close()
+	go tor.Download()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Streamed data does not match")
+	}
+
+	// Seeking back reads verified data without waiting
+	if _, err := r.Seek(int64(pieceLength+10), io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	buf := make([]byte, 20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("ReadFull failed: %v", err)
+	}
+	if !bytes.Equal(buf, data[pieceLength+10:pieceLength+30]) {
+		t.Error("Data after seek does not match")
+	}
+}
+
+func TestReaderSeekBoostsPriority(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(pieceLength * (readahead/pieceLength + 4))
+	tor := newTestTorrent(data, pieceLength)
+	last := len(tor.PieceHashes) - 1
+
+	r := tor.NewReader()
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+
+	// The piece at the seek position is requested before piece 0
+	req := mustReserve(t, tor.tracker, newTestClient(len(tor.PieceHashes)))
+	if req.index != last {
+		t.Errorf("Expected piece %d to be requested first, got %d", last, req.index)
+	}
+
+	// Reads block until the piece is verified
+	done := make(chan []byte)
+	go func() {
+		buf, _ := io.ReadAll(r)
+		done <- buf
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Read returned before the piece was available")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	begin, end := tor.calculateBoundsForPiece(last)
+	tor.store.put(last, begin, data[begin:end])
+
+	select {
+	case buf := <-done:
+		if !bytes.Equal(buf, data[len(data)-10:]) {
+			t.Error("Data after seek does not match")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return after the piece arrived")
+	}
+
+	r.Close()
+	if len(tor.tracker.urgent) != 0 {
+		t.Errorf("Expected priorities to be released on close, got %v", tor.tracker.urgent)
+	}
+}
@@ -0,0 +1,193 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+// How often Seed logs its progress.
+const seedStatusInterval = 30 * time.Second
+
+// Re-announce interval used when the tracker does not give one.
+const defaultAnnounceInterval = 30 * time.Minute
+
+// SeedLimits bound how long Seed keeps uploading. Zero values mean no limit.
+type SeedLimits struct {
+	Ratio    float64       // stop once this many times the torrent's length was uploaded
+	Duration time.Duration // stop after seeding this long
+}
+
+// LoadData verifies existing content against the piece hashes and makes
+// every matching piece available to peers. path is the content itself or a
+// directory containing it under the torrent's name; for a multi-file
+// torrent the content is a directory holding its files. It returns the
+// number of pieces that matched.
+func (t *Torrent) LoadData(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var f interface {
+		io.ReaderAt
+		io.Closer
+	}
+	if len(t.Files) > 0 {
+		if !info.IsDir() {
+			return 0, fmt.Errorf("%s is not a directory", path)
+		}
+		if info, err := os.Stat(filepath.Join(path, t.Name)); err == nil && info.IsDir() {
+			path = filepath.Join(path, t.Name)
+		}
+		f = t.openFiles(path)
+	} else {
+		if info.IsDir() {
+			path = filepath.Join(path, t.Name)
+		}
+		if f, err = os.Open(path); err != nil {
+			return 0, err
+		}
+	}
+	defer f.Close()
+
+	t.init()
+	return t.loadPieces(f)
+}
+
+// loadPieces verifies the content in f and stores every matching piece. It
+// returns the number of pieces that matched.
+func (t *Torrent) loadPieces(f io.ReaderAt) (int, error) {
+	verified := 0
+	buf := make([]byte, t.PieceLength)
+	for index := range t.NumPieces() {
+		begin, end := t.calculateBoundsForPiece(index)
+		piece := buf[:end-begin]
+		_, err := f.ReadAt(piece, int64(begin))
+		if err == io.EOF {
+			continue // Content is shorter than the torrent or a file is missing
+		}
+		if err != nil {
+			return verified, err
+		}
+		if t.checkIntegrity(index, piece) != nil {
+			continue
+		}
+
+		t.store.load(index, begin, piece)
+		t.tracker.complete(index)
+		verified++
+	}
+	return verified, nil
+}
+
+// Seed uploads the complete content to peers that connect to us, or that the
+// tracker tells us about, until ctx is done or a limit is reached. The
+// content must have been loaded with LoadData first.
+func (t *Torrent) Seed(ctx context.Context, limits SeedLimits) error {
+	t.init()
+	if n := t.store.count(); n < t.NumPieces() {
+		return fmt.Errorf("cannot seed %s: only %d of %d pieces verified", t.Name, n, t.NumPieces())
+	}
+
+	t.startRun()
+	interval := defaultAnnounceInterval
+	// The download that completed the content already said so
+	if resp, err := t.announce("started"); err != nil {
+		log.Printf("Announce failed: %v", err)
+	} else if resp != nil {
+		interval = t.connectAnnounced(resp)
+	}
+	defer t.announce("stopped")
+	defer t.tracker.stop()
+	defer t.startLSD()()
+	go t.runDHT()
+
+	if limits.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Duration)
+		defer cancel()
+	}
+
+	status := time.NewTicker(seedStatusInterval)
+	defer status.Stop()
+	check := time.NewTicker(time.Second) // for the ratio limit
+	defer check.Stop()
+	reannounce := time.NewTimer(interval)
+	defer reannounce.Stop()
+
+	start := time.Now()
+	lastUploaded := int64(0)
+	for {
+		uploaded := t.uploaded.Load()
+		ratio := float64(uploaded) / float64(t.Length)
+		if limits.Ratio > 0 && ratio >= limits.Ratio {
+			log.Printf("Reached ratio %.2f for '%s', stopping", ratio, t.Name)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped seeding '%s' after %s", t.Name, time.Since(start).Round(time.Second))
+			return nil
+		case <-status.C:
+			rate := float64(uploaded-lastUploaded) / seedStatusInterval.Seconds()
+			lastUploaded = uploaded
+			log.Printf("Seeding '%s': %d peers, uploaded %d bytes (ratio %.2f, %.1f KiB/s)",
+				t.Name, t.tracker.numPeers(), uploaded, ratio, rate/1024)
+		case <-check.C:
+		case <-reannounce.C:
+			if resp, err := t.announce(""); err != nil {
+				log.Printf("Announce failed: %v", err)
+			} else if resp != nil {
+				interval = t.connectAnnounced(resp)
+			}
+			reannounce.Reset(interval)
+		}
+	}
+}
+
+// announce reports our state to the tracker. It does nothing for torrents
+// that were not loaded from a file.
+func (t *Torrent) announce(event string) (*torrent.TrackerResponse, error) {
+	if t.file == nil {
+		return nil, nil
+	}
+	left := int64(0)
+	for index := range t.NumPieces() {
+		if !t.store.has(index) {
+			left += int64(t.calculatePieceSize(index))
+		}
+	}
+	c, err := t.trackerClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, peersV2, err := t.announceSwarms(c, torrent.Announce{
+		Uploaded:   t.uploaded.Load(),
+		Downloaded: t.downloaded.Load(),
+		Left:       left,
+		Event:      event,
+		IPv6:       t.announcedIPv6(),
+	})
+	if len(peersV2) > 0 {
+		t.addPeers(peersV2, t.infoHashes()[1], false)
+	}
+	return resp, err
+}
+
+// connectAnnounced connects to the peers in a tracker response and returns
+// the interval until the next announce.
+func (t *Torrent) connectAnnounced(resp *torrent.TrackerResponse) time.Duration {
+	t.AddPeers(resp.Peers)
+	if resp.Interval <= 0 {
+		return defaultAnnounceInterval
+	}
+	return time.Duration(resp.Interval) * time.Second
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-client/mse"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+func writeTestData(t *testing.T, name string, data []byte) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	return dir
+}
+
+func TestLoadDataVerifiesPieces(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3*pieceLength + 10)
+	tor := newTestTorrent(data, pieceLength)
+
+	corrupt := append([]byte(nil), data...)
+	corrupt[pieceLength+5]++
+	dir := writeTestData(t, tor.Name, corrupt)
+
+	// The directory containing the content works as well as the file itself
+	for _, path := range []string{dir, filepath.Join(dir, tor.Name)} {
+		verified, err := tor.LoadData(path)
+		if err != nil {
+			t.Fatalf("LoadData failed: %v", err)
+		}
+		if verified != 3 {
+			t.Errorf("Expected 3 verified pieces, got %d", verified)
+		}
+	}
+
+	if tor.store.has(1) {
+		t.Error("Expected the corrupted piece not to be stored")
+	}
+	if len(tor.tracker.queue) != 1 || tor.tracker.queue[0].index != 1 {
+		t.Errorf("Expected only piece 1 left to download, got %d pieces", len(tor.tracker.queue))
+	}
+}
+
+func TestSeedRequiresCompleteData(t *testing.T) {
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	if err := tor.Seed(context.Background(), SeedLimits{}); err == nil {
+		t.Error("Expected an error when seeding without data")
+	}
+}
+
+func TestSeedStopsAfterDuration(t *testing.T) {
+	data := newTestData(MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	if _, err := tor.LoadData(writeTestData(t, tor.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+
+	start := time.Now()
+	if err := tor.Seed(context.Background(), SeedLimits{Duration: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Seed failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Seed ran for %s", elapsed)
+	}
+}
+
+func TestSeedUploadsToIncomingPeerUntilRatio(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(2 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+	if _, err := tor.LoadData(writeTestData(t, tor.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l := newTestListener(t, tor)
+
+	// One block is a quarter of the content
+	done := make(chan error, 1)
+	go func() {
+		done <- tor.Seed(context.Background(), SeedLimits{Ratio: 0.25})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var peerID [20]byte
+	copy(peerID[:], "-TL0001-testleecher0")
+	conn.Write(peer.NewHandshake(tor.InfoHash, peerID).Serialize())
+	conn.Write((&peer.Message{ID: peer.MsgBitfield, Payload: []byte{0}}).Serialize())
+	if _, err := peer.ReadHandshake(conn); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	conn.Write((&peer.Message{ID: peer.MsgInterested}).Serialize())
+
+	for {
+		msg, err := peer.ReadMessage(conn)
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		if msg != nil && msg.ID == peer.MsgUnchoke {
+			conn.Write(peer.NewRequestMessage(1, MaxBlockSize, MaxBlockSize).Serialize())
+		}
+		if msg != nil && msg.ID == peer.MsgPiece {
+			_, block, err := peer.ParsePieceMessage(1, msg.Payload)
+			if err != nil {
+				t.Fatalf("Unexpected piece: %v", err)
+			}
+			if !bytes.Equal(block, data[pieceLength+MaxBlockSize:]) {
+				t.Error("Uploaded block does not match")
+			}
+			break
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Seed failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Seed did not stop at the ratio limit")
+	}
+}
+
+func TestSeedAfterDownload(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	_, middle := newTestSeedTorrent(t, data, MaxBlockSize, mse.Disabled)
+	if _, err := middle.Download(); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	// Downloading again finds every piece and returns at once
+	if _, err := middle.Download(); err != nil {
+		t.Fatalf("Second download failed: %v", err)
+	}
+
+	l := newTestListener(t, middle)
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded := make(chan error, 1)
+	go func() { seeded <- middle.Seed(ctx, SeedLimits{}) }()
+
+	leecher := newTestTorrent(data, MaxBlockSize)
+	copy(leecher.PeerID[:], "-TC0001-testclient02")
+	leecher.Peers = []torrent.Peer{listenerPeer(l)}
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download from the seeding torrent failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	cancel()
+	if err := <-seeded; err != nil {
+		t.Errorf("Seed failed: %v", err)
+	}
+}
+
+func TestSeedAnnouncesCompletedOnlyAfterDownload(t *testing.T) {
+	events := make(chan string, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		events <- q.Get("event") + " left=" + q.Get("left")
+		fmt.Fprint(w, "d8:intervali900e5:peers0:e")
+	}))
+	defer tracker.Close()
+
+	data := newTestData(3 * MaxBlockSize)
+	_, tor := newTestSeedTorrent(t, data, MaxBlockSize, mse.Disabled)
+	tor.file = &torrent.TorrentFile{Announce: tracker.URL + "/announce", InfoHash: tor.InfoHash, Length: tor.Length}
+	if _, err := tor.Download(); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	// Neither finding the content complete nor seeding it is a completion
+	if _, err := tor.Download(); err != nil {
+		t.Fatalf("Second download failed: %v", err)
+	}
+	if err := tor.Seed(context.Background(), SeedLimits{Duration: 100 * time.Millisecond}); err != nil {
+		t.Fatalf("Seed failed: %v", err)
+	}
+
+	var got []string
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 3 announces, got %v", got)
+		}
+	}
+	// The completed announce runs in the background
+	want := map[string]bool{"completed left=0": true, "started left=0": true, "stopped left=0": true}
+	for _, e := range got {
+		if !want[e] {
+			t.Errorf("Unexpected announce %q", e)
+		}
+		delete(want, e)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("Unexpected announce %q", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
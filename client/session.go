@@ -0,0 +1,604 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"torrent-client/dht"
+	"torrent-client/lsd"
+	"torrent-client/mse"
+	"torrent-client/proxy"
+	"torrent-client/ratelimit"
+	"torrent-client/utp"
+)
+
+const (
+	// DefaultMaxActiveDownloads is the default number of torrents a Session
+	// downloads at once.
+	DefaultMaxActiveDownloads = 3
+	// DefaultMaxActiveSeeds is the default number of torrents a Session
+	// seeds at once.
+	DefaultMaxActiveSeeds = 5
+	// DefaultDiskWorkers is the default number of reads and writes of
+	// torrent data a Session runs at once.
+	DefaultDiskWorkers = 2
+)
+
+// State is the state of a torrent in a Session.
+type State int
+
+const (
+	// Checking verifies the data already on disk.
+	Checking State = iota
+	// Queued waits for a free download or seed slot.
+	Queued
+	Downloading
+	Seeding
+	// Paused keeps the verified pieces on disk until the torrent is
+	// resumed.
+	Paused
+	// Finished reached the seed limits.
+	Finished
+	// Failed stopped with an error.
+	Failed
+)
+
+var stateNames = [...]string{"checking", "queued", "downloading", "seeding", "paused", "finished", "failed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+var errSessionClosed = errors.New("session is closed")
+
+// SessionConfig configures a Session. The DHT, LSD service and uTP socket,
+// if set, are shared by all its torrents and closed with it.
+type SessionConfig struct {
+	// ListenAddr is where incoming peer connections are accepted, e.g.
+	// ":6881". None are without it, or in proxy-only mode.
+	ListenAddr string
+	// MaxConns stops incoming connections from being accepted while all
+	// torrents have this many. Outgoing connections are only bound by each
+	// torrent's MaxConns. Defaults to DefaultMaxListenerConns.
+	MaxConns int
+
+	DHT        *dht.Server
+	LSD        *lsd.Service
+	UTP        *utp.Socket
+	Encryption mse.Policy
+	Transport  utp.Policy
+	Proxy      *proxy.Proxy
+	ProxyOnly  bool
+
+	// MaxActiveDownloads and MaxActiveSeeds limit how many torrents download
+	// and seed at once. The others are queued in the order they were added.
+	// They default to DefaultMaxActiveDownloads and DefaultMaxActiveSeeds;
+	// a negative value means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// SeedLimits bound how long each complete torrent is seeded.
+	SeedLimits SeedLimits
+	// DiskWorkers limits how many reads and writes of torrent data run at
+	// once. Defaults to DefaultDiskWorkers.
+	DiskWorkers int
+}
+
+// Session runs many torrents in one process. They share a listener, the
+// DHT, rate limits, disk workers and a peer ID.
+type Session struct {
+	config   SessionConfig
+	peerID   [20]byte
+	listener *Listener
+	disk     chan struct{} // holds a token per busy disk worker
+
+	downloadLimit ratelimit.Limiter
+	uploadLimit   ratelimit.Limiter
+
+	mu       sync.Mutex
+	torrents []*sessionTorrent // in the order they were added
+	closed   bool
+}
+
+// sessionTorrent is a torrent added to a Session. Every time it starts, a
+// fresh copy of meta runs with the verified pieces loaded from disk. Its
+// content stays in its files: each piece is written there once verified and
+// read from there to upload it.
+type sessionTorrent struct {
+	meta     *Torrent
+	dir      string
+	state    State
+	err      error
+	checked  bool     // the data on disk was checked after Add
+	complete bool     // every piece is verified and written
+	run      *Torrent // the current run, nil while stopped
+	cancel   context.CancelFunc
+	stopped  chan struct{} // closed when the current run has ended
+
+	// Totals of the last run, reported while stopped
+	verified   int
+	downloaded int64
+	uploaded   int64
+}
+
+// TorrentStatus describes a torrent of a Session.
+type TorrentStatus struct {
+	InfoHash   [20]byte
+	Name       string
+	State      State
+	Verified   int // number of verified pieces
+	NumPieces  int
+	Downloaded int64 // bytes
+	Uploaded   int64 // bytes
+	Peers      int
+	Err        error // why the torrent failed
+}
+
+// NewSession starts a session, listening on config.ListenAddr if set.
+func NewSession(config SessionConfig) (*Session, error) {
+	peerID, err := generatePeerID()
+	if err != nil {
+		return nil, err
+	}
+	workers := config.DiskWorkers
+	if workers <= 0 {
+		workers = DefaultDiskWorkers
+	}
+	s := &Session{config: config, peerID: peerID, disk: make(chan struct{}, workers)}
+
+	if config.ListenAddr != "" && !config.ProxyOnly {
+		l, err := Listen(config.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
+		l.MaxConns = config.MaxConns
+		l.Encryption = config.Encryption
+		s.listener = l
+		go l.Serve()
+		if config.UTP != nil {
+			go l.ServeUTP(config.UTP)
+		}
+	}
+	return s, nil
+}
+
+// Addr returns the address of the session's listener, or nil if it has
+// none.
+func (s *Session) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// PeerID returns the peer ID of every torrent of the session.
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// SetRateLimit caps the combined download and upload rates of the session's
+// torrents in bytes per second. 0 means unlimited. It replaces the global
+// rate limit for them.
+func (s *Session) SetRateLimit(download, upload int64) {
+	s.downloadLimit.SetRate(download)
+	s.uploadLimit.SetRate(upload)
+}
+
+// Add adds t, as returned by Load, to the session. Its content is kept in
+// dir under the torrent's name. Data already there is checked first, so a
+// complete torrent is seeded right away. Changes to t after Add have no
+// effect.
+func (s *Session) Add(t *Torrent, dir string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSessionClosed
+	}
+	if s.find(t.InfoHash) != nil {
+		return fmt.Errorf("%s was already added", t.Name)
+	}
+	e := &sessionTorrent{meta: t, dir: dir, state: Checking, stopped: make(chan struct{})}
+	s.torrents = append(s.torrents, e)
+	go s.check(e)
+	return nil
+}
+
+// Remove stops a torrent and removes it from the session once it has
+// disconnected from its peers. Its data is left on disk.
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	e := s.find(infoHash)
+	if e == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	for i, other := range s.torrents {
+		if other == e {
+			s.torrents = append(s.torrents[:i], s.torrents[i+1:]...)
+			break
+		}
+	}
+	if e.cancel != nil {
+		e.cancel()
+	}
+	stopped := e.stopped
+	s.schedule()
+	s.mu.Unlock()
+
+	<-stopped
+	log.Printf("Removed '%s'", e.meta.Name)
+	return nil
+}
+
+// Pause stops downloading or seeding a torrent until Resume is called. Its
+// verified pieces stay on disk and are loaded from there on resume.
+func (s *Session) Pause(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.find(infoHash)
+	if e == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	switch e.state {
+	case Paused:
+		return nil
+	case Finished, Failed:
+		return fmt.Errorf("cannot pause %s: it is %s", e.meta.Name, e.state)
+	}
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.state = Paused
+	log.Printf("Paused '%s'", e.meta.Name)
+	s.schedule()
+	return nil
+}
+
+// Resume queues a paused torrent again. Finished and failed torrents are
+// queued as well, to seed or retry them.
+func (s *Session) Resume(infoHash [20]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.find(infoHash)
+	if e == nil {
+		return fmt.Errorf("unknown torrent %x", infoHash)
+	}
+	if e.state != Paused && e.state != Finished && e.state != Failed {
+		return nil
+	}
+	e.err = nil
+	if !e.checked {
+		e.state = Checking // the check is still running
+	} else {
+		e.state = Queued
+	}
+	log.Printf("Resumed '%s'", e.meta.Name)
+	s.schedule()
+	return nil
+}
+
+// Status returns the status of a torrent of the session.
+func (s *Session) Status(infoHash [20]byte) (TorrentStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.find(infoHash)
+	if e == nil {
+		return TorrentStatus{}, false
+	}
+	return e.status(), true
+}
+
+// Torrents returns the status of every torrent of the session, in the order
+// they were added.
+func (s *Session) Torrents() []TorrentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]TorrentStatus, len(s.torrents))
+	for i, e := range s.torrents {
+		statuses[i] = e.status()
+	}
+	return statuses
+}
+
+// Close stops every torrent, then closes the listener, the DHT, the LSD
+// service and the uTP socket.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	var stopped []chan struct{}
+	for _, e := range s.torrents {
+		if e.cancel != nil {
+			e.cancel()
+		}
+		stopped = append(stopped, e.stopped)
+	}
+	s.mu.Unlock()
+	for _, c := range stopped {
+		<-c
+	}
+
+	var err error
+	keep := func(cerr error) {
+		// The DHT may run on the uTP socket and close it first
+		if err == nil && cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+			err = cerr
+		}
+	}
+	if s.listener != nil {
+		keep(s.listener.Close())
+	}
+	if s.config.LSD != nil {
+		keep(s.config.LSD.Close())
+	}
+	if s.config.DHT != nil {
+		keep(s.config.DHT.Close())
+	}
+	if s.config.UTP != nil {
+		keep(s.config.UTP.Close())
+	}
+	return err
+}
+
+func (s *Session) find(infoHash [20]byte) *sessionTorrent {
+	for _, e := range s.torrents {
+		if e.meta.InfoHash == infoHash {
+			return e
+		}
+	}
+	return nil
+}
+
+func (e *sessionTorrent) status() TorrentStatus {
+	st := TorrentStatus{
+		InfoHash:   e.meta.InfoHash,
+		Name:       e.meta.Name,
+		State:      e.state,
+		Verified:   e.verified,
+		NumPieces:  e.meta.NumPieces(),
+		Downloaded: e.downloaded,
+		Uploaded:   e.uploaded,
+		Err:        e.err,
+	}
+	if t := e.run; t != nil {
+		st.Verified = t.store.count()
+		st.Downloaded = t.downloaded.Load()
+		st.Uploaded = t.uploaded.Load()
+		st.Peers = t.tracker.numPeers()
+	}
+	return st
+}
+
+// schedule starts queued torrents, in the order they were added, while
+// download and seed slots are free. s.mu must be held.
+func (s *Session) schedule() {
+	if s.closed {
+		return
+	}
+	downloads, seeds := 0, 0
+	for _, e := range s.torrents {
+		switch e.state {
+		case Downloading:
+			downloads++
+		case Seeding:
+			seeds++
+		}
+	}
+	for _, e := range s.torrents {
+		if e.state != Queued {
+			continue
+		}
+		if e.complete && !limitReached(seeds, s.config.MaxActiveSeeds, DefaultMaxActiveSeeds) {
+			s.start(e, Seeding)
+			seeds++
+		} else if !e.complete && !limitReached(downloads, s.config.MaxActiveDownloads, DefaultMaxActiveDownloads) {
+			s.start(e, Downloading)
+			downloads++
+		}
+	}
+}
+
+func limitReached(n, limit, defaultLimit int) bool {
+	if limit == 0 {
+		limit = defaultLimit
+	}
+	return limit > 0 && n >= limit
+}
+
+// start runs e in the given state once its last run has ended. s.mu must be
+// held.
+func (s *Session) start(e *sessionTorrent, state State) {
+	ctx, cancel := context.WithCancel(context.Background())
+	lastStopped := e.stopped
+	stopped := make(chan struct{})
+	e.state, e.cancel, e.stopped = state, cancel, stopped
+	log.Printf("Starting '%s' (%s)", e.meta.Name, state)
+
+	go func() {
+		defer close(stopped)
+		// The last run must have left the listener and LSD, and closed its
+		// files
+		<-lastStopped
+		if ctx.Err() != nil {
+			return
+		}
+		t, err := s.load(e)
+		if err != nil {
+			s.finish(ctx, e, Failed, err)
+			return
+		}
+		s.mu.Lock()
+		e.run = t
+		s.mu.Unlock()
+		defer s.unload(e, t)
+
+		if s.listener != nil {
+			s.listener.Add(t)
+			defer s.listener.Remove(t)
+		}
+		if state == Seeding {
+			if t.store.count() < t.NumPieces() {
+				log.Printf("'%s' is incomplete on disk, downloading it again", t.Name)
+				s.mu.Lock()
+				e.complete = false
+				s.mu.Unlock()
+				s.finish(ctx, e, Queued, nil)
+				return
+			}
+			err := t.Seed(ctx, s.config.SeedLimits)
+			s.finish(ctx, e, Finished, err)
+			return
+		}
+
+		if t.file != nil {
+			if err := t.RequestPeers(); err != nil {
+				log.Printf("Failed to get peers for '%s' from the tracker: %v", t.Name, err)
+			}
+		}
+		err = t.download(ctx)
+		if err == nil {
+			s.mu.Lock()
+			e.complete = true
+			s.mu.Unlock()
+		}
+		s.finish(ctx, e, Queued, err) // to seed it
+	}()
+}
+
+// finish records that the run of e ended in state, or failed with err,
+// unless it was stopped by Pause, Remove or Close. The slot it held is
+// handed to the next queued torrent.
+func (s *Session) finish(ctx context.Context, e *sessionTorrent, state State, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() == nil {
+		e.cancel()
+		if err != nil {
+			log.Printf("'%s' failed: %v", e.meta.Name, err)
+			e.state, e.err = Failed, err
+		} else {
+			e.state = state
+		}
+	}
+	s.schedule()
+}
+
+// check verifies the data of a newly added torrent and queues it. The data
+// is loaded again when the torrent starts.
+func (s *Session) check(e *sessionTorrent) {
+	defer close(e.stopped)
+	var verified int
+	t, err := s.load(e)
+	if err == nil {
+		verified = t.store.count()
+		t.tracker.stop()
+		t.store.close()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.checked = true
+	e.verified = verified
+	e.complete = verified == e.meta.NumPieces()
+	if err != nil {
+		log.Printf("Checking '%s' failed: %v", e.meta.Name, err)
+		e.state, e.err = Failed, err
+	} else if e.state == Checking {
+		log.Printf("Checked '%s': %d of %d pieces verified", e.meta.Name, verified, e.meta.NumPieces())
+		e.state = Queued
+	}
+	s.schedule()
+}
+
+// load returns a new run of e with the verified pieces on disk and the
+// transfer totals of the last run.
+func (s *Session) load(e *sessionTorrent) (*Torrent, error) {
+	t := s.newRun(e.meta, e.dir)
+	if _, err := t.loadPieces(t.files); err != nil {
+		t.tracker.stop()
+		t.store.close()
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.downloaded.Store(e.downloaded)
+	t.uploaded.Store(e.uploaded)
+	return t, nil
+}
+
+// unload keeps the totals of the ended run t of e and closes its files.
+func (s *Session) unload(e *sessionTorrent, t *Torrent) {
+	if err := t.store.close(); err != nil {
+		log.Printf("Failed to close the files of '%s': %v", t.Name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.verified = t.store.count()
+	e.downloaded = t.downloaded.Load()
+	e.uploaded = t.uploaded.Load()
+	e.run = nil
+}
+
+// newRun returns a copy of meta set up to run in the session, with its
+// content in dir under the torrent's name.
+func (s *Session) newRun(meta *Torrent, dir string) *Torrent {
+	c := s.config
+	t := &Torrent{
+		Peers:            meta.Peers,
+		PeerID:           s.peerID,
+		InfoHash:         meta.InfoHash,
+		PieceHashes:      meta.PieceHashes,
+		PiecesV2:         meta.PiecesV2,
+		InfoHashV2:       meta.InfoHashV2,
+		PieceLength:      meta.PieceLength,
+		Length:           meta.Length,
+		Name:             meta.Name,
+		Files:            meta.Files,
+		WebSeeds:         meta.WebSeeds,
+		HTTPSeeds:        meta.HTTPSeeds,
+		Private:          meta.Private,
+		Sequential:       meta.Sequential,
+		MaxRequestLength: meta.MaxRequestLength,
+		MaxConns:         meta.MaxConns,
+		UploadSlots:      meta.UploadSlots,
+		DHT:              c.DHT,
+		LSD:              c.LSD,
+		Encryption:       c.Encryption,
+		UTP:              c.UTP,
+		Transport:        c.Transport,
+		Dialer:           meta.Dialer,
+		Proxy:            c.Proxy,
+		ProxyOnly:        c.ProxyOnly,
+		file:             meta.file,
+		session:          s,
+		peersV2:          meta.peersV2,
+	}
+	if s.listener != nil {
+		t.ListenPort = s.listener.port()
+	}
+	t.SetRateLimit(meta.downloadLimit.Rate(), meta.uploadLimit.Rate())
+	meta.limitMu.Lock()
+	t.peerDownloadRate, t.peerUploadRate = meta.peerDownloadRate, meta.peerUploadRate
+	meta.limitMu.Unlock()
+	t.files = t.openFiles(filepath.Join(dir, meta.Name))
+	t.files.disk = s.withDisk
+	t.init()
+	return t
+}
+
+// withDisk runs f once a disk worker is free.
+func (s *Session) withDisk(f func() error) error {
+	s.disk <- struct{}{}
+	defer func() { <-s.disk }()
+	return f()
+}
@@ -0,0 +1,272 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+func newTestSession(t *testing.T, config SessionConfig) *Session {
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	s, err := NewSession(config)
+	if err != nil {
+		t.Fatalf("NewSession failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestSessionTorrent returns a torrent of data with its own name and
+// infohash.
+func newTestSessionTorrent(data []byte, pieceLength int, name string) *Torrent {
+	tor := newTestTorrent(data, pieceLength)
+	tor.Name = name
+	copy(tor.InfoHash[:], name)
+	return tor
+}
+
+// running reports whether the torrent has a run with its files open.
+func (s *Session) running(infoHash [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.find(infoHash)
+	return e != nil && e.run != nil
+}
+
+func waitForState(t *testing.T, s *Session, infoHash [20]byte, state State) TorrentStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, ok := s.Status(infoHash)
+		if !ok {
+			t.Fatalf("Unknown torrent %x", infoHash)
+		}
+		if st.State == state {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be %s, got %s (%v)", st.Name, state, st.State, st.Err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionDownloadsThenSeeds(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(3*pieceLength + 100)
+
+	seeder := newTestSession(t, SessionConfig{})
+	tor := newTestSessionTorrent(data, pieceLength, "movie")
+	if err := seeder.Add(tor, writeTestData(t, tor.Name, data)); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, seeder, tor.InfoHash, Seeding)
+
+	leecher := newTestSession(t, SessionConfig{})
+	tor = newTestSessionTorrent(data, pieceLength, "movie")
+	addr := seeder.Addr().(*net.TCPAddr)
+	tor.Peers = []torrent.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+	dir := t.TempDir()
+	if err := leecher.Add(tor, dir); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if err := leecher.Add(tor, dir); err == nil {
+		t.Error("Expected adding the torrent twice to fail")
+	}
+
+	st := waitForState(t, leecher, tor.InfoHash, Seeding)
+	if st.Verified != st.NumPieces {
+		t.Errorf("Expected %d verified pieces, got %d", st.NumPieces, st.Verified)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "movie"))
+	if err != nil {
+		t.Fatalf("Failed to read the saved content: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Saved content does not match")
+	}
+}
+
+func TestSessionQueuesDownloads(t *testing.T) {
+	data := newTestData(2 * MaxBlockSize)
+	s := newTestSession(t, SessionConfig{MaxActiveDownloads: 1})
+
+	// Without peers both would download forever
+	a := newTestSessionTorrent(data, MaxBlockSize, "a")
+	b := newTestSessionTorrent(data, MaxBlockSize, "b")
+	if err := s.Add(a, t.TempDir()); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, s, a.InfoHash, Downloading)
+	if err := s.Add(b, t.TempDir()); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, s, b.InfoHash, Queued)
+
+	// Pausing a hands its slot to b, and a queues behind it when resumed
+	if err := s.Pause(a.InfoHash); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	waitForState(t, s, a.InfoHash, Paused)
+	waitForState(t, s, b.InfoHash, Downloading)
+	if err := s.Resume(a.InfoHash); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	waitForState(t, s, a.InfoHash, Queued)
+
+	if err := s.Remove(b.InfoHash); err != nil {
+		t.Fatalf("Remove failed: %v", err)
+	}
+	waitForState(t, s, a.InfoHash, Downloading)
+	if _, ok := s.Status(b.InfoHash); ok {
+		t.Error("Expected b to be removed")
+	}
+	if n := len(s.Torrents()); n != 1 {
+		t.Errorf("Expected 1 torrent, got %d", n)
+	}
+}
+
+func TestSessionPauseKeepsVerifiedPieces(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data := newTestData(4 * pieceLength)
+	s := newTestSession(t, SessionConfig{})
+
+	// Only the first half is on disk
+	tor := newTestSessionTorrent(data, pieceLength, "half")
+	dir := writeTestData(t, tor.Name, data[:2*pieceLength])
+	if err := s.Add(tor, dir); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if st := waitForState(t, s, tor.InfoHash, Downloading); st.Verified != 2 {
+		t.Errorf("Expected 2 verified pieces, got %d", st.Verified)
+	}
+
+	if err := s.Pause(tor.InfoHash); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	// A stopped torrent closes its files
+	deadline := time.Now().Add(5 * time.Second)
+	for s.running(tor.InfoHash) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the paused torrent to end its run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st, _ := s.Status(tor.InfoHash); st.Verified != 2 {
+		t.Errorf("Expected 2 verified pieces while paused, got %d", st.Verified)
+	}
+	if err := s.Resume(tor.InfoHash); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if st := waitForState(t, s, tor.InfoHash, Downloading); st.Verified != 2 {
+		t.Errorf("Expected 2 verified pieces after resuming, got %d", st.Verified)
+	}
+}
+
+func TestSessionRunWritesPiecesToItsFiles(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data := newTestData(4 * pieceLength)
+	clear(data[pieceLength+100 : 2*pieceLength]) // padding reads as zeros
+	tor := newTestMultiFileTorrent(data, pieceLength, pieceLength+100, pieceLength-100, 2*pieceLength)
+	tor.Files[1].Padding = true
+	s := newTestSession(t, SessionConfig{})
+	dir := t.TempDir()
+	run := s.newRun(tor, dir)
+	defer run.store.close()
+	if run.store.buf != nil {
+		t.Error("Expected the content not to be held in memory")
+	}
+
+	for _, index := range []int{1, 3} {
+		begin, end := run.calculateBoundsForPiece(index)
+		if err := run.store.put(index, begin, data[begin:end]); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, tor.Name, "dir", "b")); !os.IsNotExist(err) {
+		t.Error("Expected the padding file not to be written")
+	}
+	// Uploads read the pieces back from the files
+	if block, err := run.store.read(3*pieceLength+10, 100); err != nil || !bytes.Equal(block, data[3*pieceLength+10:3*pieceLength+110]) {
+		t.Errorf("Expected the block to be read from disk, got %v", err)
+	}
+
+	// Each piece is on disk as soon as it is stored
+	loaded := newTestMultiFileTorrent(data, pieceLength, pieceLength+100, pieceLength-100, 2*pieceLength)
+	loaded.Files[1].Padding = true
+	verified, err := loaded.LoadData(dir)
+	if err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	if verified != 2 || !loaded.store.has(1) || !loaded.store.has(3) {
+		t.Errorf("Expected pieces 1 and 3 to be verified, got %d pieces", verified)
+	}
+}
+
+func TestSessionQueuesSeedsUntilLimitsAreReached(t *testing.T) {
+	data := newTestData(2 * MaxBlockSize)
+	s := newTestSession(t, SessionConfig{
+		MaxActiveSeeds: 1,
+		SeedLimits:     SeedLimits{Duration: 500 * time.Millisecond},
+	})
+
+	a := newTestSessionTorrent(data, MaxBlockSize, "a")
+	b := newTestSessionTorrent(data, MaxBlockSize, "b")
+	dir := writeTestData(t, "a", data)
+	if err := os.WriteFile(filepath.Join(dir, "b"), data, 0644); err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+	if err := s.Add(a, dir); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, s, a.InfoHash, Seeding)
+	if err := s.Add(b, dir); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, s, b.InfoHash, Queued)
+
+	waitForState(t, s, a.InfoHash, Finished)
+	waitForState(t, s, b.InfoHash, Finished)
+	if err := s.Pause(a.InfoHash); err == nil {
+		t.Error("Expected pausing a finished torrent to fail")
+	}
+}
+
+func TestSessionAnnouncesItsListenPort(t *testing.T) {
+	data := newTestData(2 * MaxBlockSize)
+	s := newTestSession(t, SessionConfig{})
+	tor := newTestSessionTorrent(data, MaxBlockSize, "port")
+	if err := s.Add(tor, writeTestData(t, tor.Name, data)); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	waitForState(t, s, tor.InfoHash, Seeding)
+
+	_, ours := dialExtendedPeer(t, s.listener, tor)
+	if port := s.Addr().(*net.TCPAddr).Port; ours.P != port {
+		t.Errorf("Expected port %d in the extended handshake, got %d", port, ours.P)
+	}
+}
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		state    State
+		expected string
+	}{
+		{Checking, "checking"},
+		{Seeding, "seeding"},
+		{Failed, "failed"},
+		{State(42), "State(42)"},
+	}
+	for _, tt := range tests {
+		if s := tt.state.String(); s != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, s)
+		}
+	}
+}
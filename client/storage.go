@@ -0,0 +1,160 @@
+package client
+
+import (
+	"sync"
+
+	"torrent-client/peer"
+)
+
+// pieceStore holds the verified pieces of a torrent, in memory or in its
+// files, and lets readers wait for the pieces they need.
+type pieceStore struct {
+	mu      sync.Mutex
+	buf     []byte   // the content, unless files holds it
+	files   *fileSet // nil if the content is kept in memory
+	have    []bool
+	changed chan struct{}
+}
+
+func newPieceStore(length, numPieces int, files *fileSet) *pieceStore {
+	s := &pieceStore{
+		files:   files,
+		have:    make([]bool, numPieces),
+		changed: make(chan struct{}),
+	}
+	if files == nil {
+		s.buf = make([]byte, length)
+	}
+	return s
+}
+
+// put stores a verified piece that starts at offset begin, writing it to
+// the files if the store keeps them.
+func (s *pieceStore) put(index, begin int, data []byte) error {
+	if s.files != nil {
+		if _, err := s.files.WriteAt(data, int64(begin)); err != nil {
+			return err
+		}
+	}
+	s.load(index, begin, data)
+	return nil
+}
+
+// load records a piece that was verified in the store's files, or copies it
+// in if the store is in memory.
+func (s *pieceStore) load(index, begin int, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.files == nil {
+		copy(s.buf[begin:], data)
+	}
+	s.have[index] = true
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// readAt copies data at off into p if piece index, which must cover the
+// whole range, has been verified. Otherwise it returns a channel that is
+// closed when the next piece arrives.
+func (s *pieceStore) readAt(p []byte, off int64, index int) (int, <-chan struct{}, error) {
+	s.mu.Lock()
+	if !s.have[index] {
+		defer s.mu.Unlock()
+		return 0, s.changed, nil
+	}
+	if s.files == nil {
+		defer s.mu.Unlock()
+		return copy(p, s.buf[off:]), nil, nil
+	}
+	s.mu.Unlock()
+	n, err := s.files.ReadAt(p, off)
+	return n, nil, err
+}
+
+// bytes returns a copy of the whole content.
+func (s *pieceStore) bytes() ([]byte, error) {
+	if s.files != nil {
+		return s.read(0, s.files.t.Length)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]byte(nil), s.buf...), nil
+}
+
+// close closes the files of the store, if it keeps any.
+func (s *pieceStore) close() error {
+	if s.files == nil {
+		return nil
+	}
+	return s.files.Close()
+}
+
+// count returns the number of verified pieces.
+func (s *pieceStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, ok := range s.have {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// wait returns a channel that is closed when the next piece is stored.
+func (s *pieceStore) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+// wants reports whether bf has any piece that is not verified yet.
+func (s *pieceStore) wants(bf peer.Bitfield) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, ok := range s.have {
+		if !ok && bf.HasPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *pieceStore) has(index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.have[index]
+}
+
+// bitfield returns the verified pieces in wire format.
+func (s *pieceStore) bitfield() peer.Bitfield {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bf := make(peer.Bitfield, (len(s.have)+7)/8)
+	for i, ok := range s.have {
+		if ok {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// read returns a copy of length bytes at off, which must lie in verified
+// pieces.
+func (s *pieceStore) read(off, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	if s.files != nil {
+		if _, err := s.files.ReadAt(buf, int64(off)); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(buf, s.buf[off:off+length])
+	return buf, nil
+}
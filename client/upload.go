@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"log"
+)
+
+// Requests beyond this many queued for a single peer are dropped.
+const maxUploadQueue = 250
+
+// queueUpload validates a block request from the peer and queues it. Requests
+// that may legitimately race with our own state changes, such as arriving
+// after we choked the peer, are dropped, or rejected with the fast
+// extension; malformed requests are an error. Allowed fast pieces are served
+// even while the peer is choked.
+func (state *peerState) queueUpload(index, begin, length int) error {
+	t := state.torrent
+	maxLength := t.MaxRequestLength
+	if maxLength == 0 {
+		maxLength = MaxBlockSize
+	}
+
+	if index < 0 || index >= t.NumPieces() {
+		return fmt.Errorf("request for invalid piece %d", index)
+	}
+	if length <= 0 || length > maxLength {
+		return fmt.Errorf("request length %d out of range (max %d)", length, maxLength)
+	}
+	if begin < 0 || begin+length > t.calculatePieceSize(index) {
+		return fmt.Errorf("request for %d bytes at %d exceeds piece %d", length, begin, index)
+	}
+
+	c := state.client
+	if (c.AmChoking && !state.allowedFast[index]) || !t.store.has(index) {
+		return state.refuseUpload(index, begin, length)
+	}
+	if len(state.uploads) >= maxUploadQueue {
+		log.Printf("Dropping request from %s: upload queue full\n", c)
+		return state.refuseUpload(index, begin, length)
+	}
+	state.uploads = append(state.uploads, blockRequest{index, begin, length})
+	return nil
+}
+
+// refuseUpload rejects a request the peer would otherwise have to time out,
+// if it supports the fast extension.
+func (state *peerState) refuseUpload(index, begin, length int) error {
+	if !state.client.SupportsFast() {
+		return nil
+	}
+	return state.client.SendReject(index, begin, length)
+}
+
+// cancelUpload removes a queued request that the peer no longer wants.
+func (state *peerState) cancelUpload(index, begin, length int) {
+	req := blockRequest{index, begin, length}
+	for i, queued := range state.uploads {
+		if queued == req {
+			state.uploads = append(state.uploads[:i], state.uploads[i+1:]...)
+			return
+		}
+	}
+}
+
+// sendUpload answers the oldest queued request.
+func (state *peerState) sendUpload() error {
+	req := state.uploads[0]
+	state.uploads = state.uploads[1:]
+
+	begin, _ := state.torrent.calculateBoundsForPiece(req.index)
+	block, err := state.torrent.store.read(begin+req.begin, req.length)
+	if err != nil {
+		return err
+	}
+	if err := state.client.SendPiece(req.index, req.begin, block); err != nil {
+		return err
+	}
+	state.torrent.uploaded.Add(int64(len(block)))
+	state.pipeline.onUpload(len(block))
+	return nil
+}
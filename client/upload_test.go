@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/mse"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+func TestQueueUploadValidation(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(2*pieceLength + 100)
+	tor := newTestTorrent(data, pieceLength)
+	tor.init()
+	tor.store.put(0, 0, data[:pieceLength])
+	tor.store.put(2, 2*pieceLength, data[2*pieceLength:])
+
+	testCases := []struct {
+		name    string
+		choked  bool
+		req     blockRequest
+		queued  bool
+		wantErr bool
+	}{
+		{"valid", false, blockRequest{0, 0, MaxBlockSize}, true, false},
+		{"short last piece", false, blockRequest{2, 0, 100}, true, false},
+		{"choked", true, blockRequest{0, 0, MaxBlockSize}, false, false},
+		{"missing piece", false, blockRequest{1, 0, MaxBlockSize}, false, false},
+		{"invalid piece", false, blockRequest{3, 0, MaxBlockSize}, false, true},
+		{"too long", false, blockRequest{0, 0, MaxBlockSize + 1}, false, true},
+		{"past end of piece", false, blockRequest{2, 64, 100}, false, true},
+		{"zero length", false, blockRequest{0, 0, 0}, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := peerState{torrent: tor, client: &peer.Client{AmChoking: tc.choked}}
+			err := state.queueUpload(tc.req.index, tc.req.begin, tc.req.length)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Expected error %v, got %v", tc.wantErr, err)
+			}
+			if queued := len(state.uploads) == 1; queued != tc.queued {
+				t.Errorf("Expected queued %v, got %v", tc.queued, queued)
+			}
+		})
+	}
+}
+
+func TestCancelUploadRemovesQueuedRequest(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+	tor.init()
+	tor.store.put(0, 0, data)
+
+	state := peerState{torrent: tor, client: &peer.Client{}}
+	state.queueUpload(0, 0, MaxBlockSize)
+	state.queueUpload(0, MaxBlockSize, MaxBlockSize)
+	state.cancelUpload(0, 0, MaxBlockSize)
+
+	if len(state.uploads) != 1 || state.uploads[0].begin != MaxBlockSize {
+		t.Errorf("Expected only the second request to remain, got %v", state.uploads)
+	}
+}
+
+// serveTestLeecher accepts a connection from the client, announces no pieces and
+// requests the first block of every piece the client announces once it is
+// unchoked.
+func serveTestLeecher(t *testing.T, infoHash [20]byte, numPieces int) (torrent.Peer, <-chan *peer.Message) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	pieces := make(chan *peer.Message, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := peer.ReadHandshake(conn); err != nil {
+			return
+		}
+		var peerID [20]byte
+		copy(peerID[:], "-TL0001-testleecher0")
+		conn.Write(peer.NewHandshake(infoHash, peerID).Serialize())
+		conn.Write((&peer.Message{ID: peer.MsgBitfield, Payload: make([]byte, (numPieces+7)/8)}).Serialize())
+		conn.Write((&peer.Message{ID: peer.MsgInterested}).Serialize())
+
+		// Asking for a piece the client does not have yet goes unanswered
+		conn.Write(peer.NewRequestMessage(1, 0, MaxBlockSize).Serialize())
+
+		choked := true
+		var waiting []int
+		for {
+			msg, err := peer.ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil {
+				continue
+			}
+			switch msg.ID {
+			case peer.MsgUnchoke:
+				choked = false
+				for _, index := range waiting {
+					conn.Write(peer.NewRequestMessage(index, 0, MaxBlockSize).Serialize())
+				}
+				waiting = nil
+			case peer.MsgHave:
+				index, _ := peer.ParseHaveMessage(msg.Payload)
+				if choked {
+					waiting = append(waiting, index)
+					continue
+				}
+				conn.Write(peer.NewRequestMessage(index, 0, MaxBlockSize).Serialize())
+			case peer.MsgPiece:
+				pieces <- msg
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, pieces
+}
+
+func TestUploadsVerifiedPiecesWhileDownloading(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(2 * pieceLength)
+	tor := newTestTorrent(data, pieceLength)
+
+	// Piece 1 arrives late, so the leecher can only be served piece 0 at first
+	seeder := newTestSeeder(t, data, pieceLength, tor.InfoHash)
+	seeder.pieceDelay = map[int]time.Duration{1: time.Second}
+	seeder.start()
+	leecher, pieces := serveTestLeecher(t, tor.InfoHash, len(tor.PieceHashes))
+	tor.Peers = []torrent.Peer{seeder.addr(), leecher}
+
+	go tor.Download()
+
+	select {
+	case msg := <-pieces:
+		index, block, err := peer.ParsePieceMessage(0, msg.Payload)
+		if err != nil {
+			t.Fatalf("Expected the first upload to be piece 0: %v", err)
+		}
+		if index != 0 || !bytes.Equal(block, data[:MaxBlockSize]) {
+			t.Error("Uploaded block does not match")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Leecher was not served")
+	}
+}
+
+func TestStoppingSeedDisconnectsRateLimitedPeers(t *testing.T) {
+	data := newTestData(40 * MaxBlockSize)
+	seeder, leecher := newTestSeedTorrent(t, data, MaxBlockSize, mse.Disabled)
+	seeder.SetRateLimit(0, 2*MaxBlockSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded := make(chan error, 1)
+	go func() { seeded <- seeder.Seed(ctx, SeedLimits{}) }()
+	leecherCtx, stopLeecher := context.WithCancel(context.Background())
+	defer stopLeecher()
+	go leecher.DownloadContext(leecherCtx)
+
+	// Wait until blocks are queued behind the rate limit
+	waitForPeers(t, seeder, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for seeder.uploaded.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-seeded
+
+	waitForPeers(t, seeder, 0)
+	uploaded := seeder.uploaded.Load()
+	time.Sleep(time.Second)
+	if more := seeder.uploaded.Load() - uploaded; more > 0 {
+		t.Errorf("Expected no uploads after stopping, got %d bytes", more)
+	}
+}
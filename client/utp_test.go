@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"torrent-client/mse"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+	"torrent-client/utp"
+)
+
+func newTestUTPSocket(t *testing.T) *utp.Socket {
+	s, err := utp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestUTPDownload(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	seeder := newTestTorrent(data, MaxBlockSize)
+	if _, err := seeder.LoadData(writeTestData(t, seeder.Name, data)); err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	l := newEncryptedTestListener(t, mse.Preferred, seeder)
+	s := newTestUTPSocket(t)
+	go l.ServeUTP(s)
+
+	leecher := newTestTorrent(data, MaxBlockSize)
+	copy(leecher.PeerID[:], "-TC0001-testclient01")
+	leecher.UTP = newTestUTPSocket(t)
+	leecher.Transport = utp.UTPOnly
+	leecher.Encryption = mse.Preferred
+	addr := s.Addr().(*net.UDPAddr)
+	leecher.Peers = []torrent.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}
+
+	buf, err := leecher.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+}
+
+func TestPexFlagsUTP(t *testing.T) {
+	a := newTestUTPSocket(t)
+	b := newTestUTPSocket(t)
+	conn, err := a.Dial(b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	tor := newTestTorrent(newTestData(MaxBlockSize), MaxBlockSize)
+	hs := peer.NewHandshake(tor.InfoHash, [20]byte{1})
+	c, err := peer.Accept(conn, hs, tor.PeerID, nil)
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	c.Extended = &peer.ExtendedHandshake{P: 6881}
+	c.Bitfield = make(peer.Bitfield, 1)
+
+	state := &peerState{torrent: tor, client: c}
+	p := state.pexInfo()
+	if p == nil || p.flags&pexUTP == 0 {
+		t.Errorf("Expected the uTP flag for a uTP connection, got %+v", p)
+	}
+}
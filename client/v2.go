@@ -0,0 +1,257 @@
+package client
+
+import (
+	"crypto/sha256"
+	"log"
+
+	"torrent-client/merkle"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+)
+
+// NumPieces returns the number of pieces of the torrent.
+func (t *Torrent) NumPieces() int {
+	return max(len(t.PieceHashes), len(t.PiecesV2))
+}
+
+// infoHashes returns the infohashes of the swarms the torrent joins: that
+// of the v2 swarm follows InfoHash for hybrid torrents.
+func (t *Torrent) infoHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	if len(t.PieceHashes) > 0 && len(t.PiecesV2) > 0 {
+		var v2 [20]byte
+		copy(v2[:], t.InfoHashV2[:])
+		hashes = append(hashes, v2)
+	}
+	return hashes
+}
+
+// announceSwarms announces to the tracker for every swarm of the torrent.
+// It returns the response for InfoHash and the peers of the v2 swarm of a
+// hybrid torrent.
+func (t *Torrent) announceSwarms(c *torrent.TrackerClient, a torrent.Announce) (*torrent.TrackerResponse, []torrent.Peer, error) {
+	resp, err := c.Announce(t.file, t.PeerID, t.listenPort(), a)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := t.infoHashes()
+	if len(hashes) < 2 {
+		return resp, nil, nil
+	}
+	file := *t.file
+	file.InfoHash = hashes[1]
+	v2, err := c.Announce(&file, t.PeerID, t.listenPort(), a)
+	if err != nil {
+		log.Printf("Announce of the v2 swarm failed: %v", err)
+		return resp, nil, nil
+	}
+	return resp, v2.Peers, nil
+}
+
+// verifyV2 reports whether buf matches the merkle tree of a v2 piece. The
+// padding after the data of the piece must be zero.
+func verifyV2(p torrent.PieceV2, buf []byte) bool {
+	if len(buf) < p.Length || !isZero(buf[p.Length:]) {
+		return false
+	}
+	return merkle.Root(merkle.BlockHashes(buf[:p.Length]), 0, p.Leaves) == p.Hash
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// filePieces returns the first piece of the file with the given pieces root
+// and its number of pieces.
+func (t *Torrent) filePieces(root [32]byte) (int, int, bool) {
+	first, n := -1, 0
+	for index, p := range t.PiecesV2 {
+		if p.Root == root {
+			if first < 0 {
+				first = index
+			}
+			n++
+		}
+	}
+	return first, n, first >= 0
+}
+
+// pieceLayer returns the layer of the merkle trees whose nodes cover a
+// piece.
+func (t *Torrent) pieceLayer() int {
+	return merkle.Log2(t.PieceLength / merkle.BlockSize)
+}
+
+// hashes answers a hash request from a peer. Nodes at or above the piece
+// layer come from the metadata. Nodes below it are computed from the data
+// of a piece we have, so the request must not span pieces.
+func (t *Torrent) hashes(req peer.HashRequest) ([][32]byte, bool) {
+	first, n, ok := t.filePieces(req.PiecesRoot)
+	if !ok || req.Length < 1 || req.BaseLayer < 0 || req.BaseLayer > 32 {
+		return nil, false
+	}
+	// The tree of the pieces of files larger than a piece
+	var upper *merkle.Tree
+	if n > 1 {
+		layer := make([][32]byte, n)
+		for i := range layer {
+			layer[i] = t.PiecesV2[first+i].Hash
+		}
+		upper = merkle.NewTree(layer, t.pieceLayer(), merkle.Width(n))
+		if req.BaseLayer >= t.pieceLayer() {
+			return upper.Hashes(req.BaseLayer, req.Index, req.Length, req.ProofLayers)
+		}
+	}
+
+	// The span must lie within the subtree of one piece
+	p := t.PiecesV2[first]
+	leaves := req.Index << req.BaseLayer
+	i := leaves / p.Leaves
+	if i >= n || req.BaseLayer >= 31 || (req.Length<<req.BaseLayer) > p.Leaves {
+		return nil, false
+	}
+	index := first + i
+	if !t.store.has(index) {
+		return nil, false
+	}
+	p = t.PiecesV2[index]
+	begin, _ := t.calculateBoundsForPiece(index)
+	data, err := t.store.read(begin, p.Length)
+	if err != nil {
+		return nil, false
+	}
+	sub := merkle.NewTree(merkle.BlockHashes(data), 0, p.Leaves)
+	hashes, ok := sub.Hashes(req.BaseLayer, req.Index-i*(p.Leaves>>req.BaseLayer), req.Length, req.ProofLayers)
+	if !ok {
+		return nil, false
+	}
+	// Uncles above the piece come from the tree of the pieces
+	if more := req.ProofLayers - (len(hashes) - req.Length); more > 0 && upper != nil {
+		proof, _ := upper.Hashes(t.pieceLayer(), i, 1, more)
+		hashes = append(hashes, proof[1:]...)
+	}
+	return hashes, true
+}
+
+// requestBlockHashes asks a peer for the hashes of the blocks of a v2 piece
+// that failed its check, so the blocks can be verified one by one and only
+// the peers that sent bad ones are blamed.
+func (t *Torrent) requestBlockHashes(index int) {
+	if index >= len(t.PiecesV2) {
+		return
+	}
+	t.hashMu.Lock()
+	if t.blockHashes[index] != nil || t.hashRequested[index] {
+		t.hashMu.Unlock()
+		return
+	}
+	t.hashMu.Unlock()
+
+	p := t.PiecesV2[index]
+	req := peer.HashRequest{PiecesRoot: p.Root, Index: p.Index * p.Leaves, Length: p.Leaves}
+	for _, c := range t.tracker.connected() {
+		if !c.SupportsV2() || !c.Bitfield.HasPiece(index) {
+			continue
+		}
+		if err := c.SendHashRequest(req); err == nil {
+			t.hashMu.Lock()
+			if t.hashRequested == nil {
+				t.hashRequested = make(map[int]bool)
+			}
+			t.hashRequested[index] = true
+			t.hashMu.Unlock()
+			return
+		}
+	}
+}
+
+// addBlockHashes stores the block hashes a peer sent for a piece if they
+// lead up to the piece's hash.
+func (t *Torrent) addBlockHashes(req peer.HashRequest, hashes [][32]byte) {
+	first, _, ok := t.filePieces(req.PiecesRoot)
+	if !ok || req.BaseLayer != 0 || len(hashes) < req.Length {
+		return
+	}
+	p := t.PiecesV2[first]
+	if req.Length != p.Leaves || req.Index%p.Leaves != 0 {
+		return
+	}
+	index := first + req.Index/p.Leaves
+	if index >= len(t.PiecesV2) || t.PiecesV2[index].Root != req.PiecesRoot {
+		return
+	}
+	hashes = hashes[:req.Length]
+	if merkle.Root(hashes, 0, req.Length) != t.PiecesV2[index].Hash {
+		log.Printf("Block hashes for piece #%d do not match its hash", index)
+		return
+	}
+
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	if t.blockHashes == nil {
+		t.blockHashes = make(map[int][][32]byte)
+	}
+	t.blockHashes[index] = hashes
+	delete(t.hashRequested, index)
+}
+
+// verifyBlock checks a block against its hash, if the block hashes of its
+// piece are known.
+func (t *Torrent) verifyBlock(index, begin int, block []byte) bool {
+	t.hashMu.Lock()
+	hashes := t.blockHashes[index]
+	t.hashMu.Unlock()
+	if hashes == nil || begin%merkle.BlockSize != 0 {
+		return true
+	}
+	p := t.PiecesV2[index]
+	data := block[:max(0, min(len(block), p.Length-begin))]
+	if !isZero(block[len(data):]) {
+		return false
+	}
+	if len(data) == 0 {
+		return true
+	}
+	leaf := begin / merkle.BlockSize
+	return leaf < len(hashes) && sha256.Sum256(data) == hashes[leaf]
+}
+
+// handleHashMessage processes the hash messages of BitTorrent v2.
+func (state *peerState) handleHashMessage(msg *peer.Message) error {
+	c := state.client
+	switch msg.ID {
+	case peer.MsgHashRequest:
+		req, err := peer.ParseHashRequest(msg.Payload)
+		if err != nil {
+			return err
+		}
+		if hashes, ok := state.torrent.hashes(req); ok {
+			return c.SendHashes(req, hashes)
+		}
+		return c.SendHashReject(req)
+	case peer.MsgHashes:
+		req, hashes, err := peer.ParseHashes(msg.Payload)
+		if err != nil {
+			return err
+		}
+		state.torrent.addBlockHashes(req, hashes)
+	case peer.MsgHashReject:
+		req, err := peer.ParseHashRequest(msg.Payload)
+		if err != nil {
+			return err
+		}
+		first, _, ok := state.torrent.filePieces(req.PiecesRoot)
+		if ok && req.Length > 0 {
+			index := first + (req.Index<<req.BaseLayer)/state.torrent.PiecesV2[first].Leaves
+			state.torrent.hashMu.Lock()
+			delete(state.torrent.hashRequested, index)
+			state.torrent.hashMu.Unlock()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"torrent-client/merkle"
+	"torrent-client/peer"
+	"torrent-client/torrent"
+	"torrent-client/torrent/torrenttest"
+)
+
+// newTestV2Files returns files of a torrent that span several pieces, are
+// shorter than a piece and do not end on a block boundary.
+func newTestV2Files() []torrenttest.File {
+	return []torrenttest.File{
+		{Path: []string{"a.bin"}, Data: newTestData(5*MaxBlockSize + 100)},
+		{Path: []string{"sub", "b.bin"}, Data: newTestData(3000)},
+		{Path: []string{"sub", "c.bin"}, Data: newTestData(2 * MaxBlockSize)},
+	}
+}
+
+// loadTestV2Torrent builds a torrent of the given version and loads it.
+func loadTestV2Torrent(t *testing.T, files []torrenttest.File, pieceLength, version int) *Torrent {
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, torrenttest.Build("test", pieceLength, files, version), 0644); err != nil {
+		t.Fatalf("Failed to write torrent: %v", err)
+	}
+	tor, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	return tor
+}
+
+// newTestV2Seeder loads the content of files into a torrent and serves it
+// from a listener.
+func newTestV2Seeder(t *testing.T, files []torrenttest.File, pieceLength, version int) (*Torrent, *Listener) {
+	seeder := loadTestV2Torrent(t, files, pieceLength, version)
+	dir := t.TempDir()
+	for _, f := range files {
+		path := filepath.Join(append([]string{dir, seeder.Name}, f.Path...)...)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll failed: %v", err)
+		}
+		if err := os.WriteFile(path, f.Data, 0644); err != nil {
+			t.Fatalf("Failed to write data: %v", err)
+		}
+	}
+	verified, err := seeder.LoadData(dir)
+	if err != nil {
+		t.Fatalf("LoadData failed: %v", err)
+	}
+	if verified != seeder.NumPieces() {
+		t.Fatalf("Expected %d verified pieces, got %d", seeder.NumPieces(), verified)
+	}
+	return seeder, newTestListener(t, seeder)
+}
+
+func listenerPeer(l *Listener) torrent.Peer {
+	addr := l.Addr().(*net.TCPAddr)
+	return torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// checkTestV2Files downloads the content of tor and checks its files.
+func checkTestV2Files(t *testing.T, tor *Torrent, files []torrenttest.File) {
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	dir := t.TempDir()
+	if err := tor.writeFiles(dir, buf); err != nil {
+		t.Fatalf("writeFiles failed: %v", err)
+	}
+	for _, f := range files {
+		got, err := os.ReadFile(filepath.Join(append([]string{dir}, f.Path...)...))
+		if err != nil {
+			t.Fatalf("Failed to read file: %v", err)
+		}
+		if !bytes.Equal(got, f.Data) {
+			t.Errorf("File %v does not match", f.Path)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".pad")); !os.IsNotExist(err) {
+		t.Error("Expected padding files not to be written")
+	}
+}
+
+func TestV2Download(t *testing.T) {
+	files := newTestV2Files()
+	seeder, l := newTestV2Seeder(t, files, 2*MaxBlockSize, torrenttest.V2)
+	if len(seeder.PieceHashes) != 0 {
+		t.Fatal("Expected a v2-only torrent")
+	}
+
+	leecher := loadTestV2Torrent(t, files, 2*MaxBlockSize, torrenttest.V2)
+	leecher.Peers = []torrent.Peer{listenerPeer(l)}
+	checkTestV2Files(t, leecher, files)
+}
+
+func TestHybridDownloadFromV2Swarm(t *testing.T) {
+	files := newTestV2Files()
+	_, l := newTestV2Seeder(t, files, 2*MaxBlockSize, torrenttest.Hybrid)
+
+	leecher := loadTestV2Torrent(t, files, 2*MaxBlockSize, torrenttest.Hybrid)
+	hashes := leecher.infoHashes()
+	if len(hashes) != 2 || hashes[0] != leecher.InfoHash || !bytes.Equal(hashes[1][:], leecher.InfoHashV2[:20]) {
+		t.Fatalf("Expected the v1 and truncated v2 infohashes, got %x", hashes)
+	}
+	// Only a peer of the v2 swarm is known
+	leecher.peersV2 = []torrent.Peer{listenerPeer(l)}
+	checkTestV2Files(t, leecher, files)
+}
+
+func TestServeV2Hashes(t *testing.T) {
+	files := newTestV2Files()
+	pieceLength := 2 * MaxBlockSize
+	seeder, _ := newTestV2Seeder(t, files, pieceLength, torrenttest.V2)
+	root, _ := torrenttest.Hashes(files[0].Data, pieceLength)
+
+	tests := []struct {
+		name string
+		req  peer.HashRequest
+	}{
+		{"piece layer", peer.HashRequest{BaseLayer: 1, Index: 0, Length: 4}},
+		{"piece layer with proof", peer.HashRequest{BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 1}},
+		{"blocks of a piece", peer.HashRequest{BaseLayer: 0, Index: 2, Length: 2, ProofLayers: 2}},
+		{"last piece", peer.HashRequest{BaseLayer: 0, Index: 4, Length: 2, ProofLayers: 2}},
+	}
+	for _, tt := range tests {
+		tt.req.PiecesRoot = root
+		hashes, ok := seeder.hashes(tt.req)
+		if !ok {
+			t.Errorf("%s: expected hashes", tt.name)
+			continue
+		}
+		if !merkle.Verify(hashes, tt.req.BaseLayer, tt.req.Index, tt.req.Length, root) {
+			t.Errorf("%s: hashes do not lead up to the pieces root", tt.name)
+		}
+	}
+
+	// Requests spanning pieces below the piece layer are rejected
+	if _, ok := seeder.hashes(peer.HashRequest{PiecesRoot: root, Index: 0, Length: 4}); ok {
+		t.Error("Expected a request spanning pieces to be rejected")
+	}
+	if _, ok := seeder.hashes(peer.HashRequest{PiecesRoot: [32]byte{1}, Length: 1}); ok {
+		t.Error("Expected a request for an unknown file to be rejected")
+	}
+}
+
+func TestV2BlockHashesFindBadBlock(t *testing.T) {
+	files := newTestV2Files()
+	tor := loadTestV2Torrent(t, files, 2*MaxBlockSize, torrenttest.V2)
+	p := tor.PiecesV2[1]
+	data := files[0].Data[2*MaxBlockSize : 4*MaxBlockSize]
+	leaves := merkle.BlockHashes(data)
+	req := peer.HashRequest{PiecesRoot: p.Root, Index: p.Index * p.Leaves, Length: p.Leaves}
+
+	// Hashes that do not match the piece are ignored
+	wrong := [][32]byte{leaves[0], {}}
+	tor.addBlockHashes(req, wrong)
+	if !tor.verifyBlock(1, 0, make([]byte, MaxBlockSize)) {
+		t.Error("Expected blocks to pass before their hashes are known")
+	}
+
+	tor.addBlockHashes(req, leaves)
+	if !tor.verifyBlock(1, MaxBlockSize, data[MaxBlockSize:]) {
+		t.Error("Expected the block to match its hash")
+	}
+	bad := append([]byte(nil), data[:MaxBlockSize]...)
+	bad[10]++
+	if tor.verifyBlock(1, 0, bad) {
+		t.Error("Expected the corrupt block to be found")
+	}
+	if !tor.verifyBlock(1, 0, data[:MaxBlockSize]) {
+		t.Error("Expected the first block to match its hash")
+	}
+}
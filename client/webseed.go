@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"torrent-client/ratelimit"
+)
+
+const (
+	// How long a single request to a web seed may take.
+	webSeedTimeout = 60 * time.Second
+	// Number of blocks fetched from a web seed per round.
+	webSeedBlocks = 32
+	// Delay before retrying a web seed after a failure, doubled on every
+	// further failure up to webSeedMaxRetry.
+	webSeedRetry    = time.Second
+	webSeedMaxRetry = 5 * time.Minute
+)
+
+// errNoRanges is returned for a web seed that ignores range requests.
+// Skipping to every offset in the whole file would cost too much, so the
+// seed is not used any more.
+var errNoRanges = errors.New("web seed does not support range requests")
+
+// webSeed downloads blocks from an HTTP server holding the content
+// (BEP 19), or from an HTTP seed that serves pieces by index (BEP 17). The
+// piece tracker schedules it like a peer that has every piece.
+type webSeed struct {
+	url      string
+	torrent  *Torrent
+	client   *http.Client
+	httpSeed bool
+	ctx      context.Context // cancelled when the run stops
+}
+
+func (ws *webSeed) String() string {
+	return ws.url
+}
+
+// httpClient returns the client for web seeds, which goes through the proxy
+// if there is one.
+func (t *Torrent) httpClient(timeout time.Duration) (*http.Client, error) {
+	if t.Proxy != nil {
+		return t.Proxy.HTTPClient(timeout), nil
+	}
+	if t.ProxyOnly {
+		return nil, errNoProxy
+	}
+	return &http.Client{Timeout: timeout}, nil
+}
+
+// runWebSeeds downloads from every web seed and HTTP seed of the torrent
+// until the download completes.
+func (t *Torrent) runWebSeeds() {
+	if len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 {
+		return
+	}
+	client, err := t.httpClient(webSeedTimeout)
+	if err != nil {
+		log.Printf("Not using web seeds: %v", err)
+		return
+	}
+	for _, u := range t.WebSeeds {
+		go (&webSeed{url: u, torrent: t, client: client}).run()
+	}
+	for _, u := range t.HTTPSeeds {
+		go (&webSeed{url: u, torrent: t, client: client, httpSeed: true}).run()
+	}
+}
+
+func (ws *webSeed) run() {
+	pt := ws.torrent.tracker
+	done := pt.stopped()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	ws.ctx = ctx
+
+	retry := webSeedRetry
+	for !pt.banned(ws) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		wake := pt.wait()
+		var reqs []blockRequest
+		for len(reqs) < webSeedBlocks {
+			req, ok := pt.reserve(ws)
+			if !ok {
+				break
+			}
+			reqs = append(reqs, req)
+		}
+		if len(reqs) == 0 {
+			select {
+			case <-wake:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		err := ws.fetch(reqs)
+		if err == nil {
+			retry = webSeedRetry
+			continue
+		}
+		pt.release(ws)
+		if errors.Is(err, errNoRanges) {
+			log.Printf("Stopped using web seed %s: %v", ws.url, err)
+			return
+		}
+		delay := retry
+		var busy *busyError
+		if errors.As(err, &busy) {
+			// The seed said when to come back
+			delay = min(busy.retryAfter, webSeedMaxRetry)
+		} else {
+			retry = min(2*retry, webSeedMaxRetry)
+		}
+		log.Printf("Web seed %s failed, retrying in %v: %v", ws.url, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return
+		}
+	}
+	log.Printf("Stopped using web seed %s after bad data", ws.url)
+}
+
+// fetch downloads the requested blocks, merging adjacent ones into a single
+// range, or into a single request per piece for HTTP seeds.
+func (ws *webSeed) fetch(reqs []blockRequest) error {
+	t := ws.torrent
+	offset := func(req blockRequest) int {
+		return req.index*t.PieceLength + req.begin
+	}
+	sort.Slice(reqs, func(i, j int) bool { return offset(reqs[i]) < offset(reqs[j]) })
+
+	for len(reqs) > 0 {
+		n := 1
+		length := reqs[0].length
+		for ; n < len(reqs); n++ {
+			if ws.httpSeed && reqs[n].index != reqs[0].index ||
+				!ws.httpSeed && offset(reqs[n]) != offset(reqs[0])+length {
+				break
+			}
+			length += reqs[n].length
+		}
+		var data []byte
+		var err error
+		if ws.httpSeed {
+			data, err = ws.getPiece(reqs[:n])
+		} else {
+			data, err = ws.get(offset(reqs[0]), length)
+		}
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs[:n] {
+			if err := t.receiveBlock(ws, req.index, req.begin, data[:req.length]); err != nil {
+				return err
+			}
+			data = data[req.length:]
+		}
+		reqs = reqs[n:]
+	}
+	return nil
+}
+
+// get downloads length bytes of content starting at off, with one request
+// per file they are stored in. Padding files are not requested.
+func (ws *webSeed) get(off, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	n := 0
+	for _, r := range ws.torrent.fileRanges(off, length) {
+		if len(ws.torrent.Files) > 0 && ws.torrent.Files[r.file].Padding {
+			n += r.length
+			continue
+		}
+		if err := ws.getRange(ws.fileURL(r.file), r.offset, buf[n:n+r.length]); err != nil {
+			return nil, err
+		}
+		n += r.length
+	}
+	return buf, nil
+}
+
+// getRange fills buf with the data of the file at u starting at off.
+func (ws *webSeed) getRange(u string, off int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ws.ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	t := ws.torrent
+	download, _ := t.sharedLimits()
+	body := io.Reader(&limitedReader{resp.Body, []*ratelimit.Limiter{&t.downloadLimit, download}})
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != off {
+			return fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server ignored the range and sends the whole file, which
+		// is only what we asked for if the range was all of it
+		if off != 0 || resp.ContentLength != int64(len(buf)) {
+			return errNoRanges
+		}
+	default:
+		return fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	_, err = io.ReadFull(body, buf)
+	return err
+}
+
+// fileURL returns the URL of file i. A URL ending in a slash is the
+// directory holding the content under the torrent's name, as it must be for
+// multi-file torrents.
+func (ws *webSeed) fileURL(i int) string {
+	t := ws.torrent
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(ws.url, "/") {
+			return ws.url + url.PathEscape(t.Name)
+		}
+		return ws.url
+	}
+	u := ws.url
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	u += url.PathEscape(t.Name)
+	for _, c := range t.Files[i].Path {
+		u += "/" + url.PathEscape(c)
+	}
+	return u
+}
+
+// limitedReader subjects reads to the given download limits.
+type limitedReader struct {
+	r      io.Reader
+	limits []*ratelimit.Limiter
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > MaxBlockSize {
+		p = p[:MaxBlockSize]
+	}
+	n, err := l.r.Read(p)
+	ratelimit.WaitAll(n, l.limits)
+	return n, err
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+// webSeedServer serves files by path and records the requested paths and
+// whether they asked for a range.
+type webSeedServer struct {
+	*httptest.Server
+	files map[string][]byte
+	fail  atomic.Int32 // number of requests still to fail
+
+	mu     sync.Mutex
+	paths  []string
+	ranged bool
+}
+
+func newWebSeedServer(t *testing.T, files map[string][]byte) *webSeedServer {
+	s := &webSeedServer{files: files}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.paths = append(s.paths, r.URL.Path)
+		s.ranged = s.ranged || r.Header.Get("Range") != ""
+		s.mu.Unlock()
+
+		if s.fail.Add(-1) >= 0 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		data, ok := s.files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webSeedServer) requested(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range s.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	pieceLength := 2 * MaxBlockSize
+	data := newTestData(5*pieceLength + 123)
+	tor := newTestTorrent(data, pieceLength)
+	server := newWebSeedServer(t, map[string][]byte{"/files/test": data})
+	tor.WebSeeds = []string{server.URL + "/files/"}
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	if !server.ranged {
+		t.Error("Expected the web seed to be asked for ranges")
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	pieceLength := MaxBlockSize
+	data := newTestData(3*pieceLength + 100)
+	tor := newTestMultiFileTorrent(data, pieceLength, 1000, pieceLength, 0, 2*pieceLength-900)
+	tor.Files[1].Path = []string{"dir", "with space"}
+	server := newWebSeedServer(t, map[string][]byte{
+		"/test/dir/a":          data[:1000],
+		"/test/dir/with space": data[1000 : 1000+pieceLength],
+		"/test/dir/c":          nil,
+		"/test/dir/d":          data[1000+pieceLength:],
+	})
+	tor.WebSeeds = []string{server.URL}
+
+	dir := t.TempDir()
+	if err := tor.DownloadToFile(dir); err != nil {
+		t.Fatalf("DownloadToFile failed: %v", err)
+	}
+	if !server.requested("/test/dir/with space") {
+		t.Error("Expected files to be requested below the torrent's name")
+	}
+
+	seeder := newTestMultiFileTorrent(data, pieceLength, 1000, pieceLength, 0, 2*pieceLength-900)
+	seeder.Files[1].Path = tor.Files[1].Path
+	if verified, err := seeder.LoadData(dir); err != nil || verified != 4 {
+		t.Errorf("Expected the written files to hold 4 verified pieces, got %d (%v)", verified, err)
+	}
+}
+
+func TestWebSeedRetriesAfterErrors(t *testing.T) {
+	data := newTestData(3 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	server := newWebSeedServer(t, map[string][]byte{"/test": data})
+	server.fail.Store(2)
+	tor.WebSeeds = []string{server.URL + "/test"}
+
+	done := make(chan []byte, 1)
+	go func() {
+		buf, _ := tor.Download()
+		done <- buf
+	}()
+	select {
+	case buf := <-done:
+		if !bytes.Equal(buf, data) {
+			t.Error("Downloaded data does not match")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Download did not recover from web seed errors")
+	}
+}
+
+func TestCorruptWebSeedIsBanned(t *testing.T) {
+	// Pieces of a single block are never blamed on the peer as well
+	data := newTestData(8 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	corrupt := bytes.Repeat([]byte{0xff}, len(data))
+	server := newWebSeedServer(t, map[string][]byte{"/test": corrupt})
+	tor.WebSeeds = []string{server.URL + "/test"}
+
+	// The web seed gets every piece before the peer connects
+	seeder := newTestSeeder(t, data, MaxBlockSize, tor.InfoHash)
+	seeder.connectDelay = 200 * time.Millisecond
+	seeder.start()
+	tor.Peers = []torrent.Peer{seeder.addr()}
+
+	buf, err := tor.Download()
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Downloaded data does not match")
+	}
+	pt := tor.tracker
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	banned := false
+	for c, strikes := range pt.strikes {
+		if _, ok := c.(*webSeed); ok {
+			banned = strikes >= maxHashFailures
+		}
+	}
+	if !banned {
+		t.Error("Expected the web seed to be banned")
+	}
+}
+
+func TestCancelledDownloadStopsWebSeeds(t *testing.T) {
+	data := newTestData(200 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	server := newWebSeedServer(t, map[string][]byte{"/test": data})
+	tor.WebSeeds = []string{server.URL + "/"}
+	// Every round of webSeedBlocks takes about two seconds
+	tor.SetRateLimit(webSeedBlocks*MaxBlockSize/2, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tor.DownloadContext(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !server.requested("/test") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	// The request in flight is abandoned and no more are made
+	time.Sleep(3 * time.Second)
+	if n := tor.store.count(); n > 0 {
+		t.Errorf("Expected no pieces after cancelling, got %d", n)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if n := len(server.paths); n != 1 {
+		t.Errorf("Expected 1 request, got %d", n)
+	}
+}
+
+func TestWebSeedIgnoringRangesIsDropped(t *testing.T) {
+	data := newTestData(4 * MaxBlockSize)
+	tor := newTestTorrent(data, MaxBlockSize)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(data)
+	}))
+	defer server.Close()
+	tor.WebSeeds = []string{server.URL}
+
+	// Pieces past the first are not at the start of the file
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tor.init()
+	tor.store.put(0, 0, data[:MaxBlockSize])
+	tor.tracker.complete(0)
+	if _, err := tor.DownloadContext(ctx); err == nil {
+		t.Fatal("Expected the download not to complete")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("Expected the web seed to be dropped after 1 request, got %d", n)
+	}
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"fmt"
+
+	"torrent-client/bencode"
+)
+
+// KRPC error codes.
+const (
+	errGeneric       = 201
+	errServer        = 202
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// message is a KRPC message: a query ("q"), a response ("r") or an error
+// ("e"), matched up by the transaction ID t.
+type message struct {
+	T string
+	Y string
+	Q string                 // query method
+	A map[string]interface{} // query arguments
+	R map[string]interface{} // response values
+	E []interface{}          // error code and message
+}
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Message)
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		dict["q"] = m.Q
+		dict["a"] = m.A
+	case "r":
+		dict["r"] = m.R
+	case "e":
+		dict["e"] = m.E
+	}
+	return bencode.Encode(dict)
+}
+
+func decodeMessage(buf []byte) (*message, error) {
+	decoded, err := bencode.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("KRPC message is not a dictionary")
+	}
+
+	m := &message{}
+	m.T, _ = dict["t"].(string)
+	m.Y, _ = dict["y"].(string)
+	if m.T == "" {
+		return nil, fmt.Errorf("KRPC message has no transaction ID")
+	}
+	switch m.Y {
+	case "q":
+		m.Q, _ = dict["q"].(string)
+		m.A, _ = dict["a"].(map[string]interface{})
+		if m.A == nil {
+			return nil, fmt.Errorf("query %q has no arguments", m.Q)
+		}
+	case "r":
+		m.R, _ = dict["r"].(map[string]interface{})
+		if m.R == nil {
+			return nil, fmt.Errorf("response has no values")
+		}
+	case "e":
+		m.E, _ = dict["e"].([]interface{})
+	default:
+		return nil, fmt.Errorf("unknown KRPC message type %q", m.Y)
+	}
+	return m, nil
+}
+
+// err returns the remote error carried by an "e" message.
+func (m *message) err() error {
+	e := &Error{Code: errGeneric}
+	if len(m.E) > 0 {
+		if code, ok := m.E[0].(int); ok {
+			e.Code = code
+		}
+	}
+	if len(m.E) > 1 {
+		e.Message, _ = m.E[1].(string)
+	}
+	return e
+}
+
+// nodeID reads a 20 byte ID from dict[key].
+func nodeID(dict map[string]interface{}, key string) (NodeID, bool) {
+	var id NodeID
+	s, ok := dict[key].(string)
+	if !ok || len(s) != len(id) {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+)
+
+// NodeID identifies a DHT node. Info hashes live in the same 160-bit space.
+type NodeID [20]byte
+
+func RandomID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// distance returns the XOR distance between two IDs.
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b NodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefixLen returns the number of leading bits a and b share.
+func commonPrefixLen(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
+
+// Node is a DHT node we know the address of.
+type Node struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%s@%s", n.ID.String()[:8], n.Addr)
+}
+
+// compactNodeLen is the length of a node in compact node info format: 20
+// bytes ID, the address and 2 bytes port.
+func compactNodeLen(ipLen int) int {
+	return 20 + ipLen + 2
+}
+
+// compactNodes encodes the nodes whose address has length ipLen in compact
+// node info format: IPv4 nodes for "nodes" and IPv6 nodes for "nodes6"
+// (BEP 32).
+func compactNodes(nodes []Node, ipLen int) []byte {
+	var buf []byte
+	for _, n := range nodes {
+		ip := n.Addr.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = n.Addr.IP.To16()
+		}
+		if len(ip) != ipLen {
+			continue
+		}
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.Addr.Port))
+	}
+	return buf
+}
+
+func parseCompactNodes(buf []byte, ipLen int) ([]Node, error) {
+	size := compactNodeLen(ipLen)
+	if len(buf)%size != 0 {
+		return nil, fmt.Errorf("invalid compact node info length %d", len(buf))
+	}
+	nodes := make([]Node, 0, len(buf)/size)
+	for i := 0; i < len(buf); i += size {
+		var n Node
+		copy(n.ID[:], buf[i:i+20])
+		ip := make(net.IP, ipLen)
+		copy(ip, buf[i+20:i+20+ipLen])
+		n.Addr = &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(buf[i+20+ipLen : i+size]))}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// nodeLists are the keys of compact node lists and the address length of
+// their nodes.
+var nodeLists = []struct {
+	key   string
+	ipLen int
+}{{"nodes", net.IPv4len}, {"nodes6", net.IPv6len}}
+
+// ipLen returns the length of addresses in ip's family.
+func ipLen(ip net.IP) int {
+	if ip.To4() != nil {
+		return net.IPv4len
+	}
+	return net.IPv6len
+}
@@ -0,0 +1,682 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"torrent-client/bencode"
+	"torrent-client/torrent"
+)
+
+// Well-known routers that hand out an initial set of nodes.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+const (
+	defaultQueryTimeout = 2 * time.Second
+	// Number of queries a lookup keeps in flight.
+	alpha = 3
+	// Tokens handed out in get_peers responses are accepted in
+	// announce_peer for one to two rotation periods.
+	tokenRotation = 5 * time.Minute
+	// Announced peers are forgotten after this long unless they announce
+	// again.
+	peerExpiry = 30 * time.Minute
+	// At most this many peers are returned for an info hash.
+	maxPeersReturned = 50
+	// At most this many peers are stored per info hash, and this many info
+	// hashes in total. Announces past either limit are dropped.
+	maxPeersPerInfoHash = 200
+	maxInfoHashes       = 1000
+	maintenanceInterval = time.Minute
+)
+
+type Config struct {
+	// ID is our node ID. A random ID is used if it is zero and none was
+	// saved in StateFile.
+	ID NodeID
+	// BootstrapNodes are the host:port addresses Bootstrap starts from.
+	BootstrapNodes []string
+	// StateFile, if set, is where our ID and routing table are loaded from
+	// on start and saved to periodically and on Close.
+	StateFile string
+	// QueryTimeout is how long to wait for an answer. Defaults to 2s.
+	QueryTimeout time.Duration
+}
+
+// Server is a node of the mainline DHT (BEP 5). It answers queries from
+// other nodes and finds and announces peers for info hashes.
+type Server struct {
+	ID NodeID
+
+	conn      net.PacketConn
+	table     *table
+	config    Config
+	mu        sync.Mutex
+	pending   map[string]pendingQuery // by transaction ID
+	nextTx    uint16
+	peers     map[NodeID]map[string]announcedPeer // by info hash, then address
+	secret    [8]byte
+	oldSecret [8]byte
+	rotated   time.Time
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// pendingQuery waits for the reply to a query sent to addr.
+type pendingQuery struct {
+	addr  *net.UDPAddr
+	reply chan *message
+}
+
+type announcedPeer struct {
+	addr torrent.Peer
+	seen time.Time
+}
+
+// Listen opens a UDP socket on addr, e.g. ":6881", and serves the DHT on it.
+func Listen(addr string, config Config) (*Server, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s, err := New(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// New serves the DHT on conn until Close is called.
+func New(conn net.PacketConn, config Config) (*Server, error) {
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = defaultQueryTimeout
+	}
+	s := &Server{
+		ID:      config.ID,
+		conn:    conn,
+		config:  config,
+		pending: make(map[string]pendingQuery),
+		peers:   make(map[NodeID]map[string]announcedPeer),
+		rotated: time.Now(),
+		done:    make(chan struct{}),
+	}
+	rand.Read(s.secret[:])
+	s.oldSecret = s.secret
+
+	var saved []Node
+	if config.StateFile != "" {
+		id, nodes, err := loadState(config.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if s.ID == (NodeID{}) {
+			s.ID = id
+		}
+		saved = nodes
+	}
+	if s.ID == (NodeID{}) {
+		s.ID = RandomID()
+	}
+
+	s.table = newTable(s.ID, time.Now())
+	for _, n := range saved {
+		s.table.seen(n, time.Time{})
+	}
+
+	go s.readLoop()
+	go s.maintain()
+	return s, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Nodes returns the nodes in the routing table.
+func (s *Server) Nodes() []Node {
+	return s.table.nodes()
+}
+
+// Close stops the server and saves its state if a state file is set.
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.config.StateFile != "" {
+			err = s.Save(s.config.StateFile)
+		}
+		if cerr := s.conn.Close(); err == nil {
+			err = cerr
+		}
+	})
+	return err
+}
+
+// Bootstrap fills the routing table by contacting the bootstrap nodes and
+// looking up our own ID.
+func (s *Server) Bootstrap() error {
+	var wg sync.WaitGroup
+	for _, addr := range s.config.BootstrapNodes {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			log.Printf("Skipping DHT bootstrap node %s: %v", addr, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Ping(udpAddr)
+		}()
+	}
+	wg.Wait()
+
+	s.FindNode(s.ID)
+	if s.table.len() == 0 {
+		return fmt.Errorf("no DHT nodes reachable")
+	}
+	return nil
+}
+
+// Ping asks the node at addr for its ID.
+func (s *Server) Ping(addr *net.UDPAddr) (NodeID, error) {
+	r, err := s.query(addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	id, _ := nodeID(r, "id")
+	return id, nil
+}
+
+// FindNode returns the K nodes closest to target that answered us.
+func (s *Server) FindNode(target NodeID) []Node {
+	nodes, _ := s.lookup(target, "find_node")
+	result := make([]Node, len(nodes))
+	for i, n := range nodes {
+		result[i] = n.Node
+	}
+	return result
+}
+
+// GetPeers returns the peers that announced themselves for infoHash.
+func (s *Server) GetPeers(infoHash [20]byte) []torrent.Peer {
+	_, peers := s.lookup(infoHash, "get_peers")
+	return peers
+}
+
+// Announce tells the nodes closest to infoHash that we accept peers on port,
+// and returns the peers found on the way.
+func (s *Server) Announce(infoHash [20]byte, port int) ([]torrent.Peer, error) {
+	nodes, peers := s.lookup(infoHash, "get_peers")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	announced := 0
+	for _, n := range nodes {
+		if n.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(n lookupNode) {
+			defer wg.Done()
+			_, err := s.query(n.Addr, "announce_peer", map[string]interface{}{
+				"info_hash": string(infoHash[:]),
+				"port":      port,
+				"token":     n.token,
+			})
+			if err == nil {
+				mu.Lock()
+				announced++
+				mu.Unlock()
+			}
+		}(n)
+	}
+	wg.Wait()
+	if announced == 0 {
+		return peers, fmt.Errorf("no DHT node accepted the announce")
+	}
+	return peers, nil
+}
+
+// lookupNode is a node that answered during a lookup, with the token it
+// handed out for get_peers.
+type lookupNode struct {
+	Node
+	token string
+}
+
+// lookup iteratively queries the nodes closest to target, alpha at a time,
+// until the K closest nodes that answered have all been queried. It returns
+// those nodes, and for get_peers the peers they know.
+func (s *Server) lookup(target NodeID, method string) ([]lookupNode, []torrent.Peer) {
+	type candidate struct {
+		node    Node
+		queried bool
+		failed  bool
+		token   string
+		replied bool
+	}
+	var mu sync.Mutex
+	candidates := make(map[NodeID]*candidate)
+	add := func(n Node) {
+		if _, ok := candidates[n.ID]; !ok && n.ID != s.ID {
+			candidates[n.ID] = &candidate{node: n}
+		}
+	}
+	for _, n := range s.table.closest(target, K) {
+		add(n)
+	}
+
+	seenPeers := make(map[string]bool)
+	var peers []torrent.Peer
+
+	args := map[string]interface{}{}
+	switch method {
+	case "find_node":
+		args["target"] = string(target[:])
+	case "get_peers":
+		args["info_hash"] = string(target[:])
+	}
+
+	for {
+		mu.Lock()
+		var sorted []*candidate
+		for _, c := range candidates {
+			if !c.failed {
+				sorted = append(sorted, c)
+			}
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return closer(target, sorted[i].node.ID, sorted[j].node.ID)
+		})
+		if len(sorted) > K {
+			sorted = sorted[:K]
+		}
+		var next []*candidate
+		for _, c := range sorted {
+			if !c.queried && len(next) < alpha {
+				c.queried = true
+				next = append(next, c)
+			}
+		}
+		mu.Unlock()
+		if len(next) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range next {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				r, err := s.query(c.node.Addr, method, args)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					c.failed = true
+					return
+				}
+				c.replied = true
+				c.token, _ = r["token"].(string)
+				for _, list := range nodeLists {
+					if buf, ok := r[list.key].(string); ok {
+						nodes, _ := parseCompactNodes([]byte(buf), list.ipLen)
+						for _, n := range nodes {
+							add(n)
+						}
+					}
+				}
+				values, _ := r["values"].([]interface{})
+				for _, v := range values {
+					// Each value is one peer, IPv4 or IPv6
+					buf, _ := v.(string)
+					if len(buf) != net.IPv4len+2 && len(buf) != net.IPv6len+2 {
+						continue
+					}
+					found, err := torrent.ParseCompactPeers([]byte(buf), len(buf)-2)
+					if err != nil {
+						continue
+					}
+					for _, p := range found {
+						if !seenPeers[p.String()] {
+							seenPeers[p.String()] = true
+							peers = append(peers, p)
+						}
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	var result []lookupNode
+	for _, c := range candidates {
+		if c.replied {
+			result = append(result, lookupNode{c.node, c.token})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return closer(target, result[i].ID, result[j].ID)
+	})
+	if len(result) > K {
+		result = result[:K]
+	}
+	return result, peers
+}
+
+// query sends a query to addr and waits for the response values.
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	a := map[string]interface{}{"id": string(s.ID[:])}
+	for k, v := range args {
+		a[k] = v
+	}
+
+	s.mu.Lock()
+	s.nextTx++
+	tx := string(binary.BigEndian.AppendUint16(nil, s.nextTx))
+	reply := make(chan *message, 1)
+	s.pending[tx] = pendingQuery{addr, reply}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, tx)
+		s.mu.Unlock()
+	}()
+
+	if err := s.send(addr, &message{T: tx, Y: "q", Q: method, A: a}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case m := <-reply:
+		if m.Y == "e" {
+			return nil, m.err()
+		}
+		id, ok := nodeID(m.R, "id")
+		if !ok {
+			return nil, fmt.Errorf("response from %s has no node ID", addr)
+		}
+		s.table.seen(Node{id, addr}, time.Now())
+		return m.R, nil
+	case <-time.After(s.config.QueryTimeout):
+		for _, n := range s.table.nodes() {
+			if n.Addr.String() == addr.String() {
+				s.table.failed(n.ID)
+			}
+		}
+		return nil, fmt.Errorf("%s query to %s timed out", method, addr)
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Server) send(addr net.Addr, m *message) error {
+	buf, err := m.encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(buf, addr)
+	return err
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		m, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		if m.Y == "q" {
+			s.handleQuery(udpAddr, m)
+			continue
+		}
+		// Replies from anywhere but the queried node are ignored, so a
+		// guessed transaction ID is not enough to inject one
+		s.mu.Lock()
+		q, ok := s.pending[m.T]
+		s.mu.Unlock()
+		if ok && q.addr.IP.Equal(udpAddr.IP) && q.addr.Port == udpAddr.Port {
+			select {
+			case q.reply <- m:
+			default:
+			}
+		}
+	}
+}
+
+func (s *Server) handleQuery(addr *net.UDPAddr, m *message) {
+	id, ok := nodeID(m.A, "id")
+	if !ok {
+		s.sendError(addr, m.T, errProtocol, "missing node ID")
+		return
+	}
+
+	// Nodes and peers are returned in the requester's address family
+	family := ipLen(addr.IP)
+	nodesKey := "nodes"
+	if family == net.IPv6len {
+		nodesKey = "nodes6"
+	}
+
+	r := map[string]interface{}{"id": string(s.ID[:])}
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, ok := nodeID(m.A, "target")
+		if !ok {
+			s.sendError(addr, m.T, errProtocol, "missing target")
+			return
+		}
+		r[nodesKey] = compactNodes(s.table.closest(target, K), family)
+	case "get_peers":
+		infoHash, ok := nodeID(m.A, "info_hash")
+		if !ok {
+			s.sendError(addr, m.T, errProtocol, "missing info_hash")
+			return
+		}
+		r["token"] = s.token(addr.IP, s.secret)
+		if values := s.announced(infoHash, family); len(values) > 0 {
+			r["values"] = values
+		} else {
+			r[nodesKey] = compactNodes(s.table.closest(infoHash, K), family)
+		}
+	case "announce_peer":
+		infoHash, ok := nodeID(m.A, "info_hash")
+		port, _ := m.A["port"].(int)
+		token, _ := m.A["token"].(string)
+		if !ok {
+			s.sendError(addr, m.T, errProtocol, "missing info_hash")
+			return
+		}
+		if !s.validToken(addr.IP, token) {
+			s.sendError(addr, m.T, errProtocol, "bad token")
+			return
+		}
+		if implied, _ := m.A["implied_port"].(int); implied == 1 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			s.sendError(addr, m.T, errProtocol, "invalid port")
+			return
+		}
+		s.addPeer(infoHash, torrent.Peer{IP: addr.IP, Port: uint16(port)})
+	default:
+		s.sendError(addr, m.T, errMethodUnknown, "method unknown")
+		return
+	}
+
+	s.table.seen(Node{id, addr}, time.Now())
+	s.send(addr, &message{T: m.T, Y: "r", R: r})
+}
+
+func (s *Server) sendError(addr *net.UDPAddr, tx string, code int, msg string) {
+	s.send(addr, &message{T: tx, Y: "e", E: []interface{}{code, msg}})
+}
+
+// token proves to us in announce_peer that the sender asked get_peers from
+// the same IP recently.
+func (s *Server) token(ip net.IP, secret [8]byte) string {
+	h := sha1.New()
+	h.Write(ip.To16())
+	h.Write(secret[:])
+	return string(h.Sum(nil)[:8])
+}
+
+func (s *Server) validToken(ip net.IP, token string) bool {
+	s.mu.Lock()
+	secret, oldSecret := s.secret, s.oldSecret
+	s.mu.Unlock()
+	return token == s.token(ip, secret) || token == s.token(ip, oldSecret)
+}
+
+func (s *Server) addPeer(infoHash NodeID, p torrent.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := s.peers[infoHash]
+	if peers == nil {
+		if len(s.peers) >= maxInfoHashes {
+			return
+		}
+		peers = make(map[string]announcedPeer)
+		s.peers[infoHash] = peers
+	}
+	key := p.String()
+	if _, ok := peers[key]; !ok && len(peers) >= maxPeersPerInfoHash {
+		return
+	}
+	peers[key] = announcedPeer{p, time.Now()}
+}
+
+// announced returns the peers known for infoHash whose address has length
+// ipLen, in compact format.
+func (s *Server) announced(infoHash NodeID, ipLen int) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []interface{}
+	for _, p := range s.peers[infoHash] {
+		if len(values) == maxPeersReturned {
+			break
+		}
+		if buf := torrent.CompactPeers([]torrent.Peer{p.addr}, ipLen); len(buf) > 0 {
+			values = append(values, buf)
+		}
+	}
+	return values
+}
+
+// maintain rotates the token secret, expires announced peers, refreshes
+// stale buckets and saves the state until the server is closed.
+func (s *Server) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.expire(now)
+			for _, target := range s.table.stale(now) {
+				go s.FindNode(target)
+			}
+			if s.config.StateFile != "" {
+				if err := s.Save(s.config.StateFile); err != nil {
+					log.Printf("Failed to save DHT state: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.rotated) >= tokenRotation {
+		s.oldSecret = s.secret
+		rand.Read(s.secret[:])
+		s.rotated = now
+	}
+	for infoHash, peers := range s.peers {
+		for key, p := range peers {
+			if now.Sub(p.seen) > peerExpiry {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+// Save writes our ID and routing table to path.
+func (s *Server) Save(path string) error {
+	buf, err := bencode.Encode(map[string]interface{}{
+		"id":     string(s.ID[:]),
+		"nodes":  compactNodes(s.table.nodes(), net.IPv4len),
+		"nodes6": compactNodes(s.table.nodes(), net.IPv6len),
+	})
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadState(path string) (NodeID, []Node, error) {
+	var id NodeID
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return id, nil, err
+	}
+	decoded, err := bencode.Decode(buf)
+	if err != nil {
+		return id, nil, fmt.Errorf("invalid DHT state in %s: %w", path, err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return id, nil, fmt.Errorf("invalid DHT state in %s", path)
+	}
+	id, _ = nodeID(dict, "id")
+	var nodes []Node
+	for _, list := range nodeLists {
+		buf, _ := dict[list.key].(string)
+		parsed, err := parseCompactNodes([]byte(buf), list.ipLen)
+		if err != nil {
+			return id, nil, fmt.Errorf("invalid DHT state in %s: %w", path, err)
+		}
+		nodes = append(nodes, parsed...)
+	}
+	return id, nodes, nil
+}
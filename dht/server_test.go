@@ -0,0 +1,282 @@
+package dht
+
+import (
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+func newTestServer(t *testing.T, config Config) *Server {
+	t.Helper()
+	return newTestServerOn(t, "127.0.0.1:0", config)
+}
+
+func newTestServerOn(t *testing.T, addr string, config Config) *Server {
+	t.Helper()
+	if config.QueryTimeout == 0 {
+		config.QueryTimeout = 500 * time.Millisecond
+	}
+	s, err := Listen(addr, config)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestNetwork starts n nodes that each bootstrap from the first one.
+func newTestNetwork(t *testing.T, n int) []*Server {
+	t.Helper()
+	root := newTestServer(t, Config{})
+	servers := []*Server{root}
+	for i := 1; i < n; i++ {
+		s := newTestServer(t, Config{BootstrapNodes: []string{root.Addr().String()}})
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap failed: %v", err)
+		}
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func TestPing(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+
+	id, err := a.Ping(b.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if id != b.ID {
+		t.Errorf("Expected ID %s, got %s", b.ID, id)
+	}
+	if len(a.Nodes()) != 1 || len(b.Nodes()) != 1 {
+		t.Errorf("Expected both nodes to learn about each other, got %d and %d", len(a.Nodes()), len(b.Nodes()))
+	}
+}
+
+func TestBootstrapWithoutNodesFails(t *testing.T) {
+	s := newTestServer(t, Config{BootstrapNodes: []string{"127.0.0.1:1"}, QueryTimeout: 100 * time.Millisecond})
+	if err := s.Bootstrap(); err == nil {
+		t.Error("Expected Bootstrap to fail without reachable nodes")
+	}
+}
+
+func TestFindNode(t *testing.T) {
+	servers := newTestNetwork(t, 6)
+	last := servers[len(servers)-1]
+
+	// The last node only knows what it learned while bootstrapping, yet
+	// finds every other node in the network.
+	target := servers[1].ID
+	found := last.FindNode(target)
+	if len(found) != len(servers)-1 {
+		t.Fatalf("Expected %d nodes, got %d", len(servers)-1, len(found))
+	}
+	if found[0].ID != target {
+		t.Errorf("Expected the closest node to be %s, got %s", target, found[0].ID)
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	servers := newTestNetwork(t, 5)
+	var infoHash [20]byte
+	copy(infoHash[:], "dht-test-info-hash-0")
+
+	if _, err := servers[1].Announce(infoHash, 6881); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+
+	peers := servers[4].GetPeers(infoHash)
+	if len(peers) != 1 {
+		t.Fatalf("Expected 1 peer, got %d", len(peers))
+	}
+	want := torrent.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	if peers[0].String() != want.String() {
+		t.Errorf("Expected peer %s, got %s", want, peers[0])
+	}
+}
+
+func TestAnnounceAndGetPeersIPv6(t *testing.T) {
+	if ln, err := net.ListenPacket("udp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+	root := newTestServerOn(t, "[::1]:0", Config{})
+	servers := []*Server{root}
+	for i := 1; i < 4; i++ {
+		s := newTestServerOn(t, "[::1]:0", Config{BootstrapNodes: []string{root.Addr().String()}})
+		if err := s.Bootstrap(); err != nil {
+			t.Fatalf("Bootstrap failed: %v", err)
+		}
+		servers = append(servers, s)
+	}
+	var infoHash [20]byte
+	copy(infoHash[:], "dht-test-info-hash-6")
+
+	if _, err := servers[1].Announce(infoHash, 6881); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	peers := servers[3].GetPeers(infoHash)
+	if len(peers) != 1 || peers[0].String() != "[::1]:6881" {
+		t.Errorf("Expected peer [::1]:6881, got %v", peers)
+	}
+	if len(root.announced(infoHash, net.IPv4len)) != 0 {
+		t.Error("Expected IPv6 peers not to be returned to IPv4 nodes")
+	}
+}
+
+func TestAnnounceRequiresValidToken(t *testing.T) {
+	a := newTestServer(t, Config{})
+	b := newTestServer(t, Config{})
+	var infoHash [20]byte
+
+	_, err := a.query(b.Addr().(*net.UDPAddr), "announce_peer", map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      6881,
+		"token":     "forged",
+	})
+	if e, ok := err.(*Error); !ok || e.Code != errProtocol {
+		t.Errorf("Expected a protocol error, got %v", err)
+	}
+	if len(b.announced(infoHash, net.IPv4len)) != 0 {
+		t.Error("Expected the peer not to be stored")
+	}
+}
+
+func TestTokenSurvivesOneRotation(t *testing.T) {
+	s := newTestServer(t, Config{})
+	ip := net.IPv4(10, 0, 0, 1)
+	token := s.token(ip, s.secret)
+
+	s.expire(time.Now().Add(tokenRotation))
+	if !s.validToken(ip, token) {
+		t.Error("Expected the token to be valid after one rotation")
+	}
+	s.expire(time.Now().Add(2 * tokenRotation))
+	if s.validToken(ip, token) {
+		t.Error("Expected the token to expire after two rotations")
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.dat")
+	servers := newTestNetwork(t, 3)
+
+	s := newTestServer(t, Config{StateFile: path, BootstrapNodes: []string{servers[0].Addr().String()}})
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Bootstrap failed: %v", err)
+	}
+	id, nodes := s.ID, len(s.Nodes())
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	restored := newTestServer(t, Config{StateFile: path})
+	if restored.ID != id {
+		t.Errorf("Expected ID %s, got %s", id, restored.ID)
+	}
+	if got := len(restored.Nodes()); got != nodes {
+		t.Errorf("Expected %d nodes, got %d", nodes, got)
+	}
+}
+
+func TestGetPeersSkipsMalformedValues(t *testing.T) {
+	s := newTestServer(t, Config{})
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer conn.Close()
+	remote := Node{ID: RandomID(), Addr: conn.LocalAddr().(*net.UDPAddr)}
+	s.table.seen(remote, time.Now())
+
+	// The remote node answers get_peers with values of every length
+	want := torrent.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}
+	go func() {
+		buf := make([]byte, 2048)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, err := decodeMessage(buf[:n])
+		if err != nil {
+			return
+		}
+		values := []interface{}{"", "x", "short", string(torrent.CompactPeers([]torrent.Peer{want}, net.IPv4len))}
+		reply := &message{T: m.T, Y: "r", R: map[string]interface{}{
+			"id":     string(remote.ID[:]),
+			"values": values,
+		}}
+		b, _ := reply.encode()
+		conn.WriteTo(b, addr)
+	}()
+
+	var infoHash [20]byte
+	copy(infoHash[:], "dht-malformed-values")
+	peers := s.GetPeers(infoHash)
+	if len(peers) != 1 || peers[0].String() != want.String() {
+		t.Errorf("Expected only %s, got %v", want, peers)
+	}
+}
+
+func TestRepliesFromOtherAddressesAreIgnored(t *testing.T) {
+	s := newTestServer(t, Config{})
+	queried, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer queried.Close()
+	spoofer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer spoofer.Close()
+
+	// The spoofer learns the transaction ID and answers in place of the
+	// queried node
+	go func() {
+		buf := make([]byte, 2048)
+		n, addr, err := queried.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		m, err := decodeMessage(buf[:n])
+		if err != nil {
+			return
+		}
+		id := RandomID()
+		reply := &message{T: m.T, Y: "r", R: map[string]interface{}{"id": string(id[:])}}
+		b, _ := reply.encode()
+		spoofer.WriteTo(b, addr)
+	}()
+
+	if _, err := s.Ping(queried.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Error("Expected the spoofed reply to be ignored")
+	}
+}
+
+func TestAnnouncedPeersAreCapped(t *testing.T) {
+	s := newTestServer(t, Config{})
+	var infoHash NodeID
+	for i := 0; i < maxPeersPerInfoHash+10; i++ {
+		s.addPeer(infoHash, torrent.Peer{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 6881})
+	}
+	if n := len(s.peers[infoHash]); n != maxPeersPerInfoHash {
+		t.Errorf("Expected %d peers, got %d", maxPeersPerInfoHash, n)
+	}
+
+	for i := 0; i < maxInfoHashes+10; i++ {
+		var other NodeID
+		binary.BigEndian.PutUint32(other[:], uint32(i+1))
+		s.addPeer(other, torrent.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881})
+	}
+	if n := len(s.peers); n != maxInfoHashes {
+		t.Errorf("Expected %d info hashes, got %d", maxInfoHashes, n)
+	}
+}
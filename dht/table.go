@@ -0,0 +1,169 @@
+package dht
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the bucket size and the number of nodes a lookup converges on.
+const K = 8
+
+// A node that fails to answer this many queries in a row is dropped.
+const maxFailures = 2
+
+// Buckets that saw no change for this long are refreshed by looking up a
+// random ID in their range.
+const refreshInterval = 15 * time.Minute
+
+// table is a Kademlia routing table. Bucket i holds the nodes whose IDs share
+// exactly i leading bits with ours, so buckets close to us cover ever
+// smaller parts of the ID space.
+type table struct {
+	self    NodeID
+	mu      sync.Mutex
+	buckets [160]bucket
+}
+
+type bucket struct {
+	entries []*entry // least recently seen first
+	changed time.Time
+}
+
+type entry struct {
+	Node
+	lastSeen time.Time
+	failures int
+}
+
+func newTable(self NodeID, now time.Time) *table {
+	t := &table{self: self}
+	for i := range t.buckets {
+		t.buckets[i].changed = now
+	}
+	return t
+}
+
+func (t *table) bucketFor(id NodeID) *bucket {
+	i := commonPrefixLen(t.self, id)
+	if i >= len(t.buckets) {
+		i = len(t.buckets) - 1
+	}
+	return &t.buckets[i]
+}
+
+// seen records that n answered us or queried us. Known nodes move to the
+// back of their bucket. New nodes are added if the bucket has room, and are
+// otherwise dropped in favor of the long-lived nodes already there.
+func (t *table) seen(n Node, now time.Time) {
+	if n.ID == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(n.ID)
+	for i, e := range b.entries {
+		if e.ID == n.ID {
+			e.Addr = n.Addr
+			e.lastSeen = now
+			e.failures = 0
+			b.entries = append(append(b.entries[:i:i], b.entries[i+1:]...), e)
+			b.changed = now
+			return
+		}
+	}
+	if len(b.entries) >= K {
+		return
+	}
+	b.entries = append(b.entries, &entry{Node: n, lastSeen: now})
+	b.changed = now
+}
+
+// failed records that id did not answer a query, and drops it after
+// maxFailures in a row.
+func (t *table) failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := t.bucketFor(id)
+	for i, e := range b.entries {
+		if e.ID == id {
+			e.failures++
+			if e.failures >= maxFailures {
+				b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes closest to target.
+func (t *table) closest(target NodeID, n int) []Node {
+	nodes := t.nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > n {
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+func (t *table) nodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []Node
+	for i := range t.buckets {
+		for _, e := range t.buckets[i].entries {
+			nodes = append(nodes, e.Node)
+		}
+	}
+	return nodes
+}
+
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].entries)
+	}
+	return n
+}
+
+// stale returns a random target in the range of every bucket that needs a
+// refresh. Buckets beyond the deepest non-empty one are skipped, since
+// nodes that close to us are unlikely to exist.
+func (t *table) stale(now time.Time) []NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deepest := -1
+	for i := range t.buckets {
+		if len(t.buckets[i].entries) > 0 {
+			deepest = i
+		}
+	}
+	var targets []NodeID
+	for i := 0; i <= deepest; i++ {
+		if now.Sub(t.buckets[i].changed) >= refreshInterval {
+			targets = append(targets, t.randomIDInBucket(i))
+			t.buckets[i].changed = now
+		}
+	}
+	return targets
+}
+
+// randomIDInBucket returns an ID that shares exactly i leading bits with
+// ours.
+func (t *table) randomIDInBucket(i int) NodeID {
+	id := RandomID()
+	for bit := 0; bit < i; bit++ {
+		mask := byte(0x80) >> (bit % 8)
+		id[bit/8] = id[bit/8]&^mask | t.self[bit/8]&mask
+	}
+	mask := byte(0x80) >> (i % 8)
+	id[i/8] = id[i/8]&^mask | ^t.self[i/8]&mask
+	return id
+}
@@ -0,0 +1,123 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testNode(id NodeID, port int) Node {
+	return Node{ID: id, Addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	var a, b NodeID
+	if got := commonPrefixLen(a, b); got != 160 {
+		t.Errorf("Expected 160, got %d", got)
+	}
+	b[0] = 0x80
+	if got := commonPrefixLen(a, b); got != 0 {
+		t.Errorf("Expected 0, got %d", got)
+	}
+	b[0] = 0
+	b[1] = 0x10
+	if got := commonPrefixLen(a, b); got != 11 {
+		t.Errorf("Expected 11, got %d", got)
+	}
+}
+
+func TestTableBucketsAreBounded(t *testing.T) {
+	var self NodeID
+	now := time.Now()
+	tab := newTable(self, now)
+
+	// All of these share no prefix with self and land in bucket 0
+	for i := 0; i < K+5; i++ {
+		var id NodeID
+		id[0] = 0x80
+		id[19] = byte(i)
+		tab.seen(testNode(id, 1000+i), now)
+	}
+	if got := tab.len(); got != K {
+		t.Errorf("Expected %d nodes, got %d", K, got)
+	}
+
+	var first NodeID
+	first[0] = 0x80
+	for i := 0; i < maxFailures; i++ {
+		tab.failed(first)
+	}
+	if got := tab.len(); got != K-1 {
+		t.Errorf("Expected the failing node to be dropped, got %d nodes", got)
+	}
+}
+
+func TestTableClosest(t *testing.T) {
+	var self NodeID
+	tab := newTable(self, time.Now())
+	for i := 1; i <= 20; i++ {
+		var id NodeID
+		id[19] = byte(i)
+		tab.seen(testNode(id, 1000+i), time.Now())
+	}
+
+	var target NodeID
+	target[19] = 4
+	closest := tab.closest(target, 3)
+	if len(closest) != 3 {
+		t.Fatalf("Expected 3 nodes, got %d", len(closest))
+	}
+	// Distances from 4: 4^4=0, 4^5=1, 4^6=2
+	for i, want := range []byte{4, 5, 6} {
+		if closest[i].ID[19] != want {
+			t.Errorf("Expected node %d at position %d, got %d", want, i, closest[i].ID[19])
+		}
+	}
+}
+
+func TestTableStaleBuckets(t *testing.T) {
+	var self NodeID
+	start := time.Now()
+	tab := newTable(self, start)
+
+	var id NodeID
+	id[0] = 0x40 // bucket 1
+	tab.seen(testNode(id, 1000), start)
+
+	targets := tab.stale(start.Add(refreshInterval + time.Second))
+	if len(targets) != 2 {
+		t.Fatalf("Expected buckets 0 and 1 to need a refresh, got %d", len(targets))
+	}
+	for i, target := range targets {
+		if got := commonPrefixLen(self, target); got != i {
+			t.Errorf("Expected a target in bucket %d, got one in bucket %d", i, got)
+		}
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	v6 := Node{ID: RandomID(), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}
+	nodes := []Node{testNode(RandomID(), 6881), v6, testNode(RandomID(), 51413)}
+	tests := []struct {
+		ipLen    int
+		expected []Node
+	}{
+		{net.IPv4len, []Node{nodes[0], nodes[2]}},
+		{net.IPv6len, []Node{v6}},
+	}
+
+	for _, tt := range tests {
+		parsed, err := parseCompactNodes(compactNodes(nodes, tt.ipLen), tt.ipLen)
+		if err != nil {
+			t.Fatalf("parseCompactNodes failed: %v", err)
+		}
+		if len(parsed) != len(tt.expected) {
+			t.Fatalf("Expected %d nodes, got %d", len(tt.expected), len(parsed))
+		}
+		for i := range tt.expected {
+			if parsed[i].ID != tt.expected[i].ID || parsed[i].Addr.String() != tt.expected[i].Addr.String() {
+				t.Errorf("Expected %s, got %s", tt.expected[i], parsed[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package lsd implements Local Service Discovery (BEP 14): announcing the
+// torrents we serve to peers on the local network over multicast, and
+// learning about theirs.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+// Multicast groups of BEP 14.
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+const (
+	// Every torrent is announced this often.
+	announceInterval = 5 * time.Minute
+	// How often to check for torrents that are due. Torrents due together
+	// share one message, keeping multicast traffic low.
+	checkInterval = time.Minute
+)
+
+// Group is a socket that receives the announcements sent to a multicast
+// group, and the group's address.
+type Group struct {
+	Conn net.PacketConn
+	Addr *net.UDPAddr
+}
+
+// Service announces torrents on the local network and reports the peers
+// announcing the same torrents.
+type Service struct {
+	groups    []Group
+	cookie    string
+	mu        sync.Mutex
+	torrents  map[[20]byte]*localTorrent
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type localTorrent struct {
+	port      uint16
+	found     func(torrent.Peer)
+	announced time.Time
+}
+
+// Listen joins the IPv4 and IPv6 groups on all interfaces. It fails only if
+// neither group can be joined.
+func Listen() (*Service, error) {
+	var groups []Group
+	var errs []string
+	for _, g := range []struct {
+		network string
+		addr    *net.UDPAddr
+	}{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+		conn, err := net.ListenMulticastUDP(g.network, nil, g.addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		groups = append(groups, Group{conn, g.addr})
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("failed to join a multicast group: %s", strings.Join(errs, "; "))
+	}
+	return New(groups...), nil
+}
+
+// New serves LSD on the given groups until Close is called.
+func New(groups ...Group) *Service {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	s := &Service{
+		groups:   groups,
+		cookie:   hex.EncodeToString(buf),
+		torrents: make(map[[20]byte]*localTorrent),
+		done:     make(chan struct{}),
+	}
+	for _, g := range groups {
+		go s.readLoop(g.Conn)
+	}
+	go s.announceLoop()
+	return s
+}
+
+// Add announces infoHash with the port we accept peers on, now and
+// periodically until Remove is called. found is called with every local peer
+// announcing the same torrent.
+func (s *Service) Add(infoHash [20]byte, port uint16, found func(torrent.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &localTorrent{port: port, found: found}
+	s.mu.Unlock()
+	s.announce(time.Now())
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Service) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, g := range s.groups {
+			if cerr := g.Conn.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.announce(now)
+		}
+	}
+}
+
+// announce sends the torrents that are due, one message per port.
+func (s *Service) announce(now time.Time) {
+	s.mu.Lock()
+	byPort := make(map[uint16][][20]byte)
+	for infoHash, t := range s.torrents {
+		if t.announced.IsZero() || now.Sub(t.announced) >= announceInterval {
+			t.announced = now
+			byPort[t.port] = append(byPort[t.port], infoHash)
+		}
+	}
+	s.mu.Unlock()
+
+	for port, infoHashes := range byPort {
+		for _, g := range s.groups {
+			msg := Announcement{InfoHashes: infoHashes, Port: port, Cookie: s.cookie}
+			if _, err := g.Conn.WriteTo(msg.Serialize(g.Addr), g.Addr); err != nil {
+				log.Printf("LSD announce to %s failed: %v", g.Addr, err)
+			}
+		}
+	}
+}
+
+func (s *Service) readLoop(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := ParseAnnouncement(buf[:n])
+		if err != nil || msg.Cookie == s.cookie {
+			continue // malformed or our own
+		}
+		s.received(msg, udpAddr.IP)
+	}
+}
+
+func (s *Service) received(msg *Announcement, ip net.IP) {
+	p := torrent.Peer{IP: ip, Port: msg.Port}
+	var found []func(torrent.Peer)
+	s.mu.Lock()
+	for _, infoHash := range msg.InfoHashes {
+		if t, ok := s.torrents[infoHash]; ok {
+			found = append(found, t.found)
+		}
+	}
+	s.mu.Unlock()
+	for _, f := range found {
+		f(p)
+	}
+}
+
+// Announcement is a BT-SEARCH message.
+type Announcement struct {
+	InfoHashes [][20]byte
+	Port       uint16
+	// Cookie lets a host recognize its own announcements.
+	Cookie string
+}
+
+// Serialize formats the announcement for sending to group.
+func (a *Announcement) Serialize(group *net.UDPAddr) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "Host: %s\r\n", group)
+	fmt.Fprintf(&buf, "Port: %d\r\n", a.Port)
+	for _, infoHash := range a.InfoHashes {
+		fmt.Fprintf(&buf, "Infohash: %x\r\n", infoHash)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&buf, "cookie: %s\r\n", a.Cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func ParseAnnouncement(buf []byte) (*Announcement, error) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(buf)))
+	line, err := r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	if line != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("not a BT-SEARCH message: %q", line)
+	}
+	header, err := r.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port %q", header.Get("Port"))
+	}
+	a := &Announcement{Port: uint16(port), Cookie: header.Get("Cookie")}
+	for _, value := range header.Values("Infohash") {
+		var infoHash [20]byte
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != len(infoHash) {
+			return nil, fmt.Errorf("invalid infohash %q", value)
+		}
+		copy(infoHash[:], decoded)
+		a.InfoHashes = append(a.InfoHashes, infoHash)
+	}
+	if len(a.InfoHashes) == 0 {
+		return nil, fmt.Errorf("announcement has no infohash")
+	}
+	return a, nil
+}
@@ -0,0 +1,118 @@
+package lsd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"torrent-client/torrent"
+)
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	var a, b [20]byte
+	copy(a[:], "first-info-hash-0000")
+	copy(b[:], "second-info-hash-000")
+	msg := &Announcement{InfoHashes: [][20]byte{a, b}, Port: 6881, Cookie: "abc"}
+
+	parsed, err := ParseAnnouncement(msg.Serialize(IPv4Group))
+	if err != nil {
+		t.Fatalf("ParseAnnouncement failed: %v", err)
+	}
+	if parsed.Port != 6881 {
+		t.Errorf("Expected port 6881, got %d", parsed.Port)
+	}
+	if parsed.Cookie != "abc" {
+		t.Errorf("Expected cookie abc, got %q", parsed.Cookie)
+	}
+	if len(parsed.InfoHashes) != 2 || parsed.InfoHashes[0] != a || parsed.InfoHashes[1] != b {
+		t.Errorf("Expected infohashes %x and %x, got %x", a, b, parsed.InfoHashes)
+	}
+}
+
+func TestParseAnnouncement(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"bep 14 example", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n\r\n", true},
+		{"lower case headers", "BT-SEARCH * HTTP/1.1\r\nhost: 239.192.152.143:6771\r\nport: 6881\r\ninfohash: 0123456789ABCDEF0123456789ABCDEF01234567\r\n\r\n\r\n", true},
+		{"wrong method", "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n", false},
+		{"missing port", "BT-SEARCH * HTTP/1.1\r\nInfohash: 0123456789abcdef0123456789abcdef01234567\r\n\r\n", false},
+		{"short infohash", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: 0123\r\n\r\n", false},
+		{"no infohash", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseAnnouncement([]byte(tc.input))
+			if tc.valid && err != nil {
+				t.Errorf("Expected a valid announcement, got %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+// newTestPair returns two services whose "groups" are each other's unicast
+// sockets, standing in for a multicast group both are members of.
+func newTestPair(t *testing.T) (*Service, *Service) {
+	a, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	b, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	sa := New(Group{a, b.LocalAddr().(*net.UDPAddr)})
+	sb := New(Group{b, a.LocalAddr().(*net.UDPAddr)})
+	t.Cleanup(func() {
+		sa.Close()
+		sb.Close()
+	})
+	return sa, sb
+}
+
+func TestServiceFindsLocalPeers(t *testing.T) {
+	a, b := newTestPair(t)
+	var infoHash, other [20]byte
+	copy(infoHash[:], "shared-info-hash-000")
+	copy(other[:], "other-info-hash-0000")
+
+	found := make(chan torrent.Peer, 2)
+	b.Add(infoHash, 7000, func(p torrent.Peer) { found <- p })
+	b.Add(other, 7000, func(p torrent.Peer) { t.Error("Unexpected peer for another torrent") })
+	a.Add(infoHash, 6881, func(torrent.Peer) {})
+
+	select {
+	case p := <-found:
+		if p.Port != 6881 || !p.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Errorf("Expected peer 127.0.0.1:6881, got %s", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("No local peer found")
+	}
+}
+
+func TestServiceIgnoresOwnAnnouncements(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	// Announcements loop back to the sender, as multicast ones do
+	s := New(Group{conn, conn.LocalAddr().(*net.UDPAddr)})
+	defer s.Close()
+
+	var infoHash [20]byte
+	found := make(chan torrent.Peer, 1)
+	s.Add(infoHash, 6881, func(p torrent.Peer) { found <- p })
+
+	select {
+	case p := <-found:
+		t.Errorf("Expected our own announcement to be ignored, got %s", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
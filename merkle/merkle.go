@@ -0,0 +1,140 @@
+// Package merkle computes the SHA-256 merkle trees of BitTorrent v2
+// (BEP 52). The leaves of a file's tree are the hashes of its 16 KiB
+// blocks, padded with zero hashes to a power of two.
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+// BlockSize is the amount of data covered by one leaf.
+const BlockSize = 16 * 1024
+
+// BlockHashes returns the leaf hashes of data, one per block. The last block
+// may be short.
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[begin:min(begin+BlockSize, len(data))]))
+	}
+	return hashes
+}
+
+// PadHash returns the hash of a subtree whose leaves are all zero hashes,
+// at layer levels above the leaves.
+func PadHash(layer int) [32]byte {
+	var h [32]byte
+	for i := 0; i < layer; i++ {
+		h = pair(h, h)
+	}
+	return h
+}
+
+// Width returns the number of nodes a layer of n hashes is padded to.
+func Width(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Log2 returns the layer at which a node covers n nodes of a lower layer;
+// n must be a power of two.
+func Log2(n int) int {
+	return bits.TrailingZeros(uint(n))
+}
+
+func pair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// Root returns the root of the tree whose nodes at layer are hashes, padded
+// to width nodes.
+func Root(hashes [][32]byte, layer, width int) [32]byte {
+	return NewTree(hashes, layer, width).Root()
+}
+
+// Tree holds every layer of a merkle tree from a base layer up to the root.
+type Tree struct {
+	base   int
+	layers [][][32]byte
+}
+
+// NewTree builds the tree whose nodes at layer base are hashes, padded to
+// width nodes, which must be a power of two at least len(hashes).
+func NewTree(hashes [][32]byte, base, width int) *Tree {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	pad := PadHash(base)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	t := &Tree{base: base, layers: [][][32]byte{layer}}
+	for len(layer) > 1 {
+		up := make([][32]byte, len(layer)/2)
+		for i := range up {
+			up[i] = pair(layer[2*i], layer[2*i+1])
+		}
+		t.layers = append(t.layers, up)
+		layer = up
+	}
+	return t
+}
+
+// Root returns the root hash.
+func (t *Tree) Root() [32]byte {
+	return t.layers[len(t.layers)-1][0]
+}
+
+// Layer returns the nodes of a layer, or nil if the tree does not hold it.
+func (t *Tree) Layer(layer int) [][32]byte {
+	if layer < t.base || layer-t.base >= len(t.layers) {
+		return nil
+	}
+	return t.layers[layer-t.base]
+}
+
+// Hashes returns length nodes of layer starting at index, followed by the
+// uncle hashes proving them: the siblings of their common ancestor and of
+// its ancestors, proofLayers of them at most. index must be a multiple of
+// length, which must be a power of two. It returns false for nodes outside
+// the tree.
+func (t *Tree) Hashes(layer, index, length, proofLayers int) ([][32]byte, bool) {
+	nodes := t.Layer(layer)
+	if nodes == nil || length < 1 || length&(length-1) != 0 || index < 0 || index%length != 0 || index+length > len(nodes) {
+		return nil, false
+	}
+	hashes := append([][32]byte(nil), nodes[index:index+length]...)
+	l := layer - t.base + Log2(length)
+	i := index / length
+	for ; proofLayers > 0 && l < len(t.layers)-1; proofLayers-- {
+		hashes = append(hashes, t.layers[l][i^1])
+		l++
+		i /= 2
+	}
+	return hashes, true
+}
+
+// Verify reports whether hashes, nodes of layer starting at index as
+// returned by Tree.Hashes with their uncle hashes, lead up to expected: the
+// root, or the ancestor the last uncle hash leads to.
+func Verify(hashes [][32]byte, layer, index, length int, expected [32]byte) bool {
+	if length < 1 || length&(length-1) != 0 || index%length != 0 || len(hashes) < length {
+		return false
+	}
+	h := Root(hashes[:length], layer, length)
+	i := index / length
+	for _, uncle := range hashes[length:] {
+		if i%2 == 0 {
+			h = pair(h, uncle)
+		} else {
+			h = pair(uncle, h)
+		}
+		i /= 2
+	}
+	return h == expected
+}
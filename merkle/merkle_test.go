@@ -0,0 +1,100 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func testLeaves(n int) [][32]byte {
+	leaves := make([][32]byte, n)
+	for i := range leaves {
+		leaves[i] = sha256.Sum256([]byte{byte(i)})
+	}
+	return leaves
+}
+
+func TestBlockHashes(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, 2*BlockSize+10)
+	hashes := BlockHashes(data)
+	if len(hashes) != 3 {
+		t.Fatalf("Expected 3 hashes, got %d", len(hashes))
+	}
+	if hashes[2] != sha256.Sum256(data[2*BlockSize:]) {
+		t.Error("Expected the last block to be hashed as it is")
+	}
+}
+
+func TestRoot(t *testing.T) {
+	leaves := testLeaves(3)
+	var zero [32]byte
+	expected := pair(pair(leaves[0], leaves[1]), pair(leaves[2], zero))
+	if root := Root(leaves, 0, Width(len(leaves))); root != expected {
+		t.Errorf("Expected root %x, got %x", expected, root)
+	}
+	if root := Root(leaves[:1], 0, 1); root != leaves[0] {
+		t.Error("Expected the root of a single leaf to be the leaf")
+	}
+}
+
+func TestTreeFromUpperLayer(t *testing.T) {
+	// A tree built from the layer of two-block pieces has the same root as
+	// the one built from the blocks
+	leaves := testLeaves(5)
+	full := NewTree(leaves, 0, Width(len(leaves)))
+	pieces := full.Layer(1)[:3]
+	if root := Root(pieces, 1, Width(len(pieces))); root != full.Root() {
+		t.Errorf("Expected root %x, got %x", full.Root(), root)
+	}
+}
+
+func TestWidthAndLog2(t *testing.T) {
+	tests := []struct{ n, width int }{{0, 1}, {1, 1}, {2, 2}, {3, 4}, {4, 4}, {5, 8}}
+	for _, tt := range tests {
+		if w := Width(tt.n); w != tt.width {
+			t.Errorf("Width(%d): expected %d, got %d", tt.n, tt.width, w)
+		}
+	}
+	if l := Log2(64); l != 6 {
+		t.Errorf("Expected Log2(64) to be 6, got %d", l)
+	}
+}
+
+func TestHashesAndVerify(t *testing.T) {
+	leaves := testLeaves(13)
+	tree := NewTree(leaves, 0, Width(len(leaves)))
+
+	tests := []struct {
+		layer, index, length, proofLayers int
+		count                             int
+	}{
+		{0, 4, 4, 10, 4 + 2},
+		{0, 0, 16, 10, 16},
+		{1, 2, 2, 1, 2 + 1},
+		{0, 12, 2, 3, 2 + 3},
+	}
+	for _, tt := range tests {
+		hashes, ok := tree.Hashes(tt.layer, tt.index, tt.length, tt.proofLayers)
+		if !ok || len(hashes) != tt.count {
+			t.Errorf("Hashes(%d, %d, %d, %d): expected %d hashes, got %d (%v)", tt.layer, tt.index, tt.length, tt.proofLayers, tt.count, len(hashes), ok)
+			continue
+		}
+		expected := tree.Root()
+		if top := tt.layer + Log2(tt.length) + len(hashes) - tt.length; top < len(tree.layers)-1 {
+			expected = tree.Layer(top)[(tt.index>>Log2(tt.length))>>(len(hashes)-tt.length)]
+		}
+		if !Verify(hashes, tt.layer, tt.index, tt.length, expected) {
+			t.Errorf("Hashes(%d, %d, %d, %d) did not verify", tt.layer, tt.index, tt.length, tt.proofLayers)
+		}
+		hashes[0][0]++
+		if Verify(hashes, tt.layer, tt.index, tt.length, expected) {
+			t.Errorf("Hashes(%d, %d, %d, %d) verified after tampering", tt.layer, tt.index, tt.length, tt.proofLayers)
+		}
+	}
+
+	for _, bad := range [][3]int{{0, 3, 2}, {0, 0, 3}, {0, 16, 2}, {7, 0, 1}} {
+		if _, ok := tree.Hashes(bad[0], bad[1], bad[2], 0); ok {
+			t.Errorf("Expected Hashes%v to be refused", bad)
+		}
+	}
+}
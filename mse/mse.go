@@ -0,0 +1,404 @@
+// Package mse implements Message Stream Encryption, also known as Protocol
+// Encryption: a Diffie-Hellman key exchange followed by an RC4 stream that
+// hides BitTorrent traffic from throttling middleboxes.
+package mse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Crypto methods offered in crypto_provide and chosen in crypto_select.
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLen = 96
+	maxPad = 512
+	// Bytes of RC4 keystream discarded after setting up each cipher.
+	discard = 1024
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8) // verification constant
+)
+
+// Policy says when connections are encrypted.
+type Policy int
+
+const (
+	// Disabled uses plaintext connections only. It is the zero value.
+	Disabled Policy = iota
+	// Preferred encrypts where the peer supports it. Outgoing connections
+	// that fail to negotiate encryption are retried in plaintext, and
+	// incoming connections may be either.
+	Preferred
+	// Required refuses plaintext connections.
+	Required
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "disabled", "disable", "off":
+		return Disabled, nil
+	case "preferred", "prefer":
+		return Preferred, nil
+	case "required", "require", "forced", "force":
+		return Required, nil
+	}
+	return Disabled, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Preferred:
+		return "preferred"
+	case Required:
+		return "required"
+	default:
+		return "disabled"
+	}
+}
+
+// Provide returns the crypto methods to offer under the policy.
+func (p Policy) Provide() uint32 {
+	if p == Required {
+		return CryptoRC4
+	}
+	return CryptoRC4 | CryptoPlaintext
+}
+
+// Select picks one of the methods a peer offers, preferring RC4, or returns
+// 0 if the policy allows none of them.
+func (p Policy) Select(provide uint32) uint32 {
+	switch {
+	case provide&CryptoRC4 != 0:
+		return CryptoRC4
+	case provide&CryptoPlaintext != 0 && p != Required:
+		return CryptoPlaintext
+	}
+	return 0
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// keyPair returns a private key and the matching public key padded to
+// keyLen bytes.
+func keyPair() (*big.Int, []byte, error) {
+	private := make([]byte, 20)
+	if _, err := rand.Read(private); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(private)
+	y := new(big.Int).Exp(generator, x, prime)
+	return x, pad(y.Bytes()), nil
+}
+
+func sharedSecret(x *big.Int, remote []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remote)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return pad(new(big.Int).Exp(y, x, prime).Bytes()), nil
+}
+
+func pad(b []byte) []byte {
+	buf := make([]byte, keyLen)
+	copy(buf[keyLen-len(b):], b)
+	return buf
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPad+1))
+	_, err := rand.Read(buf)
+	return buf, err
+}
+
+func newCipher(name string, secret []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey[:]))
+	buf := make([]byte, discard)
+	c.XORKeyStream(buf, buf)
+	return c
+}
+
+// Initiate encrypts an outgoing connection to a peer serving the torrent
+// with infohash skey, offering the methods in provide. It returns the
+// connection to use for the BitTorrent handshake and the method the peer
+// selected.
+func Initiate(conn net.Conn, skey [20]byte, provide uint32) (net.Conn, uint32, error) {
+	x, ya, err := keyPair()
+	if err != nil {
+		return nil, 0, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := conn.Write(append(ya, padA...)); err != nil {
+		return nil, 0, err
+	}
+
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(conn, yb); err != nil {
+		return nil, 0, err
+	}
+	s, err := sharedSecret(x, yb)
+	if err != nil {
+		return nil, 0, err
+	}
+	enc := newCipher("keyA", s, skey)
+	dec := newCipher("keyB", s, skey)
+
+	padC, err := randomPad()
+	if err != nil {
+		return nil, 0, err
+	}
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	req2, req3 := hash([]byte("req2"), skey[:]), hash([]byte("req3"), s)
+	for i := range req2 {
+		msg.WriteByte(req2[i] ^ req3[i])
+	}
+	plain := make([]byte, 0, 16+len(padC))
+	plain = append(plain, vc...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(padC)))
+	plain = append(plain, padC...)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // no initial payload
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, 0, err
+	}
+
+	// The peer's padding ends where its encrypted verification constant
+	// starts
+	want := make([]byte, len(vc))
+	dec.XORKeyStream(want, vc)
+	if err := syncTo(conn, want, maxPad); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(buf, buf)
+	selected := binary.BigEndian.Uint32(buf[0:4])
+	padD := make([]byte, binary.BigEndian.Uint16(buf[4:6]))
+	if len(padD) > maxPad {
+		return nil, 0, fmt.Errorf("padding of %d bytes is too long", len(padD))
+	}
+	if _, err := io.ReadFull(conn, padD); err != nil {
+		return nil, 0, err
+	}
+	dec.XORKeyStream(padD, padD)
+
+	switch {
+	case selected&provide == 0 || selected&(selected-1) != 0:
+		return nil, 0, fmt.Errorf("peer selected crypto method %#x, offered %#x", selected, provide)
+	case selected == CryptoRC4:
+		return newConn(conn, nil, enc, dec), selected, nil
+	}
+	return conn, selected, nil
+}
+
+// Receive answers the encryption handshake of an incoming connection. skeys
+// are the infohashes we serve and choose picks the crypto method from those
+// the peer offers, or returns 0 to refuse them all. It returns the
+// connection to read the BitTorrent handshake from, the infohash the peer
+// asked for and the selected method.
+func Receive(conn net.Conn, skeys [][20]byte, choose func(provide uint32) uint32) (net.Conn, [20]byte, uint32, error) {
+	var skey [20]byte
+	ya := make([]byte, keyLen)
+	if _, err := io.ReadFull(conn, ya); err != nil {
+		return nil, skey, 0, err
+	}
+	x, yb, err := keyPair()
+	if err != nil {
+		return nil, skey, 0, err
+	}
+	s, err := sharedSecret(x, ya)
+	if err != nil {
+		return nil, skey, 0, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, skey, 0, err
+	}
+	if _, err := conn.Write(append(yb, padB...)); err != nil {
+		return nil, skey, 0, err
+	}
+
+	if err := syncTo(conn, hash([]byte("req1"), s), maxPad); err != nil {
+		return nil, skey, 0, err
+	}
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(conn, obfuscated); err != nil {
+		return nil, skey, 0, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range obfuscated {
+		obfuscated[i] ^= req3[i]
+	}
+	found := false
+	for _, candidate := range skeys {
+		if bytes.Equal(hash([]byte("req2"), candidate[:]), obfuscated) {
+			skey, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, 0, fmt.Errorf("peer asked for an unknown torrent")
+	}
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, skey, 0, err
+	}
+	dec.XORKeyStream(buf, buf)
+	if !bytes.Equal(buf[0:8], vc) {
+		return nil, skey, 0, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(buf[8:12])
+	padC := make([]byte, binary.BigEndian.Uint16(buf[12:14]))
+	if len(padC) > maxPad {
+		return nil, skey, 0, fmt.Errorf("padding of %d bytes is too long", len(padC))
+	}
+	if _, err := io.ReadFull(conn, padC); err != nil {
+		return nil, skey, 0, err
+	}
+	dec.XORKeyStream(padC, padC)
+	lenIA := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenIA); err != nil {
+		return nil, skey, 0, err
+	}
+	dec.XORKeyStream(lenIA, lenIA)
+	ia := make([]byte, binary.BigEndian.Uint16(lenIA))
+	if _, err := io.ReadFull(conn, ia); err != nil {
+		return nil, skey, 0, err
+	}
+	dec.XORKeyStream(ia, ia)
+
+	selected := choose(provide)
+	reply := append([]byte(nil), vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, 0) // no padding
+	enc.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, skey, 0, err
+	}
+	if selected == 0 {
+		return nil, skey, 0, fmt.Errorf("no acceptable crypto method in %#x", provide)
+	}
+
+	if selected == CryptoRC4 {
+		return newConn(conn, ia, enc, dec), skey, selected, nil
+	}
+	if len(ia) > 0 {
+		return &prefixConn{conn, io.MultiReader(bytes.NewReader(ia), conn)}, skey, selected, nil
+	}
+	return conn, skey, selected, nil
+}
+
+// syncTo reads from r until it has read marker, which must appear within
+// the first maxSkip+len(marker) bytes.
+func syncTo(r io.Reader, marker []byte, maxSkip int) error {
+	window := make([]byte, len(marker))
+	if _, err := io.ReadFull(r, window); err != nil {
+		return err
+	}
+	b := make([]byte, 1)
+	for skipped := 0; !bytes.Equal(window, marker); skipped++ {
+		if skipped == maxSkip {
+			return fmt.Errorf("encryption handshake not found")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		copy(window, window[1:])
+		window[len(window)-1] = b[0]
+	}
+	return nil
+}
+
+// Sniff reads the start of an incoming connection and reports whether it is
+// a plaintext BitTorrent handshake rather than an encryption handshake. The
+// returned connection reads from the start again.
+func Sniff(conn net.Conn) (net.Conn, bool, error) {
+	const pstr = "\x13BitTorrent protocol"
+	buf := make([]byte, len(pstr))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, false, err
+	}
+	return &prefixConn{conn, io.MultiReader(bytes.NewReader(buf), conn)}, string(buf) == pstr, nil
+}
+
+// prefixConn replays bytes that were already read from Conn.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Conn is an RC4 encrypted connection.
+type Conn struct {
+	net.Conn
+	pending []byte // decrypted data received during the handshake
+	readMu  sync.Mutex
+	writeMu sync.Mutex
+	enc     *rc4.Cipher
+	dec     *rc4.Cipher
+}
+
+func newConn(conn net.Conn, pending []byte, enc, dec *rc4.Cipher) *Conn {
+	return &Conn{Conn: conn, pending: pending, enc: enc, dec: dec}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.dec.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	buf := make([]byte, len(p))
+	c.enc.XORKeyStream(buf, p)
+	return c.Conn.Write(buf)
+}
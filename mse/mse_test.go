@@ -0,0 +1,159 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPair returns both ends of a loopback TCP connection. net.Pipe does not
+// buffer, so both sides writing their keys at once would block.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	b := <-accepted
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	return a, b
+}
+
+type result struct {
+	conn     net.Conn
+	skey     [20]byte
+	selected uint32
+	err      error
+}
+
+func handshake(t *testing.T, skey [20]byte, provide uint32, skeys [][20]byte, policy Policy) (result, result) {
+	a, b := connPair(t)
+	received := make(chan result, 1)
+	go func() {
+		var r result
+		r.conn, r.skey, r.selected, r.err = Receive(b, skeys, policy.Select)
+		received <- r
+	}()
+	var initiated result
+	initiated.conn, initiated.selected, initiated.err = Initiate(a, skey, provide)
+	return initiated, <-received
+}
+
+func TestHandshakeRC4(t *testing.T) {
+	skey := [20]byte{1, 2, 3}
+	other := [20]byte{4, 5, 6}
+	a, b := handshake(t, skey, CryptoRC4|CryptoPlaintext, [][20]byte{other, skey}, Preferred)
+	if a.err != nil || b.err != nil {
+		t.Fatalf("Handshake failed: %v, %v", a.err, b.err)
+	}
+	if a.selected != CryptoRC4 || b.selected != CryptoRC4 {
+		t.Errorf("Expected RC4 to be selected, got %#x and %#x", a.selected, b.selected)
+	}
+	if b.skey != skey {
+		t.Errorf("Expected skey %x, got %x", skey, b.skey)
+	}
+	if _, ok := a.conn.(*Conn); !ok {
+		t.Error("Expected an encrypted connection")
+	}
+
+	// Data flows both ways, and is not plaintext on the wire
+	msg := []byte("\x13BitTorrent protocol")
+	go a.conn.Write(msg)
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(b.conn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("Expected %q, got %q (%v)", msg, buf, err)
+	}
+	go b.conn.Write([]byte("reply"))
+	buf = make([]byte, 5)
+	if _, err := io.ReadFull(a.conn, buf); err != nil || string(buf) != "reply" {
+		t.Errorf("Expected reply, got %q (%v)", buf, err)
+	}
+}
+
+func TestHandshakePlaintextSelected(t *testing.T) {
+	skey := [20]byte{1}
+	a, b := handshake(t, skey, CryptoPlaintext, [][20]byte{skey}, Preferred)
+	if a.err != nil || b.err != nil {
+		t.Fatalf("Handshake failed: %v, %v", a.err, b.err)
+	}
+	if a.selected != CryptoPlaintext {
+		t.Errorf("Expected plaintext to be selected, got %#x", a.selected)
+	}
+	if _, ok := a.conn.(*Conn); ok {
+		t.Error("Expected a plaintext connection")
+	}
+}
+
+func TestHandshakeRequiredRefusesPlaintext(t *testing.T) {
+	skey := [20]byte{1}
+	a, b := handshake(t, skey, CryptoPlaintext, [][20]byte{skey}, Required)
+	if a.err == nil || b.err == nil {
+		t.Errorf("Expected both sides to fail, got %v and %v", a.err, b.err)
+	}
+}
+
+func TestHandshakeUnknownTorrent(t *testing.T) {
+	a, b := connPair(t)
+	go Initiate(a, [20]byte{1}, CryptoRC4)
+	if _, _, _, err := Receive(b, [][20]byte{{2}}, Preferred.Select); err == nil {
+		t.Error("Expected an unknown skey to be refused")
+	}
+}
+
+func TestSniff(t *testing.T) {
+	a, b := connPair(t)
+	go a.Write([]byte("\x13BitTorrent protocol and the rest"))
+	conn, plaintext, err := Sniff(b)
+	if err != nil || !plaintext {
+		t.Fatalf("Expected a plaintext handshake, got %v, %v", plaintext, err)
+	}
+	buf := make([]byte, 33)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "\x13BitTorrent protocol and the rest" {
+		t.Errorf("Expected the sniffed bytes to be replayed, got %q", buf)
+	}
+
+	a, b = connPair(t)
+	go Initiate(a, [20]byte{1}, CryptoRC4)
+	if _, plaintext, err := Sniff(b); err != nil || plaintext {
+		t.Errorf("Expected an encryption handshake, got %v, %v", plaintext, err)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected Policy
+		valid    bool
+	}{
+		{"disabled", Disabled, true},
+		{"prefer", Preferred, true},
+		{"Required", Required, true},
+		{"forced", Required, true},
+		{"sometimes", Disabled, false},
+	}
+	for _, tc := range testCases {
+		p, err := ParsePolicy(tc.input)
+		if (err == nil) != tc.valid {
+			t.Errorf("%q: expected valid %v, got %v", tc.input, tc.valid, err)
+		}
+		if p != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.input, tc.expected, p)
+		}
+	}
+}
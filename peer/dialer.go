@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"torrent-client/mse"
+)
+
+// Dialer opens connections to peers. Besides TCP it may use uTP, go through
+// a proxy, or connect to simulated peers in tests.
+type Dialer interface {
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// DialerFunc lets an ordinary function be used as a Dialer.
+type DialerFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+func (f DialerFunc) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	return f(ctx, addr)
+}
+
+// TCP connects to peers over TCP, giving up after a few seconds. It is the
+// default Dialer.
+var TCP Dialer = DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	return d.DialContext(ctx, "tcp", addr)
+})
+
+// Options configure an outgoing connection.
+type Options struct {
+	// Dialer opens the connection. Defaults to TCP.
+	Dialer Dialer
+	// Extensions lists the extensions to offer, or is nil to disable the
+	// extension protocol.
+	Extensions *Extensions
+	// Encryption decides whether the connection is encrypted. With
+	// mse.Preferred a peer that fails the encryption handshake is
+	// reconnected to in plaintext.
+	Encryption mse.Policy
+}
+
+// Timeouts for the steps of connecting to a peer whose context has no
+// deadline.
+const (
+	dialTimeout       = 3 * time.Second
+	encryptionTimeout = 5 * time.Second
+	handshakeTimeout  = 3 * time.Second
+)
+
+// deadline returns the deadline of ctx, or timeout from now if it has none.
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(timeout)
+}
+
+// watch sets a deadline on conn and makes cancelling ctx interrupt blocked
+// reads and writes. The returned function clears the deadline.
+func watch(ctx context.Context, conn net.Conn, t time.Time) func() {
+	conn.SetDeadline(t)
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	return func() {
+		stop()
+		conn.SetDeadline(time.Time{})
+	}
+}
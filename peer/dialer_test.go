@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipePeer answers a handshake on conn for infoHash and sends msgs.
+func pipePeer(conn net.Conn, infoHash [20]byte, msgs ...*Message) {
+	if _, err := ReadHandshake(conn); err != nil {
+		return
+	}
+	conn.Write(NewHandshake(infoHash, [20]byte{2}).Serialize())
+	for _, msg := range msgs {
+		conn.Write(msg.Serialize())
+	}
+}
+
+func TestNewWithConnOverPipe(t *testing.T) {
+	infoHash := [20]byte{1}
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go pipePeer(remote, infoHash, &Message{ID: MsgBitfield, Payload: []byte{0x80}})
+
+	c, err := NewWithConn(context.Background(), local, infoHash, [20]byte{3}, nil)
+	if err != nil {
+		t.Fatalf("NewWithConn failed: %v", err)
+	}
+	if !c.Outgoing() {
+		t.Error("Expected an outgoing connection")
+	}
+	if !c.Bitfield.HasPiece(0) {
+		t.Error("Expected the bitfield to be received")
+	}
+}
+
+func TestNewUsesDialer(t *testing.T) {
+	infoHash := [20]byte{1}
+	tests := []struct {
+		peer     *Peer
+		expected string
+	}{
+		{&Peer{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, "192.0.2.1:6881"},
+		{&Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, "[2001:db8::1]:6881"},
+	}
+
+	for _, tt := range tests {
+		var dialed string
+		dialer := DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+			dialed = addr
+			local, remote := net.Pipe()
+			go pipePeer(remote, infoHash, &Message{ID: MsgBitfield, Payload: []byte{0x80}})
+			return local, nil
+		})
+
+		c, err := New(context.Background(), tt.peer, infoHash, [20]byte{3}, Options{Dialer: dialer})
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		c.Close()
+		if dialed != tt.expected {
+			t.Errorf("Expected the dialer to get %s, got %q", tt.expected, dialed)
+		}
+		if c.String() != tt.expected {
+			t.Errorf("Expected the client to be named after the peer, got %s", c)
+		}
+	}
+}
+
+func TestCompleteHandshakeCancelled(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	// The remote reads our handshake but never answers
+	go ReadHandshake(remote)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := CompleteHandshake(ctx, local, NewHandshake([20]byte{1}, [20]byte{3}))
+	if err == nil {
+		t.Fatal("Expected the handshake to be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Cancelling took %s", elapsed)
+	}
+
+	// The deadline is cleared afterwards
+	go remote.Write([]byte{1})
+	local.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := local.Read(make([]byte, 1)); err != nil {
+		t.Errorf("Expected the connection to stay usable, got %v", err)
+	}
+}
+
+func TestNewDialError(t *testing.T) {
+	failed := errors.New("no route")
+	dialer := DialerFunc(func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, failed
+	})
+	_, err := New(context.Background(), &Peer{IP: net.IPv4(192, 0, 2, 1), Port: 1}, [20]byte{1}, [20]byte{3}, Options{Dialer: dialer})
+	if !errors.Is(err, failed) {
+		t.Errorf("Expected the dial error, got %v", err)
+	}
+}
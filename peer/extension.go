@@ -0,0 +1,222 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+
+	"torrent-client/bencode"
+)
+
+// MsgExtended carries the messages of the extension protocol (BEP 10). The
+// first payload byte is the extended message ID, 0 being the handshake.
+const MsgExtended MessageID = 20
+
+const extHandshakeID = 0
+
+// Extension is a protocol extension negotiated in the extended handshake,
+// such as ut_pex or ut_metadata.
+type Extension interface {
+	// Name is the key of the extension in the handshake's m dictionary.
+	Name() string
+	// Handle processes a message the peer sent for the extension.
+	Handle(c *Client, payload []byte) error
+}
+
+// Extensions is the registry of extensions we offer to peers, along with the
+// other fields of our extended handshake. Extensions are numbered in the
+// order they are registered, which must happen before any peer connects.
+type Extensions struct {
+	Version      string // v: client name and version
+	Port         int    // p: our listen port, if any
+	MaxRequests  int    // reqq: outstanding requests we accept from a peer
+	MetadataSize int    // metadata_size: length of the info dictionary, if known
+	// V2 announces BitTorrent v2 (BEP 52) in the handshake's reserved
+	// bits, for v2 and hybrid torrents.
+	V2 bool
+
+	list []Extension
+}
+
+func (e *Extensions) Register(ext Extension) {
+	e.list = append(e.list, ext)
+}
+
+func (e *Extensions) lookup(id int) Extension {
+	if id < 1 || id > len(e.list) {
+		return nil
+	}
+	return e.list[id-1]
+}
+
+// handshake returns our extended handshake for a peer at ip.
+func (e *Extensions) handshake(ip net.IP) *ExtendedHandshake {
+	h := &ExtendedHandshake{
+		M:            make(map[string]int),
+		V:            e.Version,
+		P:            e.Port,
+		Reqq:         e.MaxRequests,
+		MetadataSize: e.MetadataSize,
+		YourIP:       ip,
+	}
+	for i, ext := range e.list {
+		h.M[ext.Name()] = i + 1
+	}
+	return h
+}
+
+// ExtendedHandshake is the dictionary exchanged as extended message 0.
+// Zero values are left out.
+type ExtendedHandshake struct {
+	M            map[string]int // extension names to the IDs the sender expects
+	V            string
+	P            int
+	Reqq         int
+	MetadataSize int
+	YourIP       net.IP // the receiver's address as seen by the sender
+}
+
+func (h *ExtendedHandshake) Serialize() ([]byte, error) {
+	m := make(map[string]interface{})
+	for name, id := range h.M {
+		m[name] = id
+	}
+	dict := map[string]interface{}{"m": m}
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.P > 0 {
+		dict["p"] = h.P
+	}
+	if h.Reqq > 0 {
+		dict["reqq"] = h.Reqq
+	}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+	if ip4 := h.YourIP.To4(); ip4 != nil {
+		dict["yourip"] = []byte(ip4)
+	} else if len(h.YourIP) == net.IPv6len {
+		dict["yourip"] = []byte(h.YourIP)
+	}
+	return bencode.Encode(dict)
+}
+
+func ParseExtendedHandshake(buf []byte) (*ExtendedHandshake, error) {
+	decoded, err := bencode.Decode(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	h := &ExtendedHandshake{M: make(map[string]int)}
+	if m, ok := dict["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if id, ok := id.(int); ok {
+				h.M[name] = id
+			}
+		}
+	}
+	h.V, _ = dict["v"].(string)
+	h.P, _ = dict["p"].(int)
+	h.Reqq, _ = dict["reqq"].(int)
+	h.MetadataSize, _ = dict["metadata_size"].(int)
+	if ip, ok := dict["yourip"].(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		h.YourIP = net.IP(ip)
+	}
+	return h, nil
+}
+
+func NewExtendedMessage(id int, payload []byte) *Message {
+	buf := make([]byte, len(payload)+1)
+	buf[0] = byte(id)
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtendedMessage splits the payload of an extended message into the
+// extended message ID and its own payload.
+func ParseExtendedMessage(buf []byte) (int, []byte, error) {
+	if len(buf) < 1 {
+		return 0, nil, fmt.Errorf("extended message has no ID")
+	}
+	return int(buf[0]), buf[1:], nil
+}
+
+// SupportsExtensions reports whether both sides announced the extension
+// protocol in their handshakes.
+func (c *Client) SupportsExtensions() bool {
+	return c.extensions != nil && c.peerReserved.HasBit(BitExtension)
+}
+
+// SupportsExtension reports whether the peer offered the named extension.
+func (c *Client) SupportsExtension(name string) bool {
+	return c.peerExtensions[name] != 0
+}
+
+// SendExtended sends payload as a message of the named extension, using the
+// ID the peer chose for it.
+func (c *Client) SendExtended(name string, payload []byte) error {
+	id := c.peerExtensions[name]
+	if id == 0 {
+		return fmt.Errorf("%s does not support %s", c, name)
+	}
+	return c.write(NewExtendedMessage(id, payload))
+}
+
+func (c *Client) sendExtendedHandshake() error {
+	var ip net.IP
+	if c.peer != nil {
+		ip = c.peer.IP
+	}
+	payload, err := c.extensions.handshake(ip).Serialize()
+	if err != nil {
+		return err
+	}
+	return c.write(NewExtendedMessage(extHandshakeID, payload))
+}
+
+// HandleExtended processes the payload of an extended message: the peer's
+// handshake updates the extensions it supports and its request limit, other
+// messages go to the registered extension they are addressed to. Messages
+// for unknown extensions are ignored.
+func (c *Client) HandleExtended(payload []byte) error {
+	id, body, err := ParseExtendedMessage(payload)
+	if err != nil {
+		return err
+	}
+	if id != extHandshakeID {
+		if c.extensions == nil {
+			return nil
+		}
+		ext := c.extensions.lookup(id)
+		if ext == nil {
+			return nil
+		}
+		return ext.Handle(c, body)
+	}
+
+	h, err := ParseExtendedHandshake(body)
+	if err != nil {
+		return err
+	}
+	if c.peerExtensions == nil {
+		c.peerExtensions = make(map[string]int)
+	}
+	// Later handshakes only update the extensions they mention, and ID 0
+	// disables one
+	for name, extID := range h.M {
+		if extID == 0 {
+			delete(c.peerExtensions, name)
+		} else {
+			c.peerExtensions[name] = extID
+		}
+	}
+	if h.Reqq > 0 {
+		c.MaxRequests = h.Reqq
+	}
+	c.Extended = h
+	return nil
+}
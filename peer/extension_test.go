@@ -0,0 +1,181 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+type testExtension struct {
+	received chan []byte
+}
+
+func (e *testExtension) Name() string {
+	return "ut_test"
+}
+
+func (e *testExtension) Handle(c *Client, payload []byte) error {
+	e.received <- payload
+	return nil
+}
+
+func TestReservedBits(t *testing.T) {
+	var r Reserved
+	r.SetBit(BitExtension)
+	r.SetBit(BitFast)
+	if r[5] != 0x10 || r[7] != 0x04 {
+		t.Errorf("Expected bytes 5 and 7 to be 0x10 and 0x04, got %x", r)
+	}
+	if !r.HasBit(BitExtension) || !r.HasBit(BitFast) || r.HasBit(BitDHT) {
+		t.Errorf("Unexpected bits in %x", r)
+	}
+
+	h := NewHandshake([20]byte{1}, [20]byte{2})
+	h.Reserved = r
+	parsed, err := ReadHandshake(bytes.NewReader(h.Serialize()))
+	if err != nil {
+		t.Fatalf("ReadHandshake failed: %v", err)
+	}
+	if parsed.Reserved != r {
+		t.Errorf("Expected reserved bytes %x, got %x", r, parsed.Reserved)
+	}
+}
+
+func TestExtendedHandshakeRoundTrip(t *testing.T) {
+	h := &ExtendedHandshake{
+		M:            map[string]int{"ut_pex": 1, "ut_metadata": 2},
+		V:            "test 1.0",
+		P:            6881,
+		Reqq:         250,
+		MetadataSize: 31235,
+		YourIP:       net.ParseIP("10.0.0.1"),
+	}
+	buf, err := h.Serialize()
+	if err != nil {
+		t.Fatalf("Serialize failed: %v", err)
+	}
+	parsed, err := ParseExtendedHandshake(buf)
+	if err != nil {
+		t.Fatalf("ParseExtendedHandshake failed: %v", err)
+	}
+	if parsed.M["ut_pex"] != 1 || parsed.M["ut_metadata"] != 2 {
+		t.Errorf("Expected m to round-trip, got %v", parsed.M)
+	}
+	if parsed.V != h.V || parsed.P != h.P || parsed.Reqq != h.Reqq || parsed.MetadataSize != h.MetadataSize {
+		t.Errorf("Expected %+v, got %+v", h, parsed)
+	}
+	if !parsed.YourIP.Equal(h.YourIP) {
+		t.Errorf("Expected yourip %s, got %s", h.YourIP, parsed.YourIP)
+	}
+}
+
+func TestExtendedHandshakeExchange(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	infoHash := [20]byte{1}
+	remote := make(chan *ExtendedHandshake, 1)
+	pings := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hs, err := ReadHandshake(conn)
+		if err != nil || !hs.Reserved.HasBit(BitExtension) {
+			return
+		}
+
+		reply := NewHandshake(infoHash, [20]byte{2})
+		reply.Reserved.SetBit(BitExtension)
+		conn.Write(reply.Serialize())
+		ours, _ := (&ExtendedHandshake{M: map[string]int{"ut_test": 3}, Reqq: 42}).Serialize()
+		conn.Write(NewExtendedMessage(0, ours).Serialize())
+		conn.Write((&Message{ID: MsgBitfield, Payload: []byte{0x80}}).Serialize())
+
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			if msg == nil || msg.ID != MsgExtended {
+				continue
+			}
+			id, payload, _ := ParseExtendedMessage(msg.Payload)
+			switch id {
+			case 0:
+				h, _ := ParseExtendedHandshake(payload)
+				remote <- h
+				conn.Write(NewExtendedMessage(h.M["ut_test"], []byte("hello")).Serialize())
+			case 3:
+				pings <- payload
+			}
+		}
+	}()
+
+	ext := &testExtension{received: make(chan []byte, 1)}
+	extensions := &Extensions{Version: "test", MaxRequests: 100}
+	extensions.Register(ext)
+
+	addr := ln.Addr().(*net.TCPAddr)
+	c, err := New(context.Background(), &Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{3}, Options{Extensions: extensions})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	if !c.SupportsExtensions() || !c.SupportsExtension("ut_test") {
+		t.Fatal("Expected the peer's extensions to be known after connecting")
+	}
+	if c.MaxRequests != 42 {
+		t.Errorf("Expected MaxRequests 42 from reqq, got %d", c.MaxRequests)
+	}
+	if !c.Bitfield.HasPiece(0) {
+		t.Error("Expected the bitfield after the extended handshake to be read")
+	}
+
+	c.SendBitfield(Bitfield{0})
+	select {
+	case h := <-remote:
+		if h.M["ut_test"] != 1 || h.V != "test" || h.Reqq != 100 {
+			t.Errorf("Unexpected extended handshake %+v", h)
+		}
+		if !h.YourIP.Equal(addr.IP) {
+			t.Errorf("Expected yourip %s, got %s", addr.IP, h.YourIP)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Extended handshake was not sent after the bitfield")
+	}
+
+	msg, err := c.Read()
+	if err != nil || msg == nil || msg.ID != MsgExtended {
+		t.Fatalf("Expected an extended message, got %v, %v", msg, err)
+	}
+	if err := c.HandleExtended(msg.Payload); err != nil {
+		t.Fatalf("HandleExtended failed: %v", err)
+	}
+	if payload := <-ext.received; string(payload) != "hello" {
+		t.Errorf("Expected the extension to receive hello, got %q", payload)
+	}
+
+	if err := c.SendExtended("ut_test", []byte("ping")); err != nil {
+		t.Fatalf("SendExtended failed: %v", err)
+	}
+	select {
+	case payload := <-pings:
+		if string(payload) != "ping" {
+			t.Errorf("Expected ping, got %q", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Extended message was not sent with the peer's ID")
+	}
+	if err := c.SendExtended("ut_other", nil); err == nil {
+		t.Error("Expected an error for an extension the peer does not support")
+	}
+}
@@ -0,0 +1,108 @@
+package peer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Messages of the fast extension (BEP 6).
+const (
+	MsgSuggest     MessageID = 0x0D
+	MsgHaveAll     MessageID = 0x0E
+	MsgHaveNone    MessageID = 0x0F
+	MsgReject      MessageID = 0x10
+	MsgAllowedFast MessageID = 0x11
+)
+
+// SupportsFast reports whether both sides announced the fast extension. The
+// messages above may only be exchanged if they did.
+func (c *Client) SupportsFast() bool {
+	return c.reserved.HasBit(BitFast) && c.peerReserved.HasBit(BitFast)
+}
+
+// checkFast rejects fast extension messages the peer may not send: any of
+// them if the extension was not negotiated, and HaveAll or HaveNone
+// anywhere but in place of the bitfield.
+func (c *Client) checkFast(msg *Message) error {
+	if msg == nil {
+		return nil
+	}
+	first := !c.announced
+	if msg.ID != MsgExtended {
+		c.announced = true
+	}
+	switch msg.ID {
+	case MsgSuggest, MsgHaveAll, MsgHaveNone, MsgReject, MsgAllowedFast:
+		if !c.SupportsFast() {
+			return fmt.Errorf("%s from %s without the fast extension", msg.Name(), c.peer)
+		}
+	}
+	if (msg.ID == MsgHaveAll || msg.ID == MsgHaveNone) && !first {
+		return fmt.Errorf("%s from %s after other messages", msg.Name(), c.peer)
+	}
+	return nil
+}
+
+// SendHaveAll tells the peer we have every piece, in place of a bitfield.
+func (c *Client) SendHaveAll() error {
+	return c.sendAvailability(&Message{ID: MsgHaveAll})
+}
+
+// SendHaveNone tells the peer we have no pieces, in place of a bitfield.
+func (c *Client) SendHaveNone() error {
+	return c.sendAvailability(&Message{ID: MsgHaveNone})
+}
+
+// SendReject tells the peer we will not serve one of its requests.
+func (c *Client) SendReject(index, begin, length int) error {
+	msg := NewRequestMessage(index, begin, length)
+	msg.ID = MsgReject
+	return c.write(msg)
+}
+
+// SendSuggest hints that the peer should download a piece from us.
+func (c *Client) SendSuggest(index int) error {
+	msg := NewHaveMessage(index)
+	msg.ID = MsgSuggest
+	return c.write(msg)
+}
+
+// SendAllowedFast lets the peer request a piece even while we choke it.
+func (c *Client) SendAllowedFast(index int) error {
+	msg := NewHaveMessage(index)
+	msg.ID = MsgAllowedFast
+	return c.write(msg)
+}
+
+// AllowedFastSet returns the k pieces a peer at ip may request from us while
+// choked, computed as in BEP 6 so that reconnecting does not earn the peer
+// a different set. Only IPv4 addresses are defined; other peers get none.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	seen := make(map[int]bool)
+	var set []int
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
@@ -0,0 +1,153 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// Example from BEP 6
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	ip := net.ParseIP("80.4.4.200")
+
+	testCases := []struct {
+		k        int
+		expected []int
+	}{
+		{7, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{9, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+	}
+	for _, tc := range testCases {
+		set := AllowedFastSet(ip, infoHash, 1313, tc.k)
+		if len(set) != len(tc.expected) {
+			t.Fatalf("Expected %d pieces, got %d", len(tc.expected), len(set))
+		}
+		for i := range set {
+			if set[i] != tc.expected[i] {
+				t.Errorf("Expected %v, got %v", tc.expected, set)
+				break
+			}
+		}
+	}
+
+	if set := AllowedFastSet(ip, infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("Expected the set to be limited to 3 pieces, got %v", set)
+	}
+	if set := AllowedFastSet(net.ParseIP("2001:db8::1"), infoHash, 1313, 10); len(set) != 0 {
+		t.Errorf("Expected no allowed fast set for IPv6, got %v", set)
+	}
+}
+
+// dialFastPeer connects to a peer that supports the fast extension and sends
+// the given messages after its handshake.
+func dialFastPeer(t *testing.T, msgs ...*Message) *Client {
+	return dialTestPeer(t, true, msgs...)
+}
+
+func dialTestPeer(t *testing.T, fast bool, msgs ...*Message) *Client {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	infoHash := [20]byte{1}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		if _, err := ReadHandshake(conn); err != nil {
+			return
+		}
+		reply := NewHandshake(infoHash, [20]byte{2})
+		if fast {
+			reply.Reserved.SetBit(BitFast)
+		}
+		conn.Write(reply.Serialize())
+		for _, msg := range msgs {
+			conn.Write(msg.Serialize())
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	c, err := New(context.Background(), &Peer{IP: addr.IP, Port: uint16(addr.Port)}, infoHash, [20]byte{3}, Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestNewAcceptsHaveAllAndHaveNone(t *testing.T) {
+	c := dialFastPeer(t, &Message{ID: MsgHaveAll})
+	if !c.SupportsFast() || !c.HasAll {
+		t.Errorf("Expected a fast peer with every piece, got fast %v, has all %v", c.SupportsFast(), c.HasAll)
+	}
+
+	c = dialFastPeer(t, &Message{ID: MsgHaveNone}, &Message{ID: MsgUnchoke})
+	if c.HasAll || len(c.Bitfield) != 0 {
+		t.Errorf("Expected a peer without pieces, got %x", c.Bitfield)
+	}
+	if msg, err := c.Read(); err != nil || msg == nil || msg.ID != MsgUnchoke {
+		t.Errorf("Expected the next message to be Unchoke, got %v, %v", msg, err)
+	}
+}
+
+func TestNewWithoutBitfieldKeepsFirstMessage(t *testing.T) {
+	c := dialFastPeer(t, NewHaveMessage(4))
+	if len(c.Bitfield) != 0 {
+		t.Errorf("Expected no pieces, got %x", c.Bitfield)
+	}
+	msg, err := c.Read()
+	if err != nil || msg == nil || msg.ID != MsgHave {
+		t.Fatalf("Expected the Have message to be kept, got %v, %v", msg, err)
+	}
+	if index, _ := ParseHaveMessage(msg.Payload); index != 4 {
+		t.Errorf("Expected piece 4, got %d", index)
+	}
+}
+
+func TestFastMessagesRequireNegotiation(t *testing.T) {
+	c := dialTestPeer(t, false, &Message{ID: MsgHaveAll})
+	if c.SupportsFast() || c.HasAll {
+		t.Errorf("Expected HaveAll to be ignored without the fast extension, got fast %v, has all %v", c.SupportsFast(), c.HasAll)
+	}
+	if _, err := c.Read(); err == nil {
+		t.Error("Expected an error for HaveAll without the fast extension")
+	}
+
+	allowed := NewHaveMessage(2)
+	allowed.ID = MsgAllowedFast
+	c = dialTestPeer(t, false, &Message{ID: MsgBitfield, Payload: []byte{0x80}}, allowed)
+	if _, err := c.Read(); err == nil {
+		t.Error("Expected an error for AllowedFast without the fast extension")
+	}
+}
+
+func TestHaveAllOnlyInPlaceOfBitfield(t *testing.T) {
+	testCases := []struct {
+		name  string
+		first *Message
+		late  *Message
+	}{
+		{"HaveAll after bitfield", &Message{ID: MsgBitfield, Payload: []byte{0x80}}, &Message{ID: MsgHaveAll}},
+		{"HaveNone after HaveAll", &Message{ID: MsgHaveAll}, &Message{ID: MsgHaveNone}},
+		{"HaveAll after unchoke", &Message{ID: MsgUnchoke}, &Message{ID: MsgHaveAll}},
+	}
+	for _, tc := range testCases {
+		c := dialFastPeer(t, tc.first, tc.late)
+		if tc.first.ID == MsgUnchoke {
+			if msg, err := c.Read(); err != nil || msg == nil || msg.ID != MsgUnchoke {
+				t.Fatalf("%s: Expected Unchoke, got %v, %v", tc.name, msg, err)
+			}
+		}
+		if _, err := c.Read(); err == nil {
+			t.Errorf("%s: Expected an error", tc.name)
+		}
+	}
+}
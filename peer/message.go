@@ -27,10 +27,30 @@ type Message struct {
 
 type Handshake struct {
 	Pstr     string
+	Reserved Reserved
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// Reserved holds the feature bits of a handshake.
+type Reserved [8]byte
+
+// Reserved bits, counted from the right as in the BEPs.
+const (
+	BitDHT       = 0  // BEP 5
+	BitFast      = 2  // BEP 6
+	BitV2        = 4  // BEP 52
+	BitExtension = 20 // BEP 10
+)
+
+func (r *Reserved) SetBit(bit int) {
+	r[7-bit/8] |= 1 << (bit % 8)
+}
+
+func (r Reserved) HasBit(bit int) bool {
+	return r[7-bit/8]&(1<<(bit%8)) != 0
+}
+
 type Bitfield []byte
 
 func NewHandshake(infoHash, peerID [20]byte) *Handshake {
@@ -46,7 +66,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -70,12 +90,15 @@ func ReadHandshake(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved Reserved
 	var infoHash, peerID [20]byte
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:pstrlen+8+40])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -91,6 +114,14 @@ func NewRequestMessage(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+func NewCancelMessage(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgCancel, Payload: payload}
+}
+
 func NewHaveMessage(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
@@ -169,6 +200,18 @@ func (m *Message) Name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -205,6 +248,17 @@ func ParsePieceMessage(index int, buf []byte) (int, []byte, error) {
 	return begin, block, nil
 }
 
+// ParseRequestMessage parses the payload of a Request or Cancel message.
+func ParseRequestMessage(buf []byte) (index, begin, length int, err error) {
+	if len(buf) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(buf))
+	}
+	index = int(binary.BigEndian.Uint32(buf[0:4]))
+	begin = int(binary.BigEndian.Uint32(buf[4:8]))
+	length = int(binary.BigEndian.Uint32(buf[8:12]))
+	return index, begin, length, nil
+}
+
 func ParseHaveMessage(buf []byte) (int, error) {
 	if len(buf) != 4 {
 		return 0, fmt.Errorf("expected payload length 4, got length %d", len(buf))
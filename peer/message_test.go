@@ -78,6 +78,7 @@ func TestMessageRoundTrip(t *testing.T) {
 		{ID: MsgNotInterested, Payload: []byte{}},
 		NewHaveMessage(42),
 		NewRequestMessage(1, 0, 16384),
+		NewCancelMessage(1, 16384, 16384),
 	}
 
 	for _, original := range tests {
@@ -199,3 +200,19 @@ func TestMessageName(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRequestMessage(t *testing.T) {
+	for _, msg := range []*Message{NewRequestMessage(7, 16384, 1000), NewCancelMessage(7, 16384, 1000)} {
+		index, begin, length, err := ParseRequestMessage(msg.Payload)
+		if err != nil {
+			t.Fatalf("ParseRequestMessage failed: %v", err)
+		}
+		if index != 7 || begin != 16384 || length != 1000 {
+			t.Errorf("Expected (7, 16384, 1000), got (%d, %d, %d)", index, begin, length)
+		}
+	}
+
+	if _, _, _, err := ParseRequestMessage(make([]byte, 8)); err == nil {
+		t.Error("Expected error for short payload, got nil")
+	}
+}
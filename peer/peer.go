@@ -1,18 +1,54 @@
 package peer
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
+
+	"torrent-client/mse"
 )
 
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield Bitfield
-	peer     *Peer
-	infoHash [20]byte
-	peerID   [20]byte
+	// MaxRequests is the number of outstanding requests the peer accepts
+	// (reqq), or 0 if it did not say.
+	MaxRequests int
+	// AmInterested is whether we told the peer we want to download from it.
+	AmInterested bool
+	// AmChoking and PeerInterested describe the other direction: whether we
+	// refuse to upload to the peer, and whether it wants to download from us.
+	AmChoking      bool
+	PeerInterested bool
+	// Extended is the peer's latest extended handshake, if it sent one.
+	Extended *ExtendedHandshake
+	// HasAll is set if the peer announced every piece with HaveAll. The
+	// peer package does not know the number of pieces, so Bitfield is left
+	// for the caller to fill.
+	HasAll bool
+	// AllowedFast holds the pieces the peer lets us request while it
+	// chokes us.
+	AllowedFast map[int]bool
+	// Encrypted is whether the connection is RC4 encrypted (MSE).
+	Encrypted bool
+
+	peer           *Peer
+	infoHash       [20]byte
+	peerID         [20]byte
+	writeMu        sync.Mutex
+	extensions     *Extensions
+	reserved       Reserved // the features we announced
+	peerReserved   Reserved
+	peerExtensions map[string]int // extension names to the peer's message IDs
+	sentExtended   bool
+	outgoing       bool
+	pending        *Message // read ahead while waiting for the bitfield
+	announced      bool     // the peer's first message after the handshakes was read
 }
 
 type Peer struct {
@@ -21,42 +57,133 @@ type Peer struct {
 }
 
 func (p *Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
-func New(peer *Peer, infoHash, peerID [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// New connects to peer and completes the handshakes. Each step gives up
+// when ctx is done, or after a few seconds if ctx has no deadline.
+func New(ctx context.Context, peer *Peer, infoHash, peerID [20]byte, opts Options) (*Client, error) {
+	if opts.Dialer == nil {
+		opts.Dialer = TCP
+	}
+	if opts.Encryption != mse.Disabled {
+		c, err := connect(ctx, peer, infoHash, peerID, opts, opts.Encryption.Provide())
+		if err == nil || opts.Encryption == mse.Required || ctx.Err() != nil {
+			return c, err
+		}
+	}
+	return connect(ctx, peer, infoHash, peerID, opts, 0)
+}
+
+// connect dials peer and completes the handshakes. Unless provide is 0, the
+// connection is encrypted with one of the crypto methods it holds first.
+func connect(ctx context.Context, peer *Peer, infoHash, peerID [20]byte, opts Options, provide uint32) (*Client, error) {
+	conn, err := opts.Dialer.DialContext(ctx, peer.String())
 	if err != nil {
 		return nil, err
 	}
+	if provide != 0 {
+		stop := watch(ctx, conn, deadline(ctx, encryptionTimeout))
+		encrypted, _, err := mse.Initiate(conn, infoHash, provide)
+		stop()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("encryption handshake with %s failed: %w", peer, err)
+		}
+		conn = encrypted
+	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	c, err := NewWithConn(ctx, conn, infoHash, peerID, opts.Extensions)
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed handshake with %s: %w", peer, err)
+		return nil, err
 	}
+	c.peer = peer
+	return c, nil
+}
 
-	bf, err := recvBitfield(conn)
+// NewWithConn completes the handshakes on conn, a connection we opened to a
+// peer by any means and possibly encrypted already. ext lists the
+// extensions to offer, or is nil. The caller closes conn if it fails.
+func NewWithConn(ctx context.Context, conn net.Conn, infoHash, peerID [20]byte, ext *Extensions) (*Client, error) {
+	c := newClient(conn, peerFromAddr(conn.RemoteAddr()), infoHash, peerID, ext)
+	c.outgoing = true
+	res, err := CompleteHandshake(ctx, conn, c.handshake())
 	if err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("failed to receive bitfield from %s: %w", peer, err)
+		return nil, fmt.Errorf("failed handshake with %s: %w", c.peer, err)
 	}
+	c.peerReserved = res.Reserved
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
-	}, nil
+	err = c.recvAvailability(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive bitfield from %s: %w", c.peer, err)
+	}
+	return c, nil
 }
 
-func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*Handshake, error) {
+// Accept completes the handshake of a connection that a remote peer opened to
+// us. The caller has already read the remote handshake hs and decided to
+// serve the torrent it asks for. Unlike New, Accept does not wait for the
+// peer's bitfield, since the peer may itself be waiting for ours; it arrives
+// through Read like any other message.
+func Accept(conn net.Conn, hs *Handshake, peerID [20]byte, ext *Extensions) (*Client, error) {
+	peer := peerFromAddr(conn.RemoteAddr())
+	c := newClient(conn, peer, hs.InfoHash, peerID, ext)
+	c.peerReserved = hs.Reserved
+
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
-	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+	_, err := conn.Write(c.handshake().Serialize())
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("failed handshake with %s: %w", peer, err)
+	}
+	return c, nil
+}
+
+func newClient(conn net.Conn, peer *Peer, infoHash, peerID [20]byte, ext *Extensions) *Client {
+	_, encrypted := conn.(*mse.Conn)
+	c := &Client{
+		Encrypted:  encrypted,
+		Conn:       conn,
+		Choked:     true,
+		AmChoking:  true,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		extensions: ext,
+	}
+	c.reserved.SetBit(BitFast)
+	if ext != nil {
+		c.reserved.SetBit(BitExtension)
+		if ext.V2 {
+			c.reserved.SetBit(BitV2)
+		}
+	}
+	return c
+}
+
+// handshake returns our handshake, announcing the features we support.
+func (c *Client) handshake() *Handshake {
+	h := NewHandshake(c.infoHash, c.peerID)
+	h.Reserved = c.reserved
+	return h
+}
+
+func peerFromAddr(addr net.Addr) *Peer {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return &Peer{}
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return &Peer{IP: net.ParseIP(host), Port: uint16(port)}
+}
+
+// CompleteHandshake sends req and reads the peer's handshake, which must be for the
+// same torrent. It gives up when ctx is done, or after a few seconds if ctx
+// has no deadline.
+func CompleteHandshake(ctx context.Context, conn net.Conn, req *Handshake) (*Handshake, error) {
+	defer watch(ctx, conn, deadline(ctx, handshakeTimeout))()
 
-	req := NewHandshake(infohash, peerID)
 	_, err := conn.Write(req.Serialize())
 	if err != nil {
 		return nil, err
@@ -67,66 +194,168 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*Handshake, er
 		return nil, err
 	}
 
-	if res.InfoHash != infohash {
-		return nil, fmt.Errorf("expected infohash %x but got %x", infohash, res.InfoHash)
+	if res.InfoHash != req.InfoHash {
+		return nil, fmt.Errorf("expected infohash %x but got %x", req.InfoHash, res.InfoHash)
 	}
 
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// How long New waits for the peer to announce its pieces, unless ctx ends
+// sooner. Peers without pieces may not announce anything.
+const availabilityTimeout = 5 * time.Second
 
-	msg, err := ReadMessage(conn)
-	if err != nil {
-		return nil, err
+// recvAvailability reads the message announcing the peer's pieces: a
+// bitfield, or with the fast extension HaveAll or HaveNone. An extended
+// handshake sent ahead of it is processed on the way. If the peer sends
+// another message first, or nothing at all, it is taken to have no pieces
+// and the message is kept for Read.
+func (c *Client) recvAvailability(ctx context.Context) error {
+	t := time.Now().Add(availabilityTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(t) {
+		t = d
 	}
+	defer watch(ctx, c.Conn, t)()
 
-	if msg == nil {
-		return nil, fmt.Errorf("expected bitfield but got keep-alive")
-	}
+	for {
+		r := &countingReader{r: c.Conn}
+		msg, err := ReadMessage(r)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && r.n == 0 && ctx.Err() == nil {
+				return nil
+			}
+			return err
+		}
 
-	if msg.ID != MsgBitfield {
-		return nil, fmt.Errorf("expected bitfield but got ID %d", msg.ID)
+		switch {
+		case msg == nil:
+			continue
+		case msg.ID == MsgExtended && c.SupportsExtensions():
+			if err := c.HandleExtended(msg.Payload); err != nil {
+				return err
+			}
+			continue
+		}
+		c.announced = true
+		switch {
+		case msg.ID == MsgBitfield:
+			c.Bitfield = msg.Payload
+		case msg.ID == MsgHaveAll && c.SupportsFast():
+			c.HasAll = true
+		case msg.ID == MsgHaveNone && c.SupportsFast():
+		default:
+			c.pending = msg
+		}
+		return nil
 	}
+}
+
+// countingReader counts the bytes read, so a timeout can be told apart from
+// a message cut in half.
+type countingReader struct {
+	r io.Reader
+	n int
+}
 
-	return msg.Payload, nil
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
+
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+func (c *Client) String() string {
+	return c.peer.String()
+}
+
+// Addr returns the address of the peer's end of the connection.
+func (c *Client) Addr() Peer {
+	return *c.peer
+}
+
+// Outgoing reports whether we opened the connection.
+func (c *Client) Outgoing() bool {
+	return c.outgoing
 }
 
 func (c *Client) Read() (*Message, error) {
-	msg, err := ReadMessage(c.Conn)
-	return msg, err
+	msg := c.pending
+	c.pending = nil
+	if msg == nil {
+		var err error
+		msg, err = ReadMessage(c.Conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkFast(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-func (c *Client) SendRequest(index, begin, length int) error {
-	req := NewRequestMessage(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
+// write sends msg. It is safe to call from several goroutines.
+func (c *Client) write(msg *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.write(NewRequestMessage(index, begin, length))
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	return c.write(NewCancelMessage(index, begin, length))
+}
+
 func (c *Client) SendInterested() error {
-	msg := Message{ID: MsgInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.AmInterested = true
+	return c.write(&Message{ID: MsgInterested})
 }
 
 func (c *Client) SendNotInterested() error {
-	msg := Message{ID: MsgNotInterested}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.AmInterested = false
+	return c.write(&Message{ID: MsgNotInterested})
+}
+
+func (c *Client) SendChoke() error {
+	c.AmChoking = true
+	return c.write(&Message{ID: MsgChoke})
 }
 
 func (c *Client) SendUnchoke() error {
-	msg := Message{ID: MsgUnchoke}
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	c.AmChoking = false
+	return c.write(&Message{ID: MsgUnchoke})
 }
 
 func (c *Client) SendHave(index int) error {
-	msg := NewHaveMessage(index)
-	_, err := c.Conn.Write(msg.Serialize())
-	return err
+	return c.write(NewHaveMessage(index))
+}
+
+// SendBitfield sends our pieces, followed by our extended handshake if the
+// peer supports the extension protocol.
+func (c *Client) SendBitfield(bf Bitfield) error {
+	return c.sendAvailability(&Message{ID: MsgBitfield, Payload: bf})
+}
+
+// sendAvailability sends msg, which announces our pieces, and our extended
+// handshake after it.
+func (c *Client) sendAvailability(msg *Message) error {
+	err := c.write(msg)
+	if err != nil || !c.SupportsExtensions() || c.sentExtended {
+		return err
+	}
+	c.sentExtended = true
+	return c.sendExtendedHandshake()
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	return c.write(NewPieceMessage(index, begin, block))
 }
 
 func (c *Client) Close() error {
@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Messages of BitTorrent v2 (BEP 52) for exchanging the hashes of merkle
+// trees.
+const (
+	MsgHashRequest MessageID = 21
+	MsgHashes      MessageID = 22
+	MsgHashReject  MessageID = 23
+)
+
+// HashRequest asks for Length hashes of the tree of the file with
+// PiecesRoot, starting at Index in BaseLayer (0 being the blocks), followed
+// by ProofLayers uncle hashes.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
+
+const hashRequestLen = 48
+
+// SupportsV2 reports whether both sides announced BitTorrent v2, which the
+// messages above require.
+func (c *Client) SupportsV2() bool {
+	return c.extensions != nil && c.extensions.V2 && c.peerReserved.HasBit(BitV2)
+}
+
+func (r HashRequest) message(id MessageID, hashes [][32]byte) *Message {
+	payload := make([]byte, hashRequestLen, hashRequestLen+32*len(hashes))
+	copy(payload, r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:], uint32(r.ProofLayers))
+	for _, h := range hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: id, Payload: payload}
+}
+
+// SendHashRequest asks the peer for hashes.
+func (c *Client) SendHashRequest(r HashRequest) error {
+	return c.write(r.message(MsgHashRequest, nil))
+}
+
+// SendHashes answers a request with the hashes and their uncle hashes.
+func (c *Client) SendHashes(r HashRequest, hashes [][32]byte) error {
+	return c.write(r.message(MsgHashes, hashes))
+}
+
+// SendHashReject tells the peer we will not answer a request.
+func (c *Client) SendHashReject(r HashRequest) error {
+	return c.write(r.message(MsgHashReject, nil))
+}
+
+// ParseHashRequest parses the payload of a hash request or hash reject.
+func ParseHashRequest(payload []byte) (HashRequest, error) {
+	r, _, err := ParseHashes(payload)
+	if err == nil && len(payload) != hashRequestLen {
+		err = fmt.Errorf("hash request of %d bytes", len(payload))
+	}
+	return r, err
+}
+
+// ParseHashes parses the payload of a hashes message.
+func ParseHashes(payload []byte) (HashRequest, [][32]byte, error) {
+	if len(payload) < hashRequestLen || (len(payload)-hashRequestLen)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("invalid hashes payload of %d bytes", len(payload))
+	}
+	var r HashRequest
+	copy(r.PiecesRoot[:], payload)
+	r.BaseLayer = int(binary.BigEndian.Uint32(payload[32:]))
+	r.Index = int(binary.BigEndian.Uint32(payload[36:]))
+	r.Length = int(binary.BigEndian.Uint32(payload[40:]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(payload[44:]))
+
+	hashes := make([][32]byte, (len(payload)-hashRequestLen)/32)
+	for i := range hashes {
+		copy(hashes[i][:], payload[hashRequestLen+32*i:])
+	}
+	return r, hashes, nil
+}
@@ -0,0 +1,72 @@
+package peer
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHashMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := newClient(local, &Peer{}, [20]byte{1}, [20]byte{2}, &Extensions{V2: true})
+
+	req := HashRequest{PiecesRoot: [32]byte{9, 8, 7}, BaseLayer: 1, Index: 4, Length: 4, ProofLayers: 2}
+	hashes := [][32]byte{{1}, {2}, {3}, {4}, {5}, {6}}
+	go func() {
+		c.SendHashRequest(req)
+		c.SendHashes(req, hashes)
+		c.SendHashReject(req)
+	}()
+
+	for _, id := range []MessageID{MsgHashRequest, MsgHashes, MsgHashReject} {
+		msg, err := ReadMessage(remote)
+		if err != nil {
+			t.Fatalf("ReadMessage failed: %v", err)
+		}
+		if msg.ID != id {
+			t.Fatalf("Expected message %d, got %d", id, msg.ID)
+		}
+		if id == MsgHashes {
+			parsed, got, err := ParseHashes(msg.Payload)
+			if err != nil || parsed != req || !reflect.DeepEqual(got, hashes) {
+				t.Errorf("Expected %+v with %d hashes, got %+v with %d (%v)", req, len(hashes), parsed, len(got), err)
+			}
+			if _, err := ParseHashRequest(msg.Payload); err == nil {
+				t.Error("Expected a hash request with hashes to be refused")
+			}
+			continue
+		}
+		if parsed, err := ParseHashRequest(msg.Payload); err != nil || parsed != req {
+			t.Errorf("Expected %+v, got %+v (%v)", req, parsed, err)
+		}
+	}
+
+	if _, _, err := ParseHashes(make([]byte, 50)); err == nil {
+		t.Error("Expected a truncated hash to be refused")
+	}
+}
+
+func TestSupportsV2(t *testing.T) {
+	tests := []struct {
+		ours, theirs bool
+		expected     bool
+	}{
+		{true, true, true},
+		{true, false, false},
+		{false, true, false},
+	}
+	for _, tt := range tests {
+		c := newClient(nil, &Peer{}, [20]byte{}, [20]byte{}, &Extensions{V2: tt.ours})
+		if tt.theirs {
+			c.peerReserved.SetBit(BitV2)
+		}
+		if c.SupportsV2() != tt.expected {
+			t.Errorf("SupportsV2 with ours %v and theirs %v: expected %v", tt.ours, tt.theirs, tt.expected)
+		}
+		if tt.ours && !c.handshake().Reserved.HasBit(BitV2) {
+			t.Error("Expected the handshake to announce v2")
+		}
+	}
+}
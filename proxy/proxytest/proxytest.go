@@ -0,0 +1,299 @@
+// Package proxytest provides minimal SOCKS5 and HTTP CONNECT proxies on
+// loopback for tests.
+package proxytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Server is a proxy listening on loopback. It records the destinations
+// clients asked for.
+type Server struct {
+	// Addr is the host:port of the proxy.
+	Addr     string
+	Username string
+	Password string
+
+	ln      net.Listener
+	mu      sync.Mutex
+	targets []string
+}
+
+// NewSOCKS5 starts a SOCKS5 proxy that supports CONNECT and UDP ASSOCIATE.
+// With a username it requires password authentication. It is closed when
+// the test ends.
+func NewSOCKS5(t testing.TB, username, password string) *Server {
+	s := newServer(t, username, password)
+	go s.serve(s.handleSOCKS5)
+	return s
+}
+
+// NewHTTP starts an HTTP proxy that supports CONNECT. With a username it
+// requires basic authentication.
+func NewHTTP(t testing.TB, username, password string) *Server {
+	s := newServer(t, username, password)
+	go s.serve(s.handleHTTP)
+	return s
+}
+
+func newServer(t testing.TB, username, password string) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return &Server{Addr: ln.Addr().String(), Username: username, Password: password, ln: ln}
+}
+
+// Targets returns the destinations requested so far.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *Server) record(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = append(s.targets, target)
+}
+
+func (s *Server) serve(handle func(net.Conn)) {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handleSOCKS5(conn net.Conn) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if s.Username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !s.readPassword(conn) {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	target, err := readAddr(conn)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case 1:
+		s.record(target)
+		remote, err := net.Dial("tcp", target)
+		if err != nil {
+			conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remote.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		pipe(conn, remote)
+	case 3:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		reply := []byte{5, 0, 0, 1, 127, 0, 0, 1}
+		conn.Write(binary.BigEndian.AppendUint16(reply, uint16(port)))
+		go s.relayUDP(relay)
+		// The association ends with the control connection
+		io.Copy(io.Discard, conn)
+	default:
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func (s *Server) readPassword(conn net.Conn) bool {
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return false
+	}
+	user := make([]byte, version[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return false
+	}
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(conn, n); err != nil {
+		return false
+	}
+	pass := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return false
+	}
+	return string(user) == s.Username && string(pass) == s.Password
+}
+
+// relayUDP forwards datagrams from the client to their destination and the
+// replies back, with a SOCKS5 header naming the remote end.
+func (s *Server) relayUDP(relay net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			if n < 4 || buf[2] != 0 {
+				continue
+			}
+			r := &sliceReader{buf: buf[3:n]}
+			target, err := readAddr(r)
+			if err != nil {
+				continue
+			}
+			addr, err := net.ResolveUDPAddr("udp", target)
+			if err != nil {
+				continue
+			}
+			s.record("udp/" + target)
+			relay.WriteTo(r.buf, addr)
+			continue
+		}
+
+		udp := from.(*net.UDPAddr)
+		reply := []byte{0, 0, 0, 1}
+		if ip4 := udp.IP.To4(); ip4 != nil {
+			reply = append(reply, ip4...)
+		} else {
+			reply[3] = 4
+			reply = append(reply, udp.IP.To16()...)
+		}
+		reply = binary.BigEndian.AppendUint16(reply, uint16(udp.Port))
+		relay.WriteTo(append(reply, buf[:n]...), client)
+	}
+}
+
+func (s *Server) handleHTTP(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	if req.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return
+	}
+	if s.Username != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password))
+		if req.Header.Get("Proxy-Authorization") != expected {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+	s.record(req.Host)
+	remote, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	defer remote.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	pipe(&bufferedConn{Conn: conn, r: br}, remote)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// pipe copies between a and b until either side is done.
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if atyp[0] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+type sliceReader struct {
+	buf []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
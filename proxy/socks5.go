@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const socksVersion = 5
+
+// SOCKS5 commands, authentication methods and address types.
+const (
+	cmdConnect      = 1
+	cmdUDPAssociate = 3
+
+	authNone     = 0x00
+	authPassword = 0x02
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+var socksErrors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksRequest authenticates on conn and sends a request, returning the
+// address the proxy bound for it.
+func (p *Proxy) socksRequest(conn net.Conn, cmd byte, addr string) (string, error) {
+	if err := p.socksAuth(conn); err != nil {
+		return "", err
+	}
+
+	target, err := appendAddr([]byte{socksVersion, cmd, 0}, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(target); err != nil {
+		return "", err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", err
+	}
+	if reply[0] != socksVersion {
+		return "", fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	if reply[1] != 0 {
+		reason, ok := socksErrors[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("error %d", reply[1])
+		}
+		return "", fmt.Errorf("SOCKS5 request failed: %s", reason)
+	}
+	return readAddr(conn)
+}
+
+// socksAuth negotiates the authentication method and logs in if needed.
+func (p *Proxy) socksAuth(conn net.Conn) error {
+	greeting := []byte{socksVersion, 1, authNone}
+	if p.Username != "" {
+		greeting = []byte{socksVersion, 2, authNone, authPassword}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+
+	switch reply[1] {
+	case authNone:
+		return nil
+	case authPassword:
+		if p.Username == "" {
+			return errors.New("SOCKS5 proxy requires a username and password")
+		}
+		if len(p.Username) > 255 || len(p.Password) > 255 {
+			return errors.New("SOCKS5 username or password too long")
+		}
+		req := []byte{1, byte(len(p.Username))}
+		req = append(req, p.Username...)
+		req = append(req, byte(len(p.Password)))
+		req = append(req, p.Password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+		return nil
+	default:
+		return errors.New("SOCKS5 proxy accepts none of our authentication methods")
+	}
+}
+
+// appendAddr appends host:port in SOCKS5 format: an address type, the
+// address and the port.
+func appendAddr(buf []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %q", host)
+		}
+		buf = append(buf, atypDomain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, atypIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, atypIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port)), nil
+}
+
+// readAddr reads an address in SOCKS5 format.
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case atypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// DialUDP returns a connection whose reads and writes are datagrams
+// exchanged with addr through a SOCKS5 UDP relay. The proxy resolves addr.
+func (p *Proxy) DialUDP(ctx context.Context, addr string) (net.Conn, error) {
+	if p.Type != SOCKS5 {
+		return nil, errUDPUnsupported
+	}
+	header, err := appendAddr([]byte{0, 0, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The association lasts as long as the control connection
+	control, err := p.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := watch(ctx, control)
+	relayAddr, err := p.socksRequest(control, cmdUDPAssociate, "0.0.0.0:0")
+	stop()
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("proxy %s refused UDP: %w", p, err)
+	}
+
+	relay, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the proxy's own address
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	c := &udpConn{UDPConn: conn, control: control, header: header}
+	go c.watchControl()
+	return c, nil
+}
+
+// udpConn sends datagrams through a SOCKS5 UDP relay.
+type udpConn struct {
+	*net.UDPConn
+	control   net.Conn
+	header    []byte // prepended to every datagram
+	closeOnce sync.Once
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	_, err := c.UDPConn.Write(append(append([]byte(nil), c.header...), p...))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns the payload of the next datagram, without the relay's
+// header.
+func (c *udpConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		payload, ok := parseDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+		return copy(p, payload), nil
+	}
+}
+
+func (c *udpConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.control.Close()
+		err = c.UDPConn.Close()
+	})
+	return err
+}
+
+// watchControl closes the connection when the proxy ends the association.
+func (c *udpConn) watchControl() {
+	io.Copy(io.Discard, c.control)
+	c.Close()
+}
+
+// parseDatagram strips the SOCKS5 UDP header. Fragments are not supported
+// and dropped.
+func parseDatagram(buf []byte) ([]byte, bool) {
+	if len(buf) < 4 || buf[2] != 0 {
+		return nil, false
+	}
+	r := bytes.NewReader(buf[3:])
+	if _, err := readAddr(r); err != nil {
+		return nil, false
+	}
+	return buf[len(buf)-r.Len():], true
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+import "net"
+
+// Conn limits the rate of reads and writes on a connection. Reads wait for
+// every limiter in read after the data arrived, writes wait for every limiter
+// in write before sending.
+type Conn struct {
+	net.Conn
+	read  []*Limiter
+	write []*Limiter
+}
+
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+	return &Conn{Conn: conn, read: read, write: write}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := c.Conn.Read(p)
+	WaitAll(n, c.read)
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		end := written + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		WaitAll(end-written, c.write)
+		n, err := c.Conn.Write(p[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// chunk is the largest amount of data a single wait covers. Larger reads
+// and writes are split so that a bucket never needs more than its burst.
+const chunk = 16 << 10
+
+// How often waiters re-check a bucket, so rate changes apply promptly.
+const pollInterval = 50 * time.Millisecond
+
+// Limiter is a token bucket limiting a transfer rate in bytes per second. The
+// zero value is unlimited. Rates can be changed at any time, also while
+// transfers are waiting.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter for rate bytes per second, or an unlimited one
+// if rate is 0.
+func NewLimiter(rate int64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate)
+	return l
+}
+
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+// Rate returns the limit in bytes per second, or 0 if unlimited.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// burst must be called with l.mu held. A quarter second of transfer is
+// allowed at once, but never less than one chunk.
+func (l *Limiter) burst() float64 {
+	burst := float64(l.rate) / 4
+	if burst < chunk {
+		burst = chunk
+	}
+	return burst
+}
+
+// take removes n tokens from the bucket if it has them. Otherwise it returns
+// how long it will take until it does.
+func (l *Limiter) take(n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if burst := l.burst(); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	if l.tokens >= float64(n) {
+		l.tokens -= float64(n)
+		return true, 0
+	}
+	missing := float64(n) - l.tokens
+	return false, time.Duration(missing / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be transferred. n must not exceed one chunk.
+func (l *Limiter) Wait(n int) {
+	for {
+		ok, delay := l.take(n)
+		if ok {
+			return
+		}
+		if delay > pollInterval {
+			delay = pollInterval
+		}
+		time.Sleep(delay)
+	}
+}
+
+// WaitAll waits for n bytes on every limiter in turn. Nil limiters are
+// skipped.
+func WaitAll(n int, limiters []*Limiter) {
+	for _, l := range limiters {
+		if l != nil {
+			l.Wait(n)
+		}
+	}
+}
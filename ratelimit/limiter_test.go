@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(4 * chunk) // burst is one chunk
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		l.Wait(chunk)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 800*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("Expected about 1s for 4 chunks beyond the burst, took %s", elapsed)
+	}
+}
+
+func TestLimiterZeroValueIsUnlimited(t *testing.T) {
+	var l Limiter
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.Wait(chunk)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected no waiting, took %s", elapsed)
+	}
+}
+
+func TestLimiterRateChangeReleasesWaiters(t *testing.T) {
+	l := NewLimiter(1)
+	l.Wait(chunk) // drain the burst
+
+	done := make(chan struct{})
+	go func() {
+		l.Wait(chunk)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the waiter to finish after lifting the limit")
+	}
+}
+
+func TestConnLimitsWrites(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := server.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	global := NewLimiter(8 * chunk)
+	perPeer := NewLimiter(4 * chunk)
+	conn := NewConn(client, nil, []*Limiter{perPeer, global})
+
+	start := time.Now()
+	n, err := conn.Write(make([]byte, 5*chunk))
+	if err != nil || n != 5*chunk {
+		t.Fatalf("Write returned %d, %v", n, err)
+	}
+	// The slower per-peer limit applies
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Errorf("Expected the per-peer limit to slow the write down, took %s", elapsed)
+	}
+}
@@ -0,0 +1,143 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var units = []struct {
+	suffix string
+	size   int64
+}{
+	{"kib", 1 << 10},
+	{"mib", 1 << 20},
+	{"gib", 1 << 30},
+	{"kb", 1000},
+	{"mb", 1000 * 1000},
+	{"gb", 1000 * 1000 * 1000},
+	{"k", 1 << 10},
+	{"m", 1 << 20},
+	{"g", 1 << 30},
+	{"b", 1},
+}
+
+// ParseRate parses a rate such as "5MiB/s", "500KB/s" or "1048576" into bytes
+// per second. "0" and "unlimited" mean no limit.
+func ParseRate(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	if v == "unlimited" {
+		return 0, nil
+	}
+	v = strings.TrimSuffix(v, "/s")
+
+	size := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSuffix(v, u.suffix)
+			size = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(n * float64(size)), nil
+}
+
+// ScheduleRule sets the rates in effect during a daily time window. Windows
+// that end before they start wrap around midnight.
+type ScheduleRule struct {
+	Start    time.Duration // since midnight
+	End      time.Duration
+	Download int64
+	Upload   int64
+}
+
+// Schedule is a list of rules, the first matching of which applies.
+type Schedule []ScheduleRule
+
+// ParseSchedule parses comma-separated rules of the form
+// "HH:MM-HH:MM=download/upload", e.g. "22:00-07:00=0/0,09:00-18:00=1MiB/s/256KiB/s".
+// Rates use the format of ParseRate.
+func ParseSchedule(s string) (Schedule, error) {
+	var schedule Schedule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		window, rates, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("schedule entry %q has no rates", entry)
+		}
+		from, to, ok := strings.Cut(window, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time window %q", window)
+		}
+		start, err := parseClock(from)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(to)
+		if err != nil {
+			return nil, err
+		}
+		download, upload, err := parseRatePair(rates)
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, ScheduleRule{start, end, download, upload})
+	}
+	return schedule, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseRatePair splits "download/upload", where either rate may itself end
+// in "/s".
+func parseRatePair(s string) (int64, int64, error) {
+	parts := strings.Split(s, "/")
+	var rates []string
+	for _, part := range parts {
+		if strings.EqualFold(strings.TrimSpace(part), "s") && len(rates) > 0 {
+			continue
+		}
+		rates = append(rates, part)
+	}
+	if len(rates) != 2 {
+		return 0, 0, fmt.Errorf("expected download/upload rates, got %q", s)
+	}
+	download, err := ParseRate(rates[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	upload, err := ParseRate(rates[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return download, upload, nil
+}
+
+// At returns the rates of the first rule whose window contains t.
+func (s Schedule) At(t time.Time) (download, upload int64, ok bool) {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	for _, r := range s {
+		inside := clock >= r.Start && clock < r.End
+		if r.End <= r.Start {
+			inside = clock >= r.Start || clock < r.End
+		}
+		if inside {
+			return r.Download, r.Upload, true
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"5MiB/s", 5 << 20},
+		{"500KB/s", 500000},
+		{"1.5kib", 1536},
+		{"2M", 2 << 20},
+		{"1048576", 1048576},
+		{"0", 0},
+		{"unlimited", 0},
+	}
+
+	for _, test := range tests {
+		result, err := ParseRate(test.input)
+		if err != nil {
+			t.Errorf("ParseRate(%q) returned error: %v", test.input, err)
+		}
+		if result != test.expected {
+			t.Errorf("ParseRate(%q) = %d, want %d", test.input, result, test.expected)
+		}
+	}
+
+	for _, input := range []string{"", "fast", "-1MiB/s", "5XB"} {
+		if _, err := ParseRate(input); err == nil {
+			t.Errorf("ParseRate(%q) should have failed but didn't", input)
+		}
+	}
+}
+
+func TestScheduleAt(t *testing.T) {
+	schedule, err := ParseSchedule("22:00-07:00=0/0, 09:00-18:00=1MiB/s/256KiB/s")
+	if err != nil {
+		t.Fatalf("ParseSchedule failed: %v", err)
+	}
+
+	tests := []struct {
+		clock    string
+		download int64
+		upload   int64
+		ok       bool
+	}{
+		{"23:30", 0, 0, true},
+		{"03:00", 0, 0, true},
+		{"12:00", 1 << 20, 256 << 10, true},
+		{"18:00", 0, 0, false},
+		{"08:00", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		at, _ := time.Parse("15:04", test.clock)
+		download, upload, ok := schedule.At(at)
+		if ok != test.ok || download != test.download || upload != test.upload {
+			t.Errorf("At(%s) = %d, %d, %v, want %d, %d, %v", test.clock, download, upload, ok, test.download, test.upload, test.ok)
+		}
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, input := range []string{"22:00-07:00", "22:00=0/0", "25:00-07:00=0/0", "22:00-07:00=1MiB/s"} {
+		if _, err := ParseSchedule(input); err == nil {
+			t.Errorf("ParseSchedule(%q) should have failed but didn't", input)
+		}
+	}
+}
@@ -2,9 +2,11 @@ package torrent
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -21,6 +23,41 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	// Private torrents may only get peers from their tracker (BEP 27).
+	Private bool
+	// Files lists the files of a multi-file torrent in the order their
+	// data appears in the pieces. It is nil for a single file.
+	Files []File
+	// PiecesRoot is the merkle root of a single-file v2 torrent.
+	PiecesRoot [32]byte
+	// URLList holds the torrent's web seeds (BEP 19).
+	URLList []string
+	// HTTPSeeds holds the torrent's HTTP seeds, which serve pieces by index
+	// (BEP 17).
+	HTTPSeeds []string
+
+	// InfoHashV2 is the SHA-256 infohash of v2 and hybrid torrents
+	// (BEP 52). The InfoHash of a v2-only torrent is its first 20 bytes,
+	// which identify the torrent to trackers, the DHT and peers.
+	InfoHashV2 [32]byte
+	// PiecesV2 tells how to verify each piece with the v2 merkle trees. It
+	// is nil for v1 torrents.
+	PiecesV2 []PieceV2
+	// PieceLayers maps the pieces root of every file larger than a piece to
+	// the concatenated hashes of its pieces.
+	PieceLayers map[[32]byte][]byte
+}
+
+// File is one file of a multi-file torrent.
+type File struct {
+	Length int
+	// Path holds the path components below the torrent's directory.
+	Path []string
+	// Padding files only align the next file to a piece boundary and hold
+	// zeros (BEP 47). They are not stored.
+	Padding bool
+	// PiecesRoot is the merkle root of the file in v2 torrents.
+	PiecesRoot [32]byte
 }
 
 type bencodeInfo struct {
@@ -36,11 +73,17 @@ type bencodeTorrent struct {
 }
 
 func Open(path string) (*TorrentFile, error) {
+	return OpenWith(path, nil)
+}
+
+// OpenWith is like Open but downloads torrent files given by URL with
+// client, or with a default client if it is nil.
+func OpenWith(path string, client *http.Client) (*TorrentFile, error) {
 	var data []byte
 	var err error
 
 	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
-		data, err = downloadFile(path)
+		data, err = downloadFile(path, client)
 	} else {
 		data, err = os.ReadFile(path)
 	}
@@ -52,9 +95,11 @@ func Open(path string) (*TorrentFile, error) {
 	return Parse(data)
 }
 
-func downloadFile(urlStr string) ([]byte, error) {
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+func downloadFile(urlStr string, client *http.Client) ([]byte, error) {
+	if client == nil {
+		client = &http.Client{
+			Timeout: 30 * time.Second,
+		}
 	}
 
 	resp, err := client.Get(urlStr)
@@ -97,7 +142,15 @@ func Parse(data []byte) (*TorrentFile, error) {
 		return nil, fmt.Errorf("failed to encode info dict: %w", err)
 	}
 
-	torrent.InfoHash = sha1.Sum(infoEncoded)
+	if torrent.PieceHashes != nil {
+		torrent.InfoHash = sha1.Sum(infoEncoded)
+	}
+	if torrent.PiecesV2 != nil {
+		torrent.InfoHashV2 = sha256.Sum256(infoEncoded)
+		if torrent.PieceHashes == nil {
+			copy(torrent.InfoHash[:], torrent.InfoHashV2[:])
+		}
+	}
 
 	return torrent, nil
 }
@@ -113,19 +166,37 @@ func parseTorrentDict(dict map[string]interface{}) (*TorrentFile, error) {
 		return nil, errors.New("missing or invalid info dictionary")
 	}
 
-	pieces, ok := infoDict["pieces"].(string)
-	if !ok {
+	metaVersion, _ := infoDict["meta version"].(int)
+	if metaVersion > 2 {
+		return nil, fmt.Errorf("unsupported meta version %d", metaVersion)
+	}
+	v2 := metaVersion == 2
+
+	// v2 torrents may leave out the v1 fields, hybrid ones have both
+	pieces, hasV1 := infoDict["pieces"].(string)
+	if !hasV1 && !v2 {
 		return nil, errors.New("missing or invalid pieces")
 	}
 
 	pieceLength, ok := infoDict["piece length"].(int)
-	if !ok {
+	if !ok || pieceLength <= 0 {
 		return nil, errors.New("missing or invalid piece length")
 	}
 
 	length, ok := infoDict["length"].(int)
-	if !ok {
-		return nil, errors.New("missing or invalid length")
+	var files []File
+	if !ok && hasV1 {
+		list, isList := infoDict["files"].([]interface{})
+		if !isList {
+			return nil, errors.New("missing or invalid length")
+		}
+		var err error
+		if files, err = parseFiles(list); err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			length += f.Length
+		}
 	}
 
 	name, ok := infoDict["name"].(string)
@@ -133,28 +204,114 @@ func parseTorrentDict(dict map[string]interface{}) (*TorrentFile, error) {
 		return nil, errors.New("missing or invalid name")
 	}
 
+	private, _ := infoDict["private"].(int)
+
 	// Parse piece hashes
 	if len(pieces)%20 != 0 {
 		return nil, errors.New("invalid pieces length (must be multiple of 20)")
 	}
 
-	numPieces := len(pieces) / 20
-	pieceHashes := make([][20]byte, numPieces)
-
-	for i := 0; i < numPieces; i++ {
-		copy(pieceHashes[i][:], pieces[i*20:(i+1)*20])
+	var pieceHashes [][20]byte
+	if hasV1 {
+		numPieces := len(pieces) / 20
+		pieceHashes = make([][20]byte, numPieces)
+		for i := 0; i < numPieces; i++ {
+			copy(pieceHashes[i][:], pieces[i*20:(i+1)*20])
+		}
 	}
 
-	return &TorrentFile{
+	t := &TorrentFile{
 		Announce:    announce,
 		PieceHashes: pieceHashes,
 		PieceLength: pieceLength,
 		Length:      length,
 		Name:        name,
-	}, nil
+		Private:     private == 1,
+		Files:       files,
+		URLList:     parseURLList(dict["url-list"]),
+		HTTPSeeds:   parseURLList(dict["httpseeds"]),
+	}
+	if v2 {
+		if err := parseV2(dict, infoDict, t); err != nil {
+			return nil, err
+		}
+	}
+	if t.Files != nil && (name == "." || name == ".." || strings.ContainsAny(name, "/\\")) {
+		return nil, fmt.Errorf("invalid directory name %q", name)
+	}
+	return t, nil
+}
+
+// parseFiles reads the file list of a multi-file torrent. Path components
+// that could escape the torrent's directory are refused.
+func parseFiles(list []interface{}) ([]File, error) {
+	if len(list) == 0 {
+		return nil, errors.New("empty file list")
+	}
+	files := make([]File, 0, len(list))
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid file entry")
+		}
+		length, ok := dict["length"].(int)
+		if !ok || length < 0 {
+			return nil, errors.New("missing or invalid file length")
+		}
+		components, ok := dict["path"].([]interface{})
+		if !ok || len(components) == 0 {
+			return nil, errors.New("missing or invalid file path")
+		}
+		path := make([]string, 0, len(components))
+		for _, c := range components {
+			name, ok := c.(string)
+			if !ok || name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+				return nil, fmt.Errorf("invalid file path component %q", c)
+			}
+			path = append(path, name)
+		}
+		attr, _ := dict["attr"].(string)
+		files = append(files, File{Length: length, Path: path, Padding: strings.Contains(attr, "p")})
+	}
+	return files, nil
+}
+
+// parseURLList reads url-list or httpseeds, which are a single URL or a
+// list of them.
+func parseURLList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []interface{}:
+		var urls []string
+		for _, item := range v {
+			if u, ok := item.(string); ok && u != "" {
+				urls = append(urls, u)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// Announce describes the state reported to the tracker.
+type Announce struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string // "started", "completed", "stopped" or empty for a regular update
+	// IPv6, if set, is our IPv6 address, which HTTP trackers reached over
+	// IPv4 can then give to IPv6 peers (BEP 7).
+	IPv6 net.IP
 }
 
 func (t *TorrentFile) BuildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+	return t.BuildAnnounceURL(peerID, port, Announce{Left: int64(t.Length)})
+}
+
+func (t *TorrentFile) BuildAnnounceURL(peerID [20]byte, port uint16, a Announce) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
@@ -164,10 +321,16 @@ func (t *TorrentFile) BuildTrackerURL(peerID [20]byte, port uint16) (string, err
 		"info_hash":  []string{string(t.InfoHash[:])},
 		"peer_id":    []string{string(peerID[:])},
 		"port":       []string{fmt.Sprintf("%d", port)},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{fmt.Sprintf("%d", a.Uploaded)},
+		"downloaded": []string{fmt.Sprintf("%d", a.Downloaded)},
 		"compact":    []string{"1"},
-		"left":       []string{fmt.Sprintf("%d", t.Length)},
+		"left":       []string{fmt.Sprintf("%d", a.Left)},
+	}
+	if a.Event != "" {
+		params.Set("event", a.Event)
+	}
+	if a.IPv6 != nil {
+		params.Set("ipv6", a.IPv6.String())
 	}
 
 	base.RawQuery = params.Encode()
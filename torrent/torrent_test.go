@@ -3,6 +3,10 @@ package torrent
 import (
 	"bytes"
 	"crypto/sha1"
+	"io"
+	"net"
+	"net/http"
+	"strings"
 	"testing"
 
 	"torrent-client/bencode"
@@ -64,6 +68,34 @@ func TestParseTorrent(t *testing.T) {
 	if torrent.InfoHash != expectedHash {
 		t.Errorf("Info hash mismatch")
 	}
+
+	if torrent.Private {
+		t.Errorf("Expected a public torrent")
+	}
+}
+
+func TestParsePrivateTorrent(t *testing.T) {
+	torrentData, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://tracker.example.com:8080/announce",
+		"info": map[string]interface{}{
+			"pieces":       "abcdefghij1234567890",
+			"piece length": 262144,
+			"length":       1000,
+			"name":         "test.txt",
+			"private":      1,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+
+	torrent, err := Parse(torrentData)
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+	if !torrent.Private {
+		t.Errorf("Expected the private flag to be set")
+	}
 }
 
 func TestBuildTrackerURL(t *testing.T) {
@@ -98,6 +130,95 @@ func TestBuildTrackerURL(t *testing.T) {
 	}
 }
 
+func TestBuildAnnounceURL(t *testing.T) {
+	torrent := &TorrentFile{
+		Announce: "http://tracker.example.com:8080/announce",
+		Length:   1024,
+	}
+	peerID := [20]byte{'A', 'B', 'C', 'D', 'E', 'F', 'G', 'H', 'I', 'J', 'K', 'L', 'M', 'N', 'O', 'P', 'Q', 'R', 'S', 'T'}
+
+	url, err := torrent.BuildAnnounceURL(peerID, 6881, Announce{Uploaded: 2048, Left: 0, Event: "completed"})
+	if err != nil {
+		t.Fatalf("Failed to build announce URL: %v", err)
+	}
+
+	for _, component := range []string{"uploaded=2048", "downloaded=0", "left=0", "event=completed"} {
+		if !bytes.Contains([]byte(url), []byte(component)) {
+			t.Errorf("URL '%s' missing expected component '%s'", url, component)
+		}
+	}
+
+	url, err = torrent.BuildAnnounceURL(peerID, 6881, Announce{Left: 1024})
+	if err != nil {
+		t.Fatalf("Failed to build announce URL: %v", err)
+	}
+	if bytes.Contains([]byte(url), []byte("event=")) {
+		t.Errorf("URL '%s' should not contain an event", url)
+	}
+	if bytes.Contains([]byte(url), []byte("ipv6=")) {
+		t.Errorf("URL '%s' should not contain an IPv6 address", url)
+	}
+
+	url, err = torrent.BuildAnnounceURL(peerID, 6881, Announce{IPv6: net.ParseIP("2001:db8::1")})
+	if err != nil {
+		t.Fatalf("Failed to build announce URL: %v", err)
+	}
+	if !bytes.Contains([]byte(url), []byte("ipv6=2001%3Adb8%3A%3A1")) {
+		t.Errorf("URL '%s' missing the IPv6 address", url)
+	}
+}
+
+func TestParseMultiFileTorrent(t *testing.T) {
+	info := map[string]interface{}{
+		"pieces":       string(bytes.Repeat([]byte("abcdefghij1234567890"), 2)),
+		"piece length": 16384,
+		"name":         "album",
+		"files": []interface{}{
+			map[string]interface{}{"length": 20000, "path": []interface{}{"cd1", "01.flac"}},
+			map[string]interface{}{"length": 5000, "path": []interface{}{"cover.jpg"}},
+		},
+	}
+	data, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://tracker.example.com/announce",
+		"url-list": []interface{}{"http://mirror.example.com/pub/", "http://mirror2.example.com/"},
+		"info":     info,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+
+	torrent, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse torrent: %v", err)
+	}
+	if torrent.Length != 25000 {
+		t.Errorf("Expected the length to be the sum of the files, got %d", torrent.Length)
+	}
+	if len(torrent.Files) != 2 || torrent.Files[0].Length != 20000 || strings.Join(torrent.Files[0].Path, "/") != "cd1/01.flac" {
+		t.Errorf("Unexpected files %+v", torrent.Files)
+	}
+	if len(torrent.URLList) != 2 || torrent.URLList[0] != "http://mirror.example.com/pub/" {
+		t.Errorf("Unexpected url-list %v", torrent.URLList)
+	}
+
+	// A single URL is allowed too
+	tf, err := parseTorrentDict(map[string]interface{}{
+		"announce":  "http://tracker.example.com/announce",
+		"url-list":  "http://mirror.example.com/album.iso",
+		"httpseeds": []interface{}{"http://seed.example.com/seed.php"},
+		"info":      map[string]interface{}{"pieces": "", "piece length": 16384, "length": 0, "name": "album.iso"},
+	})
+	if err != nil {
+		t.Fatalf("parseTorrentDict failed: %v", err)
+	}
+	if len(tf.URLList) != 1 || tf.URLList[0] != "http://mirror.example.com/album.iso" {
+		t.Errorf("Unexpected url-list %v", tf.URLList)
+	}
+	if len(tf.HTTPSeeds) != 1 || tf.HTTPSeeds[0] != "http://seed.example.com/seed.php" {
+		t.Errorf("Unexpected httpseeds %v", tf.HTTPSeeds)
+	}
+}
+
 func TestParseErrors(t *testing.T) {
 	testCases := []struct {
 		name     string
@@ -139,6 +260,21 @@ func TestParseErrors(t *testing.T) {
 			},
 			errorMsg: "invalid pieces length",
 		},
+		{
+			name: "file path escaping the directory",
+			data: map[string]interface{}{
+				"announce": "http://example.com",
+				"info": map[string]interface{}{
+					"pieces":       "",
+					"piece length": 262144,
+					"name":         "test",
+					"files": []interface{}{
+						map[string]interface{}{"length": 10, "path": []interface{}{"..", "passwd"}},
+					},
+				},
+			},
+			errorMsg: "invalid file path component",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -157,3 +293,45 @@ func TestParseErrors(t *testing.T) {
 		})
 	}
 }
+
+// recordingTransport serves every request with body and counts them.
+type recordingTransport struct {
+	body     []byte
+	requests int
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.requests++
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(bytes.NewReader(rt.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestOpenWithFetchesURLsWithClient(t *testing.T) {
+	data, err := bencode.Encode(map[string]interface{}{
+		"announce": "http://tracker.example.com/announce",
+		"info": map[string]interface{}{
+			"pieces":       string(bytes.Repeat([]byte("a"), 20)),
+			"piece length": 16384,
+			"length":       1000,
+			"name":         "test.txt",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode test torrent: %v", err)
+	}
+	rt := &recordingTransport{body: data}
+
+	torrent, err := OpenWith("http://example.com/test.torrent", &http.Client{Transport: rt})
+	if err != nil {
+		t.Fatalf("OpenWith failed: %v", err)
+	}
+	if rt.requests != 1 {
+		t.Errorf("Expected 1 request through the client, got %d", rt.requests)
+	}
+	if torrent.Name != "test.txt" {
+		t.Errorf("Expected name 'test.txt', got '%s'", torrent.Name)
+	}
+}
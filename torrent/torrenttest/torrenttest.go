@@ -0,0 +1,120 @@
+// Package torrenttest builds v1, v2 and hybrid torrent files for tests.
+package torrenttest
+
+import (
+	"crypto/sha1"
+	"strconv"
+
+	"torrent-client/bencode"
+	"torrent-client/merkle"
+)
+
+// File is a file of a torrent and its content.
+type File struct {
+	Path []string
+	Data []byte
+}
+
+// Meta versions to build.
+const (
+	V1     = 1
+	V2     = 2
+	Hybrid = V1 | V2
+)
+
+// Build returns the bencoded metainfo of a torrent named name holding files.
+// A single file whose path is the name makes a single-file torrent. Hybrid
+// torrents align their files to pieces with padding files, like v2 ones.
+func Build(name string, pieceLength int, files []File, version int) []byte {
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+	}
+	dict := map[string]interface{}{
+		"announce": "http://tracker.example.com/announce",
+		"info":     info,
+	}
+	single := len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == name
+
+	if version&V1 != 0 {
+		var content []byte
+		var list []interface{}
+		for _, f := range files {
+			if pad := (pieceLength - len(content)%pieceLength) % pieceLength; version&V2 != 0 && pad > 0 && len(f.Data) > 0 {
+				content = append(content, make([]byte, pad)...)
+				list = append(list, map[string]interface{}{
+					"length": pad,
+					"path":   []interface{}{".pad", strconv.Itoa(pad)},
+					"attr":   "p",
+				})
+			}
+			content = append(content, f.Data...)
+			path := make([]interface{}, len(f.Path))
+			for i, c := range f.Path {
+				path[i] = c
+			}
+			list = append(list, map[string]interface{}{"length": len(f.Data), "path": path})
+		}
+		if single {
+			info["length"] = len(content)
+		} else {
+			info["files"] = list
+		}
+		var pieces []byte
+		for begin := 0; begin < len(content); begin += pieceLength {
+			sum := sha1.Sum(content[begin:min(begin+pieceLength, len(content))])
+			pieces = append(pieces, sum[:]...)
+		}
+		info["pieces"] = string(pieces)
+	}
+
+	if version&V2 != 0 {
+		info["meta version"] = 2
+		tree := map[string]interface{}{}
+		layers := map[string]interface{}{}
+		for _, f := range files {
+			leaf := map[string]interface{}{"length": len(f.Data)}
+			if len(f.Data) > 0 {
+				root, layer := Hashes(f.Data, pieceLength)
+				leaf["pieces root"] = string(root[:])
+				if layer != nil {
+					layers[string(root[:])] = string(layer)
+				}
+			}
+			dir := tree
+			for _, c := range f.Path {
+				sub, ok := dir[c].(map[string]interface{})
+				if !ok {
+					sub = map[string]interface{}{}
+					dir[c] = sub
+				}
+				dir = sub
+			}
+			dir[""] = leaf
+		}
+		info["file tree"] = tree
+		dict["piece layers"] = layers
+	}
+
+	data, err := bencode.Encode(dict)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Hashes returns the v2 pieces root of data and its piece layer, which is
+// nil for data of no more than a piece.
+func Hashes(data []byte, pieceLength int) ([32]byte, []byte) {
+	leaves := merkle.BlockHashes(data)
+	tree := merkle.NewTree(leaves, 0, merkle.Width(len(leaves)))
+	if len(data) <= pieceLength {
+		return tree.Root(), nil
+	}
+	numPieces := (len(data) + pieceLength - 1) / pieceLength
+	var layer []byte
+	for _, h := range tree.Layer(merkle.Log2(pieceLength / merkle.BlockSize))[:numPieces] {
+		layer = append(layer, h[:]...)
+	}
+	return tree.Root(), layer
+}
@@ -1,10 +1,14 @@
 package torrent
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"torrent-client/bencode"
@@ -16,7 +20,7 @@ type Peer struct {
 }
 
 func (p Peer) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 type TrackerResponse struct {
@@ -25,13 +29,44 @@ type TrackerResponse struct {
 }
 
 func RequestPeers(torrent *TorrentFile, peerID [20]byte, port uint16) (*TrackerResponse, error) {
-	url, err := torrent.BuildTrackerURL(peerID, port)
+	return SendAnnounce(torrent, peerID, port, Announce{Left: int64(torrent.Length)})
+}
+
+// SendAnnounce reports the state a to the tracker and returns its peer list.
+func SendAnnounce(torrent *TorrentFile, peerID [20]byte, port uint16, a Announce) (*TrackerResponse, error) {
+	var c TrackerClient
+	return c.Announce(torrent, peerID, port, a)
+}
+
+// How long an announce may take, over HTTP or UDP.
+const announceTimeout = 15 * time.Second
+
+// TrackerClient announces to HTTP and UDP trackers. The zero value
+// connects directly.
+type TrackerClient struct {
+	// HTTP, if set, sends the requests to HTTP trackers.
+	HTTP *http.Client
+	// DialUDP, if set, opens the connections to UDP trackers.
+	DialUDP func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Announce reports the state a to the tracker of torrent and returns its
+// peer list.
+func (c *TrackerClient) Announce(torrent *TorrentFile, peerID [20]byte, port uint16, a Announce) (*TrackerResponse, error) {
+	if strings.HasPrefix(torrent.Announce, "udp://") {
+		return c.announceUDP(torrent, peerID, port, a)
+	}
+
+	url, err := torrent.BuildAnnounceURL(peerID, port, a)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build tracker URL: %w", err)
 	}
 
-	client := &http.Client{
-		Timeout: 15 * time.Second,
+	client := c.HTTP
+	if client == nil {
+		client = &http.Client{
+			Timeout: announceTimeout,
+		}
 	}
 
 	resp, err := client.Get(url)
@@ -45,13 +80,18 @@ func RequestPeers(torrent *TorrentFile, peerID [20]byte, port uint16) (*TrackerR
 	}
 
 	// Read response body
-	body := make([]byte, resp.ContentLength)
-	_, err = resp.Body.Read(body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read tracker response: %w", err)
 	}
 
-	// Decode bencoded response
+	return parseTrackerResponse(body)
+}
+
+// parseTrackerResponse decodes an HTTP tracker response. Peers may come in
+// compact format or as a list of dictionaries, and IPv6 peers in compact
+// format under "peers6" (BEP 7).
+func parseTrackerResponse(body []byte) (*TrackerResponse, error) {
 	decoded, err := bencode.Decode(body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to decode tracker response: %w", err)
@@ -76,15 +116,27 @@ func RequestPeers(torrent *TorrentFile, peerID [20]byte, port uint16) (*TrackerR
 	}
 
 	// Extract peers
-	peersData, ok := responseDict["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("missing or invalid peers in tracker response")
+	var peers []Peer
+	switch peersData := responseDict["peers"].(type) {
+	case string:
+		peers, err = parsePeers([]byte(peersData))
+	case []interface{}:
+		peers, err = parsePeerList(peersData)
+	default:
+		if _, ok := responseDict["peers6"]; !ok {
+			return nil, fmt.Errorf("missing or invalid peers in tracker response")
+		}
 	}
-
-	peers, err := parsePeers([]byte(peersData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse peers: %w", err)
 	}
+	if peers6, ok := responseDict["peers6"].(string); ok {
+		parsed, err := ParseCompactPeers([]byte(peers6), net.IPv6len)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IPv6 peers: %w", err)
+		}
+		peers = append(peers, parsed...)
+	}
 
 	return &TrackerResponse{
 		Interval: interval,
@@ -92,8 +144,42 @@ func RequestPeers(torrent *TorrentFile, peerID [20]byte, port uint16) (*TrackerR
 	}, nil
 }
 
+// parsePeerList parses peers given as dictionaries with "ip" and "port"
+// keys. The IP may be an IPv4 or IPv6 address; entries with a host name or
+// a bad port are skipped.
+func parsePeerList(list []interface{}) ([]Peer, error) {
+	var peers []Peer
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("peer is not a dictionary")
+		}
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int)
+		ip := net.ParseIP(host)
+		if ip == nil || port <= 0 || port > 65535 {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		peers = append(peers, Peer{IP: ip, Port: uint16(port)})
+	}
+	return peers, nil
+}
+
 func parsePeers(peersData []byte) ([]Peer, error) {
-	const peerSize = 6 // 4 bytes IP + 2 bytes port
+	return ParseCompactPeers(peersData, net.IPv4len)
+}
+
+// ParseCompactPeers parses peers in compact format: ipLen bytes of IP
+// address followed by 2 bytes of port each, in network byte order. ipLen
+// must be 4 for IPv4 or 16 for IPv6.
+func ParseCompactPeers(peersData []byte, ipLen int) ([]Peer, error) {
+	if ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return nil, fmt.Errorf("invalid IP length: %d", ipLen)
+	}
+	peerSize := ipLen + 2
 
 	if len(peersData)%peerSize != 0 {
 		return nil, fmt.Errorf("invalid peers data length: %d (must be multiple of %d)", len(peersData), peerSize)
@@ -104,12 +190,9 @@ func parsePeers(peersData []byte) ([]Peer, error) {
 
 	for i := 0; i < numPeers; i++ {
 		offset := i * peerSize
-
-		// Extract IP (4 bytes, network byte order)
-		ip := net.IP(peersData[offset : offset+4])
-
-		// Extract port (2 bytes, network byte order)
-		port := binary.BigEndian.Uint16(peersData[offset+4 : offset+6])
+		ip := make(net.IP, ipLen)
+		copy(ip, peersData[offset:offset+ipLen])
+		port := binary.BigEndian.Uint16(peersData[offset+ipLen : offset+peerSize])
 
 		peers[i] = Peer{
 			IP:   ip,
@@ -119,3 +202,24 @@ func parsePeers(peersData []byte) ([]Peer, error) {
 
 	return peers, nil
 }
+
+// CompactPeers encodes the peers whose address has length ipLen (4 for
+// IPv4, 16 for IPv6) in compact format and skips the others.
+func CompactPeers(peers []Peer, ipLen int) []byte {
+	var buf []byte
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ipLen == net.IPv6len {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+		if len(ip) != ipLen {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, p.Port)
+	}
+	return buf
+}
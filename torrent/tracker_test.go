@@ -66,15 +66,48 @@ func TestParsePeersInvalidLength(t *testing.T) {
 	}
 }
 
+func TestCompactPeersRoundTrip(t *testing.T) {
+	peers := []Peer{
+		{IP: net.ParseIP("192.168.1.1"), Port: 8080},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+	}
+
+	v4, err := ParseCompactPeers(CompactPeers(peers, net.IPv4len), net.IPv4len)
+	if err != nil {
+		t.Fatalf("ParseCompactPeers failed: %v", err)
+	}
+	if len(v4) != 1 || !v4[0].IP.Equal(peers[0].IP) || v4[0].Port != 8080 {
+		t.Errorf("Expected only %s, got %v", peers[0], v4)
+	}
+
+	v6, err := ParseCompactPeers(CompactPeers(peers, net.IPv6len), net.IPv6len)
+	if err != nil {
+		t.Fatalf("ParseCompactPeers failed: %v", err)
+	}
+	if len(v6) != 1 || !v6[0].IP.Equal(peers[1].IP) || v6[0].Port != 6881 {
+		t.Errorf("Expected only %s, got %v", peers[1], v6)
+	}
+
+	for _, ipLen := range []int{-2, -1, 0, 5} {
+		if _, err := ParseCompactPeers(nil, ipLen); err == nil {
+			t.Errorf("Expected an error for IP length %d", ipLen)
+		}
+	}
+}
+
 func TestPeerString(t *testing.T) {
-	peer := Peer{
-		IP:   net.IPv4(192, 168, 1, 100),
-		Port: 6881,
+	tests := []struct {
+		peer     Peer
+		expected string
+	}{
+		{Peer{IP: net.IPv4(192, 168, 1, 100), Port: 6881}, "192.168.1.100:6881"},
+		{Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, "[2001:db8::1]:6881"},
 	}
 
-	expected := "192.168.1.100:6881"
-	if peer.String() != expected {
-		t.Errorf("Peer.String(): expected %s, got %s", expected, peer.String())
+	for _, tt := range tests {
+		if got := tt.peer.String(); got != tt.expected {
+			t.Errorf("Peer.String(): expected %s, got %s", tt.expected, got)
+		}
 	}
 }
 
@@ -139,6 +172,55 @@ func TestTrackerResponseParsing(t *testing.T) {
 	}
 }
 
+func TestParseTrackerResponsePeerFormats(t *testing.T) {
+	v4 := Peer{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 6881}
+	v6 := Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413}
+	tests := []struct {
+		name     string
+		response map[string]interface{}
+		expected []Peer
+	}{
+		{"compact with peers6", map[string]interface{}{
+			"interval": 900,
+			"peers":    string(CompactPeers([]Peer{v4}, net.IPv4len)),
+			"peers6":   string(CompactPeers([]Peer{v6}, net.IPv6len)),
+		}, []Peer{v4, v6}},
+		{"peers6 only", map[string]interface{}{
+			"interval": 900,
+			"peers6":   string(CompactPeers([]Peer{v6}, net.IPv6len)),
+		}, []Peer{v6}},
+		{"dictionaries", map[string]interface{}{
+			"interval": 900,
+			"peers": []interface{}{
+				map[string]interface{}{"ip": "192.0.2.1", "port": 6881, "peer id": "-XX0001-abcdefghijkl"},
+				map[string]interface{}{"ip": "2001:db8::1", "port": 51413},
+				map[string]interface{}{"ip": "peer.example.com", "port": 6881},
+			},
+		}, []Peer{v4, v6}},
+	}
+
+	for _, tt := range tests {
+		body, err := bencode.Encode(tt.response)
+		if err != nil {
+			t.Fatalf("Failed to encode response: %v", err)
+		}
+		resp, err := parseTrackerResponse(body)
+		if err != nil {
+			t.Errorf("%s: parseTrackerResponse failed: %v", tt.name, err)
+			continue
+		}
+		if len(resp.Peers) != len(tt.expected) {
+			t.Errorf("%s: expected peers %v, got %v", tt.name, tt.expected, resp.Peers)
+			continue
+		}
+		for i := range tt.expected {
+			if resp.Peers[i].String() != tt.expected[i].String() {
+				t.Errorf("%s: expected peer %s, got %s", tt.name, tt.expected[i], resp.Peers[i])
+			}
+		}
+	}
+}
+
 func TestTrackerErrorResponse(t *testing.T) {
 	// Create mock error response
 	errorResponse := map[string]interface{}{
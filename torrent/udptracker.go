@@ -0,0 +1,158 @@
+package torrent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15).
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionError    = 3
+
+	// The first request waits this long for an answer, and each retry
+	// twice as long as the one before.
+	udpRetryTimeout = 2 * time.Second
+)
+
+var udpEvents = map[string]uint32{
+	"":          0,
+	"completed": 1,
+	"started":   2,
+	"stopped":   3,
+}
+
+func (c *TrackerClient) announceUDP(torrent *TorrentFile, peerID [20]byte, port uint16, a Announce) (*TrackerResponse, error) {
+	u, err := url.Parse(torrent.Announce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL: %w", err)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("UDP tracker %q has no port", torrent.Announce)
+	}
+	event, ok := udpEvents[a.Event]
+	if !ok {
+		return nil, fmt.Errorf("unknown announce event %q", a.Event)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+	dial := c.DialUDP
+	if dial == nil {
+		dial = func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		}
+	}
+	conn, err := dial(ctx, u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to contact tracker: %w", err)
+	}
+	defer conn.Close()
+
+	connect := binary.BigEndian.AppendUint64(nil, udpProtocolID)
+	connect = binary.BigEndian.AppendUint32(connect, udpActionConnect)
+	reply, err := udpRequest(ctx, conn, connect, 16)
+	if err != nil {
+		return nil, err
+	}
+	connID := binary.BigEndian.Uint64(reply[8:16])
+
+	var key [4]byte
+	rand.Read(key[:])
+	req := binary.BigEndian.AppendUint64(nil, connID)
+	req = binary.BigEndian.AppendUint32(req, udpActionAnnounce)
+	req = append(req, torrent.InfoHash[:]...)
+	req = append(req, peerID[:]...)
+	req = binary.BigEndian.AppendUint64(req, uint64(a.Downloaded))
+	req = binary.BigEndian.AppendUint64(req, uint64(a.Left))
+	req = binary.BigEndian.AppendUint64(req, uint64(a.Uploaded))
+	req = binary.BigEndian.AppendUint32(req, event)
+	req = binary.BigEndian.AppendUint32(req, 0) // our IP: the sender's
+	req = append(req, key[:]...)
+	req = binary.BigEndian.AppendUint32(req, 0xffffffff) // default number of peers
+	req = binary.BigEndian.AppendUint16(req, port)
+	reply, err = udpRequest(ctx, conn, req, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trackers reached over IPv6 return IPv6 peers. Through a proxy the
+	// connection's address is the relay's, so a literal in the URL decides
+	ipLen := net.IPv4len
+	ip := net.ParseIP(u.Hostname())
+	if ip == nil {
+		if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+			ip = addr.IP
+		}
+	}
+	if ip != nil && ip.To4() == nil {
+		ipLen = net.IPv6len
+	}
+	peers, err := ParseCompactPeers(reply[20:], ipLen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers: %w", err)
+	}
+	return &TrackerResponse{
+		Interval: int(binary.BigEndian.Uint32(reply[8:12])),
+		Peers:    peers,
+	}, nil
+}
+
+// udpRequest sends req, which is missing its transaction ID, and returns a
+// reply of at least minLen bytes with the same action, retrying with longer
+// timeouts until ctx is done.
+func udpRequest(ctx context.Context, conn net.Conn, req []byte, minLen int) ([]byte, error) {
+	// The action and transaction ID follow the first 8 bytes of a request
+	action := binary.BigEndian.Uint32(req[8:12])
+	var tid [4]byte
+	rand.Read(tid[:])
+	req = append(req[:12:12], append(tid[:], req[12:]...)...)
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	buf := make([]byte, 65536)
+	timeout := udpRetryTimeout
+	for ctx.Err() == nil {
+		if _, err := conn.Write(req); err != nil {
+			return nil, fmt.Errorf("failed to contact tracker: %w", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read tracker response: %w", err)
+			}
+			if n < 8 || [4]byte(buf[4:8]) != tid {
+				continue
+			}
+			switch binary.BigEndian.Uint32(buf[:4]) {
+			case action:
+				if n < minLen {
+					return nil, fmt.Errorf("tracker response too short: %d bytes", n)
+				}
+				return append([]byte(nil), buf[:n]...), nil
+			case udpActionError:
+				return nil, fmt.Errorf("tracker error: %s", buf[8:n])
+			}
+		}
+		timeout *= 2
+	}
+	return nil, errors.New("tracker did not respond")
+}
@@ -0,0 +1,167 @@
+package torrent
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeUDPTracker answers BEP 15 requests with peers. It ignores the first
+// drop requests to exercise retries.
+type fakeUDPTracker struct {
+	conn      net.PacketConn
+	peers     []Peer
+	drop      int
+	failWith  string
+	announces atomic.Int32
+	lastEvent atomic.Uint32
+}
+
+func newFakeUDPTracker(t *testing.T, peers []Peer) *fakeUDPTracker {
+	return newFakeUDPTrackerOn(t, "127.0.0.1:0", peers)
+}
+
+func newFakeUDPTrackerOn(t *testing.T, addr string, peers []Peer) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &fakeUDPTracker{conn: conn, peers: peers}
+}
+
+func (f *fakeUDPTracker) url() string {
+	return "udp://" + f.conn.LocalAddr().String() + "/announce"
+}
+
+func (f *fakeUDPTracker) serve() {
+	const connID = 0x1234
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if f.drop > 0 {
+			f.drop--
+			continue
+		}
+		if n < 16 {
+			continue
+		}
+		action := binary.BigEndian.Uint32(buf[8:12])
+		tid := buf[12:16]
+		var reply []byte
+		switch {
+		case action == udpActionConnect && binary.BigEndian.Uint64(buf[:8]) == udpProtocolID:
+			reply = binary.BigEndian.AppendUint32(nil, udpActionConnect)
+			reply = append(reply, tid...)
+			reply = binary.BigEndian.AppendUint64(reply, connID)
+		case action == udpActionAnnounce && n >= 98 && binary.BigEndian.Uint64(buf[:8]) == connID:
+			f.announces.Add(1)
+			f.lastEvent.Store(binary.BigEndian.Uint32(buf[80:84]))
+			if f.failWith != "" {
+				reply = binary.BigEndian.AppendUint32(nil, udpActionError)
+				reply = append(reply, tid...)
+				reply = append(reply, f.failWith...)
+				break
+			}
+			reply = binary.BigEndian.AppendUint32(nil, udpActionAnnounce)
+			reply = append(reply, tid...)
+			reply = binary.BigEndian.AppendUint32(reply, 1800)
+			reply = binary.BigEndian.AppendUint32(reply, 0)
+			reply = binary.BigEndian.AppendUint32(reply, uint32(len(f.peers)))
+			// Peers are in the address family of the request
+			ipLen := net.IPv4len
+			if from.(*net.UDPAddr).IP.To4() == nil {
+				ipLen = net.IPv6len
+			}
+			reply = append(reply, CompactPeers(f.peers, ipLen)...)
+		default:
+			continue
+		}
+		f.conn.WriteTo(reply, from)
+	}
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	peers := []Peer{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 6881},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 51413},
+	}
+	tracker := newFakeUDPTracker(t, peers)
+	tracker.drop = 1
+	go tracker.serve()
+
+	tf := &TorrentFile{Announce: tracker.url(), InfoHash: [20]byte{1}, Length: 100}
+	resp, err := SendAnnounce(tf, [20]byte{2}, 6881, Announce{Left: 100, Event: "started"})
+	if err != nil {
+		t.Fatalf("SendAnnounce failed: %v", err)
+	}
+	if resp.Interval != 1800 {
+		t.Errorf("Expected interval 1800, got %d", resp.Interval)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[1].String() != "192.0.2.2:51413" {
+		t.Errorf("Expected peers %v, got %v", peers, resp.Peers)
+	}
+	if event := tracker.lastEvent.Load(); event != 2 {
+		t.Errorf("Expected the started event (2), got %d", event)
+	}
+}
+
+func TestUDPTrackerAnnounceIPv6(t *testing.T) {
+	if ln, err := net.ListenPacket("udp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	} else {
+		ln.Close()
+	}
+	peers := []Peer{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 6881},
+		{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+	}
+	tracker := newFakeUDPTrackerOn(t, "[::1]:0", peers)
+	go tracker.serve()
+
+	tf := &TorrentFile{Announce: tracker.url(), Length: 100}
+	resp, err := SendAnnounce(tf, [20]byte{2}, 6881, Announce{Left: 100})
+	if err != nil {
+		t.Fatalf("SendAnnounce failed: %v", err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("Expected peer [2001:db8::1]:6881, got %v", resp.Peers)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	tracker := newFakeUDPTracker(t, nil)
+	tracker.failWith = "unregistered torrent"
+	go tracker.serve()
+
+	tf := &TorrentFile{Announce: tracker.url(), Length: 100}
+	_, err := SendAnnounce(tf, [20]byte{2}, 6881, Announce{Left: 100})
+	if err == nil || !strings.Contains(err.Error(), "unregistered torrent") {
+		t.Errorf("Expected the tracker's error, got %v", err)
+	}
+}
+
+func TestTrackerClientDialUDP(t *testing.T) {
+	tracker := newFakeUDPTracker(t, []Peer{{IP: net.IPv4(192, 0, 2, 1), Port: 6881}})
+	go tracker.serve()
+
+	var dialed []string
+	c := &TrackerClient{DialUDP: func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, "udp", addr)
+	}}
+	tf := &TorrentFile{Announce: tracker.url(), Length: 100}
+	if _, err := c.Announce(tf, [20]byte{2}, 6881, Announce{Left: 100}); err != nil {
+		t.Fatalf("Announce failed: %v", err)
+	}
+	if len(dialed) != 1 || dialed[0] != tracker.conn.LocalAddr().String() {
+		t.Errorf("Expected DialUDP to be used for %s, got %v", tracker.conn.LocalAddr(), dialed)
+	}
+}
@@ -0,0 +1,239 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"torrent-client/merkle"
+)
+
+// PieceV2 describes how a piece of a v2 torrent is verified (BEP 52): the
+// hashes of the blocks in its first Length bytes, padded with zero hashes
+// to Leaves, lead up to Hash. Bytes after Length are padding between files.
+type PieceV2 struct {
+	Hash   [32]byte
+	Leaves int
+	Length int
+	// Root is the pieces root of the file holding the piece, and Index the
+	// position of the piece within the file.
+	Root  [32]byte
+	Index int
+}
+
+// v2File is a file of the file tree of a v2 info dictionary.
+type v2File struct {
+	path   []string
+	length int
+	root   [32]byte
+}
+
+// parseV2 reads the v2 parts of a torrent: the file tree of info and the
+// piece layers of dict. The files of a hybrid torrent must match its v1
+// file list, whose padding files are marked and get their pieces roots.
+func parseV2(dict, info map[string]interface{}, t *TorrentFile) error {
+	pieceLength := t.PieceLength
+	if pieceLength < merkle.BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("invalid v2 piece length %d", pieceLength)
+	}
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok {
+		return errors.New("missing or invalid file tree")
+	}
+	files, err := parseFileTree(tree, nil)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("empty file tree")
+	}
+	layers, err := parsePieceLayers(dict["piece layers"], files, pieceLength)
+	if err != nil {
+		return err
+	}
+	t.PieceLayers = layers
+
+	single := len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == t.Name
+	hybrid := t.PieceHashes != nil
+	switch {
+	case single && hybrid:
+		if t.Files != nil || t.Length != files[0].length {
+			return errors.New("v1 and v2 file lists differ")
+		}
+		t.PiecesRoot = files[0].root
+	case single:
+		t.Length = files[0].length
+		t.PiecesRoot = files[0].root
+	case hybrid:
+		if err := matchFiles(t.Files, files); err != nil {
+			return err
+		}
+	default:
+		t.Files = alignFiles(files, pieceLength)
+	}
+	if !single {
+		t.Length = 0
+		for _, f := range t.Files {
+			t.Length += f.Length
+		}
+	}
+
+	t.PiecesV2 = piecesV2(t)
+	if hybrid && len(t.PiecesV2) != len(t.PieceHashes) {
+		return fmt.Errorf("%d v1 pieces but %d v2 pieces", len(t.PieceHashes), len(t.PiecesV2))
+	}
+	return nil
+}
+
+// parseFileTree returns the files below a directory of the file tree, in
+// the order of their paths.
+func parseFileTree(dir map[string]interface{}, path []string) ([]v2File, error) {
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var files []v2File
+	for _, name := range names {
+		entry, ok := dir[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid file tree entry %q", name)
+		}
+		if name == "" {
+			return nil, errors.New("file tree entry without a name")
+		}
+		if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return nil, fmt.Errorf("invalid file path component %q", name)
+		}
+		p := append(append([]string(nil), path...), name)
+
+		leaf, ok := entry[""].(map[string]interface{})
+		if !ok {
+			sub, err := parseFileTree(entry, p)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, sub...)
+			continue
+		}
+		length, ok := leaf["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("missing or invalid length of %s", strings.Join(p, "/"))
+		}
+		f := v2File{path: p, length: length}
+		if length > 0 {
+			root, ok := leaf["pieces root"].(string)
+			if !ok || len(root) != 32 {
+				return nil, fmt.Errorf("missing or invalid pieces root of %s", strings.Join(p, "/"))
+			}
+			copy(f.root[:], root)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// parsePieceLayers reads the hashes of the pieces of every file larger than
+// a piece and checks them against the file's pieces root.
+func parsePieceLayers(v interface{}, files []v2File, pieceLength int) (map[[32]byte][]byte, error) {
+	dict, _ := v.(map[string]interface{})
+	layers := make(map[[32]byte][]byte)
+	for _, f := range files {
+		if f.length <= pieceLength {
+			continue
+		}
+		layer, ok := dict[string(f.root[:])].(string)
+		numPieces := (f.length + pieceLength - 1) / pieceLength
+		if !ok || len(layer) != numPieces*32 {
+			return nil, fmt.Errorf("missing or invalid piece layer of %s", strings.Join(f.path, "/"))
+		}
+		hashes := layerHashes([]byte(layer))
+		base := merkle.Log2(pieceLength / merkle.BlockSize)
+		if merkle.Root(hashes, base, merkle.Width(numPieces)) != f.root {
+			return nil, fmt.Errorf("piece layer of %s does not match its pieces root", strings.Join(f.path, "/"))
+		}
+		layers[f.root] = []byte(layer)
+	}
+	return layers, nil
+}
+
+func layerHashes(layer []byte) [][32]byte {
+	hashes := make([][32]byte, len(layer)/32)
+	for i := range hashes {
+		copy(hashes[i][:], layer[i*32:])
+	}
+	return hashes
+}
+
+// matchFiles checks that the v1 files of a hybrid torrent, less the padding
+// files, are the v2 files, and copies their pieces roots.
+func matchFiles(v1 []File, v2 []v2File) error {
+	i := 0
+	for j := range v1 {
+		if v1[j].Padding {
+			continue
+		}
+		if i == len(v2) || v1[j].Length != v2[i].length || strings.Join(v1[j].Path, "/") != strings.Join(v2[i].path, "/") {
+			return errors.New("v1 and v2 file lists differ")
+		}
+		v1[j].PiecesRoot = v2[i].root
+		i++
+	}
+	if i != len(v2) {
+		return errors.New("v1 and v2 file lists differ")
+	}
+	return nil
+}
+
+// alignFiles lists the files of a v2 torrent with padding files before
+// those that would not start on a piece boundary, as in hybrid torrents, so
+// that the content can be addressed like a v1 torrent's.
+func alignFiles(v2 []v2File, pieceLength int) []File {
+	var files []File
+	offset := 0
+	for _, f := range v2 {
+		if pad := (pieceLength - offset%pieceLength) % pieceLength; pad > 0 && f.length > 0 {
+			files = append(files, File{Length: pad, Path: []string{".pad", strconv.Itoa(pad)}, Padding: true})
+			offset += pad
+		}
+		files = append(files, File{Length: f.length, Path: f.path, PiecesRoot: f.root})
+		offset += f.length
+	}
+	return files
+}
+
+// piecesV2 returns how each piece of a v2 or hybrid torrent is verified.
+func piecesV2(t *TorrentFile) []PieceV2 {
+	files := t.Files
+	if files == nil {
+		files = []File{{Length: t.Length, PiecesRoot: t.PiecesRoot}}
+	}
+	var pieces []PieceV2
+	for _, f := range files {
+		if f.Padding || f.Length == 0 {
+			continue
+		}
+		numPieces := (f.Length + t.PieceLength - 1) / t.PieceLength
+		layer := t.PieceLayers[f.PiecesRoot]
+		for i := 0; i < numPieces; i++ {
+			p := PieceV2{
+				Leaves: t.PieceLength / merkle.BlockSize,
+				Length: min(t.PieceLength, f.Length-i*t.PieceLength),
+				Root:   f.PiecesRoot,
+				Index:  i,
+			}
+			if numPieces == 1 {
+				// The tree of a file of one piece is no wider than the file
+				p.Hash = f.PiecesRoot
+				p.Leaves = merkle.Width((f.Length + merkle.BlockSize - 1) / merkle.BlockSize)
+			} else {
+				copy(p.Hash[:], layer[i*32:])
+			}
+			pieces = append(pieces, p)
+		}
+	}
+	return pieces
+}
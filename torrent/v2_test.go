@@ -0,0 +1,183 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"torrent-client/bencode"
+	"torrent-client/merkle"
+	"torrent-client/torrent/torrenttest"
+)
+
+func testV2Files() []torrenttest.File {
+	data := func(n int, seed byte) []byte {
+		buf := make([]byte, n)
+		for i := range buf {
+			buf[i] = byte(i)*3 + seed
+		}
+		return buf
+	}
+	return []torrenttest.File{
+		{Path: []string{"a.bin"}, Data: data(3*32768+100, 1)},
+		{Path: []string{"empty"}, Data: nil},
+		{Path: []string{"sub", "b.bin"}, Data: data(5000, 2)},
+		{Path: []string{"sub", "c.bin"}, Data: data(32768, 3)},
+	}
+}
+
+// infoBytes returns the bencoded info dictionary of a torrent.
+func infoBytes(t *testing.T, data []byte) []byte {
+	decoded, err := bencode.Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	info, err := bencode.Encode(decoded.(map[string]interface{})["info"])
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	return info
+}
+
+func TestParseV2Torrent(t *testing.T) {
+	files := testV2Files()
+	data := torrenttest.Build("album", 32768, files, torrenttest.V2)
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	info := infoBytes(t, data)
+	if tf.InfoHashV2 != sha256.Sum256(info) {
+		t.Error("Expected the v2 infohash to be the SHA-256 of the info dictionary")
+	}
+	if string(tf.InfoHash[:]) != string(tf.InfoHashV2[:20]) {
+		t.Error("Expected the infohash of a v2 torrent to be its truncated v2 infohash")
+	}
+	if tf.PieceHashes != nil {
+		t.Errorf("Expected no v1 pieces, got %d", len(tf.PieceHashes))
+	}
+
+	// a.bin takes 4 pieces, empty takes none, b.bin one and c.bin one.
+	// Padding goes before files that would not start a piece
+	var paths []string
+	for _, f := range tf.Files {
+		paths = append(paths, strings.Join(f.Path, "/"))
+	}
+	expected := "a.bin,empty,.pad/32668,sub/b.bin,.pad/27768,sub/c.bin"
+	if strings.Join(paths, ",") != expected {
+		t.Errorf("Expected files %s, got %s", expected, strings.Join(paths, ","))
+	}
+	if tf.Length != 6*32768 {
+		t.Errorf("Expected length %d, got %d", 6*32768, tf.Length)
+	}
+	if len(tf.PiecesV2) != 6 {
+		t.Fatalf("Expected 6 v2 pieces, got %d", len(tf.PiecesV2))
+	}
+
+	root, layer := torrenttest.Hashes(files[0].Data, 32768)
+	last := tf.PiecesV2[3]
+	if last.Root != root || last.Index != 3 || last.Length != 100 || last.Leaves != 2 || string(last.Hash[:]) != string(layer[3*32:]) {
+		t.Errorf("Unexpected last piece of a.bin %+v", last)
+	}
+	small := tf.PiecesV2[4]
+	bRoot, _ := torrenttest.Hashes(files[2].Data, 32768)
+	if small.Hash != bRoot || small.Leaves != 1 || small.Length != 5000 {
+		t.Errorf("Unexpected piece of b.bin %+v", small)
+	}
+	if merkle.Root(merkle.BlockHashes(files[2].Data), 0, small.Leaves) != small.Hash {
+		t.Error("Expected the piece of b.bin to verify against its pieces root")
+	}
+}
+
+func TestParseV2SingleFile(t *testing.T) {
+	content := make([]byte, 70000)
+	data := torrenttest.Build("file.iso", 32768, []torrenttest.File{{Path: []string{"file.iso"}, Data: content}}, torrenttest.V2)
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	root, _ := torrenttest.Hashes(content, 32768)
+	if tf.Files != nil || tf.Length != 70000 || tf.PiecesRoot != root {
+		t.Errorf("Expected a single file of 70000 bytes, got %d files of %d bytes", len(tf.Files), tf.Length)
+	}
+	if len(tf.PiecesV2) != 3 {
+		t.Errorf("Expected 3 pieces, got %d", len(tf.PiecesV2))
+	}
+}
+
+func TestParseHybridTorrent(t *testing.T) {
+	files := testV2Files()
+	data := torrenttest.Build("album", 32768, files, torrenttest.Hybrid)
+	tf, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	info := infoBytes(t, data)
+	if tf.InfoHash != sha1.Sum(info) || tf.InfoHashV2 != sha256.Sum256(info) {
+		t.Error("Expected both the v1 and the v2 infohash")
+	}
+	if len(tf.PieceHashes) != 6 || len(tf.PiecesV2) != 6 {
+		t.Errorf("Expected 6 pieces of each version, got %d and %d", len(tf.PieceHashes), len(tf.PiecesV2))
+	}
+	if !tf.Files[2].Padding || tf.Files[2].Length != 32668 {
+		t.Errorf("Expected a padding file before b.bin, got %+v", tf.Files[2])
+	}
+	if root, _ := torrenttest.Hashes(files[3].Data, 32768); tf.Files[5].PiecesRoot != root {
+		t.Error("Expected the v1 files to get their pieces roots")
+	}
+}
+
+func TestParseV2Errors(t *testing.T) {
+	files := testV2Files()
+	decode := func(data []byte) map[string]interface{} {
+		decoded, err := bencode.Decode(data)
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		return decoded.(map[string]interface{})
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(dict map[string]interface{})
+		errorMsg string
+	}{
+		{"bad piece length", func(dict map[string]interface{}) {
+			dict["info"].(map[string]interface{})["piece length"] = 20000
+		}, "invalid v2 piece length"},
+		{"missing piece layer", func(dict map[string]interface{}) {
+			dict["piece layers"] = map[string]interface{}{}
+		}, "missing or invalid piece layer of a.bin"},
+		{"wrong piece layer", func(dict map[string]interface{}) {
+			for root, layer := range dict["piece layers"].(map[string]interface{}) {
+				dict["piece layers"].(map[string]interface{})[root] = strings.Repeat("x", len(layer.(string)))
+			}
+		}, "does not match its pieces root"},
+		{"path escaping the directory", func(dict map[string]interface{}) {
+			tree := dict["info"].(map[string]interface{})["file tree"].(map[string]interface{})
+			tree[".."] = tree["a.bin"]
+		}, "invalid file path component"},
+		{"unknown meta version", func(dict map[string]interface{}) {
+			dict["info"].(map[string]interface{})["meta version"] = 3
+		}, "unsupported meta version 3"},
+	}
+	for _, tt := range tests {
+		dict := decode(torrenttest.Build("album", 32768, files, torrenttest.V2))
+		tt.modify(dict)
+		_, err := parseTorrentDict(dict)
+		if err == nil || !strings.Contains(err.Error(), tt.errorMsg) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.errorMsg, err)
+		}
+	}
+
+	// The v1 and v2 parts of a hybrid torrent must describe the same files
+	dict := decode(torrenttest.Build("album", 32768, files, torrenttest.Hybrid))
+	list := dict["info"].(map[string]interface{})["files"].([]interface{})
+	list[0].(map[string]interface{})["path"] = []interface{}{"other.bin"}
+	if _, err := parseTorrentDict(dict); err == nil || !strings.Contains(err.Error(), "file lists differ") {
+		t.Errorf("Expected mismatched file lists to be refused, got %v", err)
+	}
+}
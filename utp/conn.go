@@ -0,0 +1,597 @@
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// Largest payload of a packet, keeping datagrams below common MTUs.
+	maxPayload = 1400 - headerSize
+	// Bounds of the congestion window, in bytes.
+	minWindow     = maxPayload
+	initialWindow = 4 * maxPayload
+	maxWindow     = 1 << 20
+	// LEDBAT aims to add no more than this much queuing delay.
+	targetDelay = 100 * time.Millisecond
+	// The congestion window grows by at most this many bytes per round
+	// trip.
+	maxWindowIncrease = 3000
+	// The base delay is the lowest delay seen over this long.
+	baseDelayWindow = 2 * time.Minute
+
+	recvBufferSize = 1 << 20
+	sendBufferSize = 1 << 20
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// Connections fail when a packet goes unacknowledged after this many
+	// retransmissions.
+	maxRetransmits    = 8
+	maxSynRetransmits = 3
+	// How long a closed connection keeps trying to deliver what was
+	// written before it.
+	closeTimeout = 30 * time.Second
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	raddr  net.Addr
+	recvID uint16 // connection ID of the packets we receive
+	sendID uint16 // connection ID of the packets we send
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	state  int
+	err    error // why the connection failed
+	closed bool  // Close was called
+	seqNr  uint16
+	ackNr  uint16 // last packet received in order
+
+	unsent     []byte       // written but not sent yet
+	inflight   []*outPacket // sent and not acknowledged, oldest first
+	flight     int          // payload bytes in flight
+	writeShut  bool         // no more writes; send a FIN after the data
+	finSent    bool
+	finAcked   bool
+	closedAt   time.Time
+	window     float64 // congestion window in bytes
+	peerWindow int     // free space in the peer's receive buffer
+	dupAcks    int
+	recovering bool   // retransmitting after a loss
+	recoverSeq uint16 // last packet sent before the loss was noticed
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	delay      time.Duration // latest queuing delay measured
+	curDelay   uint32        // lowest delay sample of the current half window
+	prevDelay  uint32        // and of the previous one
+	delayStart time.Time
+	replyMicro uint32 // delay of the last packet received, echoed to the peer
+
+	readBuf  []byte
+	ooo      map[uint16][]byte // packets received ahead of a gap
+	oooBytes int
+	finRecv  bool
+	eofSeq   uint16
+	eof      bool // everything up to the FIN was received
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type outPacket struct {
+	typ           int
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+}
+
+func newConn(s *Socket, raddr net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		s:          s,
+		raddr:      raddr,
+		recvID:     recvID,
+		sendID:     sendID,
+		state:      stateConnected,
+		window:     initialWindow,
+		peerWindow: recvBufferSize,
+		rto:        initialTimeout,
+		curDelay:   math.MaxUint32,
+		prevDelay:  math.MaxUint32,
+		delayStart: time.Now(),
+		ooo:        make(map[uint16][]byte),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func timestamp(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+// connect sends a SYN and waits for the peer to acknowledge it.
+func (c *Conn) connect(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = stateSynSent
+	c.seqNr = 1
+	syn := &outPacket{typ: stSyn, seq: c.seqNr}
+	c.seqNr++
+	c.inflight = append(c.inflight, syn)
+	c.transmit(syn, time.Now())
+
+	for c.state == stateSynSent {
+		if err := ctx.Err(); err != nil {
+			c.failLocked(err)
+			return err
+		}
+		c.cond.Wait()
+	}
+	return c.err
+}
+
+// accepted answers the SYN of a connection the peer opened.
+func (c *Conn) accepted(syn *header) {
+	var b [2]byte
+	rand.Read(b[:])
+	c.seqNr = binary.BigEndian.Uint16(b[:])
+	c.ackNr = syn.seqNr
+}
+
+func (c *Conn) handle(h *header, payload []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+	if c.state == stateClosed {
+		return
+	}
+
+	c.replyMicro = timestamp(now) - h.timestamp
+	switch {
+	case h.typ == stReset:
+		c.failLocked(syscall.ECONNRESET)
+		return
+	case h.typ == stSyn:
+		// A new connection, or our acknowledgement of it was lost
+		c.peerWindow = int(h.wndSize)
+		c.sendState()
+		return
+	case c.state == stateSynSent:
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+
+	c.peerWindow = int(h.wndSize)
+	c.processAck(h, now)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+		c.sendState()
+	}
+	c.flush(now)
+}
+
+// processAck removes the packets the peer acknowledged from the flight and
+// adjusts the congestion window.
+func (c *Conn) processAck(h *header, now time.Time) {
+	acked := 0
+	advanced := false
+	for len(c.inflight) > 0 && !seqLess(h.ackNr, c.inflight[0].seq) {
+		p := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		c.flight -= len(p.payload)
+		acked += len(p.payload)
+		advanced = true
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sent))
+		}
+		if p.typ == stFin {
+			c.finAcked = true
+		}
+	}
+
+	switch {
+	case advanced:
+		c.dupAcks = 0
+		c.rto = c.timeout()
+		if c.recovering {
+			if len(c.inflight) > 0 && !seqLess(c.recoverSeq, c.inflight[0].seq) {
+				// Another packet of the same loss
+				c.transmit(c.inflight[0], now)
+			} else {
+				c.recovering = false
+			}
+		}
+	case h.typ == stState && len(c.inflight) > 0 && h.ackNr == c.inflight[0].seq-1:
+		c.dupAcks++
+		if c.dupAcks == 3 && !c.recovering {
+			c.onLoss()
+			c.transmit(c.inflight[0], now)
+		}
+	}
+
+	if acked > 0 && h.timeDiff != 0 {
+		c.ledbat(h.timeDiff, acked, now)
+	}
+}
+
+// onLoss halves the congestion window and retransmits until everything in
+// flight now is acknowledged.
+func (c *Conn) onLoss() {
+	c.window = math.Max(c.window/2, minWindow)
+	c.recovering = true
+	c.recoverSeq = c.inflight[len(c.inflight)-1].seq
+}
+
+// ledbat adjusts the congestion window for acked bytes given a delay sample:
+// it grows while the queuing delay is below target and shrinks above it.
+func (c *Conn) ledbat(sample uint32, acked int, now time.Time) {
+	if now.Sub(c.delayStart) > baseDelayWindow/2 {
+		c.prevDelay, c.curDelay = c.curDelay, math.MaxUint32
+		c.delayStart = now
+	}
+	if sample < c.curDelay {
+		c.curDelay = sample
+	}
+	base := c.curDelay
+	if c.prevDelay < base {
+		base = c.prevDelay
+	}
+	c.delay = time.Duration(sample-base) * time.Microsecond
+
+	offTarget := float64(targetDelay-c.delay) / float64(targetDelay)
+	c.window += maxWindowIncrease * offTarget * float64(acked) / c.window
+	c.window = math.Min(math.Max(c.window, minWindow), maxWindow)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+		return
+	}
+	delta := c.rtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	c.rttVar += (delta - c.rttVar) / 4
+	c.rtt += (sample - c.rtt) / 8
+}
+
+func (c *Conn) timeout() time.Duration {
+	if c.rtt == 0 {
+		return initialTimeout
+	}
+	rto := c.rtt + 4*c.rttVar
+	if rto < minTimeout {
+		rto = minTimeout
+	}
+	return rto
+}
+
+// receive stores the payload of a data packet, or notes the end of the
+// stream for a FIN, and delivers what is now in order.
+func (c *Conn) receive(h *header, payload []byte) {
+	if h.typ == stFin && !c.finRecv {
+		c.finRecv = true
+		c.eofSeq = h.seqNr
+	}
+	if c.eof || !seqLess(c.ackNr, h.seqNr) {
+		return // a duplicate
+	}
+	if h.seqNr != c.ackNr+1 {
+		if h.typ == stData && c.oooBytes+len(payload) <= recvBufferSize && c.ooo[h.seqNr] == nil {
+			c.ooo[h.seqNr] = payload
+			c.oooBytes += len(payload)
+		}
+		return
+	}
+
+	c.deliver(payload)
+	for !c.eof {
+		next := c.ackNr + 1
+		if buf, ok := c.ooo[next]; ok {
+			delete(c.ooo, next)
+			c.oooBytes -= len(buf)
+			c.deliver(buf)
+		} else if c.finRecv && next == c.eofSeq {
+			c.ackNr = next
+			c.eof = true
+		} else {
+			break
+		}
+	}
+}
+
+func (c *Conn) deliver(payload []byte) {
+	c.ackNr++
+	if c.finRecv && c.ackNr == c.eofSeq {
+		c.eof = true
+		return
+	}
+	if !c.closed {
+		c.readBuf = append(c.readBuf, payload...)
+	}
+}
+
+func (c *Conn) recvWindow() int {
+	n := recvBufferSize - len(c.readBuf) - c.oooBytes
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// flush sends as much of the unsent data as the congestion window and the
+// peer's receive window allow, and the FIN once everything is sent after
+// Close.
+func (c *Conn) flush(now time.Time) {
+	if c.state != stateConnected {
+		return
+	}
+	window := int(c.window)
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+	for len(c.unsent) > 0 {
+		n := len(c.unsent)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		// One packet may always be in flight, to probe a closed window
+		if c.flight > 0 && c.flight+n > window {
+			break
+		}
+		p := &outPacket{typ: stData, seq: c.seqNr, payload: append([]byte(nil), c.unsent[:n]...)}
+		c.seqNr++
+		c.unsent = c.unsent[n:]
+		c.inflight = append(c.inflight, p)
+		c.flight += n
+		c.transmit(p, now)
+	}
+	if len(c.unsent) == 0 {
+		c.unsent = nil
+		if c.writeShut && !c.finSent {
+			fin := &outPacket{typ: stFin, seq: c.seqNr}
+			c.seqNr++
+			c.inflight = append(c.inflight, fin)
+			c.finSent = true
+			c.transmit(fin, now)
+		}
+	}
+}
+
+func (c *Conn) transmit(p *outPacket, now time.Time) {
+	p.sent = now
+	p.transmissions++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sendState() {
+	c.send(stState, c.seqNr, nil)
+}
+
+func (c *Conn) send(typ int, seq uint16, payload []byte) {
+	h := &header{
+		typ:       typ,
+		connID:    c.sendID,
+		timestamp: timestamp(time.Now()),
+		timeDiff:  c.replyMicro,
+		wndSize:   uint32(c.recvWindow()),
+		seqNr:     seq,
+		ackNr:     c.ackNr,
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	c.s.pc.WriteTo(h.serialize(payload), c.raddr)
+}
+
+// tick retransmits the oldest packet in flight once it times out, and wakes
+// up calls waiting for a deadline.
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+	if c.state == stateClosed {
+		return
+	}
+	if c.closed && (c.finAcked || now.Sub(c.closedAt) > closeTimeout) {
+		c.failLocked(net.ErrClosed)
+		return
+	}
+	if len(c.inflight) == 0 || now.Sub(c.inflight[0].sent) < c.rto {
+		return
+	}
+
+	p := c.inflight[0]
+	limit := maxRetransmits
+	if p.typ == stSyn {
+		limit = maxSynRetransmits
+	}
+	if p.transmissions > limit {
+		c.failLocked(errTimeout)
+		return
+	}
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+	c.window = minWindow
+	c.recovering = true
+	c.recoverSeq = c.inflight[len(c.inflight)-1].seq
+	c.transmit(p, now)
+}
+
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failLocked(err)
+}
+
+func (c *Conn) failLocked(err error) {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	c.err = err
+	c.cond.Broadcast()
+	c.s.remove(c)
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.readBuf) > 0:
+			wasFull := c.recvWindow() < maxPayload
+			n := copy(p, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			if wasFull && c.state == stateConnected {
+				// Tell the peer there is room again
+				c.sendState()
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.readDeadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(p) {
+		switch {
+		case c.writeShut:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		case expired(c.writeDeadline):
+			return written, os.ErrDeadlineExceeded
+		}
+		room := sendBufferSize - len(c.unsent)
+		if room <= 0 {
+			c.cond.Wait()
+			continue
+		}
+		n := len(p) - written
+		if n > room {
+			n = room
+		}
+		c.unsent = append(c.unsent, p[written:written+n]...)
+		written += n
+		c.flush(time.Now())
+	}
+	return written, nil
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Close sends what was written and then a FIN in the background. The
+// connection stays on the socket until the FIN is acknowledged.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	c.writeShut = true
+	c.closedAt = time.Now()
+	c.readBuf = nil
+	c.cond.Broadcast()
+	if c.state != stateConnected {
+		c.failLocked(net.ErrClosed)
+		return nil
+	}
+	c.flush(c.closedAt)
+	return nil
+}
+
+// CloseWrite shuts down the sending side: the peer reads EOF after the data
+// written so far, while we may still read what it sends.
+func (c *Conn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.writeShut {
+		return net.ErrClosed
+	}
+	c.writeShut = true
+	c.cond.Broadcast()
+	c.flush(time.Now())
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if addr, ok := c.s.pc.LocalAddr().(*net.UDPAddr); ok {
+		return (*Addr)(addr)
+	}
+	return c.s.pc.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if addr, ok := c.raddr.(*net.UDPAddr); ok {
+		return (*Addr)(addr)
+	}
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
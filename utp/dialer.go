@@ -0,0 +1,115 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Policy says which transports outgoing connections use.
+type Policy int
+
+const (
+	// TCPOnly never uses uTP. It is the zero value.
+	TCPOnly Policy = iota
+	// PreferTCP tries TCP first and uTP if that fails.
+	PreferTCP
+	// PreferUTP tries uTP first and TCP if that fails.
+	PreferUTP
+	// UTPOnly never uses TCP.
+	UTPOnly
+)
+
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "tcp":
+		return TCPOnly, nil
+	case "prefer-tcp", "tcp,utp":
+		return PreferTCP, nil
+	case "prefer-utp", "utp,tcp":
+		return PreferUTP, nil
+	case "utp":
+		return UTPOnly, nil
+	}
+	return TCPOnly, fmt.Errorf("unknown transport policy %q", s)
+}
+
+func (p Policy) String() string {
+	switch p {
+	case PreferTCP:
+		return "prefer-tcp"
+	case PreferUTP:
+		return "prefer-utp"
+	case UTPOnly:
+		return "utp"
+	default:
+		return "tcp"
+	}
+}
+
+// DefaultDialTimeout limits each connection attempt of a Dialer without a
+// Timeout.
+const DefaultDialTimeout = 3 * time.Second
+
+// Dialer connects to peers over TCP, uTP or both, following its Policy.
+type Dialer struct {
+	// Socket carries the uTP connections. Without one only TCP is used.
+	Socket  *Socket
+	Policy  Policy
+	Timeout time.Duration
+}
+
+// Dial connects to addr with each transport the policy allows in turn, and
+// returns the first connection that succeeds.
+func (d *Dialer) Dial(addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial but gives up when ctx is done. Each attempt is
+// limited to Timeout on top of that.
+func (d *Dialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultDialTimeout
+	}
+	dialTCP := func() (net.Conn, error) {
+		dialer := net.Dialer{Timeout: timeout}
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+	dialUTP := func() (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return d.Socket.DialContext(ctx, addr)
+	}
+
+	var attempts []func() (net.Conn, error)
+	switch {
+	case d.Socket == nil || d.Policy == TCPOnly:
+		if d.Policy == UTPOnly {
+			return nil, errors.New("uTP is required but there is no uTP socket")
+		}
+		attempts = append(attempts, dialTCP)
+	case d.Policy == PreferTCP:
+		attempts = append(attempts, dialTCP, dialUTP)
+	case d.Policy == PreferUTP:
+		attempts = append(attempts, dialUTP, dialTCP)
+	default:
+		attempts = append(attempts, dialUTP)
+	}
+
+	var errs []error
+	for _, dial := range attempts {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		conn, err := dial()
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Packet types.
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+)
+
+type header struct {
+	typ       int
+	connID    uint16
+	timestamp uint32 // microseconds
+	timeDiff  uint32 // microseconds
+	wndSize   uint32
+	seqNr     uint16
+	ackNr     uint16
+}
+
+func (h *header) serialize(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = byte(h.typ<<4 | version)
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timeDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], h.ackNr)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// isPacket reports whether buf looks like a uTP packet, as opposed to other
+// traffic on a shared socket such as DHT messages.
+func isPacket(buf []byte) bool {
+	return len(buf) >= headerSize && buf[0]&0x0f == version && buf[0]>>4 <= stSyn
+}
+
+// parsePacket parses a packet, skipping any extension headers, and returns
+// its payload.
+func parsePacket(buf []byte) (*header, []byte, error) {
+	if !isPacket(buf) {
+		return nil, nil, fmt.Errorf("not a uTP packet")
+	}
+	h := &header{
+		typ:       int(buf[0] >> 4),
+		connID:    binary.BigEndian.Uint16(buf[2:4]),
+		timestamp: binary.BigEndian.Uint32(buf[4:8]),
+		timeDiff:  binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:   binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:     binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:     binary.BigEndian.Uint16(buf[18:20]),
+	}
+	ext := buf[1]
+	rest := buf[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, nil, fmt.Errorf("truncated extension header")
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,318 @@
+// Package utp implements the Micro Transport Protocol (BEP 29): reliable,
+// ordered streams over UDP. Its LEDBAT congestion control backs off as soon
+// as queuing delay builds up, so transfers yield to the user's other traffic.
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// How often connections check for retransmissions and deadlines.
+	tickInterval = 50 * time.Millisecond
+	// Connections not yet accepted; SYNs beyond them are reset.
+	acceptBacklog = 32
+	// Datagrams for PacketConn waiting to be read; more are dropped.
+	otherBacklog = 64
+)
+
+// Addr is the address of a uTP endpoint. Its network is "utp", which tells
+// uTP connections apart from TCP ones.
+type Addr net.UDPAddr
+
+func (a *Addr) Network() string { return "utp" }
+
+func (a *Addr) String() string { return (*net.UDPAddr)(a).String() }
+
+// Socket carries uTP connections over a single UDP socket, both the ones it
+// dials and the ones it accepts. It implements net.Listener.
+type Socket struct {
+	pc        net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	accept    chan *Conn
+	other     chan datagram
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// connKey identifies a connection by the remote address and the connection
+// ID its packets carry to us.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+type datagram struct {
+	buf  []byte
+	addr net.Addr
+}
+
+// Listen opens a UDP socket on addr, e.g. ":6881". Without a host it
+// carries both IPv4 and IPv6.
+func Listen(addr string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+// NewSocket runs uTP on pc. The socket takes ownership of pc.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		other:  make(chan datagram, otherBacklog),
+		done:   make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Addr returns the local address of the UDP socket.
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for a remote peer to connect.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the UDP socket, failing every connection on it.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.pc.Close()
+		for _, c := range s.snapshot() {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// Dial connects to a uTP endpoint at addr.
+func (s *Socket) Dial(addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to a uTP endpoint at addr, giving up when ctx is
+// done.
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var c *Conn
+	for c == nil {
+		var b [2]byte
+		rand.Read(b[:])
+		id := binary.BigEndian.Uint16(b[:])
+		if s.conns[connKey{raddr.String(), id}] == nil {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[connKey{raddr.String(), id}] = c
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, fmt.Errorf("uTP connection to %s failed: %w", addr, err)
+	}
+	return c, nil
+}
+
+// PacketConn returns the datagrams on the socket that are not uTP, such as
+// DHT messages, so that another protocol can share the port. There should
+// be only one reader.
+func (s *Socket) PacketConn() net.PacketConn {
+	return &packetConn{s: s, closed: make(chan struct{})}
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		if !isPacket(buf[:n]) {
+			select {
+			case s.other <- datagram{append([]byte(nil), buf[:n]...), addr}:
+			default:
+			}
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte(nil), payload...), addr)
+	}
+}
+
+// dispatch hands a packet to its connection, creating one for a new SYN.
+func (s *Socket) dispatch(h *header, payload []byte, addr net.Addr) {
+	now := time.Now()
+	s.mu.Lock()
+	c := s.conns[connKey{addr.String(), h.connID}]
+	switch {
+	case h.typ == stSyn:
+		key := connKey{addr.String(), h.connID + 1}
+		if c = s.conns[key]; c == nil {
+			c = newConn(s, addr, h.connID+1, h.connID)
+			c.accepted(h)
+			select {
+			case s.accept <- c:
+				s.conns[key] = c
+			default:
+				s.mu.Unlock()
+				s.sendReset(h, addr)
+				return
+			}
+		}
+	case c == nil && h.typ == stReset:
+		// A reset carries the ID we send with
+		for _, other := range s.conns {
+			if other.raddr.String() == addr.String() && other.sendID == h.connID {
+				c = other
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	if c == nil {
+		if h.typ != stReset {
+			s.sendReset(h, addr)
+		}
+		return
+	}
+	c.handle(h, payload, now)
+}
+
+func (s *Socket) sendReset(h *header, addr net.Addr) {
+	reset := &header{typ: stReset, connID: h.connID, timestamp: timestamp(time.Now()), ackNr: h.seqNr}
+	s.pc.WriteTo(reset.serialize(nil), addr)
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range s.snapshot() {
+				c.tick(now)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Socket) snapshot() []*Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// packetConn reads the datagrams of a Socket that are not uTP and writes
+// through the socket.
+type packetConn struct {
+	s         *Socket
+	closed    chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	deadline  time.Time
+}
+
+func (pc *packetConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	pc.mu.Lock()
+	deadline := pc.deadline
+	pc.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-pc.s.other:
+		return copy(p, d.buf), d.addr, nil
+	case <-pc.closed:
+		return 0, nil, net.ErrClosed
+	case <-pc.s.done:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (pc *packetConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return pc.s.pc.WriteTo(p, addr)
+}
+
+// Close stops reading; the socket itself stays open.
+func (pc *packetConn) Close() error {
+	pc.closeOnce.Do(func() { close(pc.closed) })
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.s.pc.LocalAddr()
+}
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return pc.SetReadDeadline(t)
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.deadline = t
+	return nil
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var errTimeout = errors.New("connection timed out")
@@ -0,0 +1,337 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops a share of the datagrams written to it and delays the
+// rest, simulating a bad link.
+type lossyConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+	mu    sync.Mutex
+	rng   *rand.Rand
+}
+
+func (c *lossyConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rng.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(p), nil
+	}
+	buf := append([]byte(nil), p...)
+	time.AfterFunc(c.delay, func() { c.PacketConn.WriteTo(buf, addr) })
+	return len(p), nil
+}
+
+func newTestSocket(t *testing.T, loss float64, delay time.Duration) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	if loss > 0 || delay > 0 {
+		pc = &lossyConn{PacketConn: pc, loss: loss, delay: delay, rng: rand.New(rand.NewSource(1))}
+	}
+	s := NewSocket(pc)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func newTestData(n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return data
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	h := &header{typ: stData, connID: 0x1234, timestamp: 1, timeDiff: 2, wndSize: 3, seqNr: 65535, ackNr: 7}
+	buf := h.serialize([]byte("payload"))
+
+	parsed, payload, err := parsePacket(buf)
+	if err != nil {
+		t.Fatalf("parsePacket failed: %v", err)
+	}
+	if *parsed != *h {
+		t.Errorf("Expected %+v, got %+v", h, parsed)
+	}
+	if string(payload) != "payload" {
+		t.Errorf("Expected payload 'payload', got %q", payload)
+	}
+
+	// A selective ack extension is skipped
+	ext := append(append([]byte(nil), buf[:headerSize]...), 0, 4, 1, 2, 3, 4)
+	ext[1] = 1
+	ext = append(ext, "payload"...)
+	if _, payload, err = parsePacket(ext); err != nil || string(payload) != "payload" {
+		t.Errorf("Expected the extension to be skipped, got %q, %v", payload, err)
+	}
+
+	for _, buf := range [][]byte{[]byte("d1:ad2:id20:"), make([]byte, 10), append([]byte{0x51}, make([]byte, 19)...)} {
+		if isPacket(buf) {
+			t.Errorf("Expected %q not to be a uTP packet", buf)
+		}
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	testCases := []struct {
+		a, b     uint16
+		expected bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{65000, 100, true},
+	}
+	for _, tc := range testCases {
+		if got := seqLess(tc.a, tc.b); got != tc.expected {
+			t.Errorf("seqLess(%d, %d): expected %v, got %v", tc.a, tc.b, tc.expected, got)
+		}
+	}
+}
+
+// transfer sends data from a connection dialed on a to one accepted on b,
+// and back, and checks that both arrive intact.
+func transfer(t *testing.T, a, b *Socket, data []byte) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := b.Accept()
+		if err != nil {
+			t.Errorf("Accept failed: %v", err)
+		}
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dialed, err := a.DialContext(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.FailNow()
+	}
+	if server.RemoteAddr().Network() != "utp" {
+		t.Errorf("Expected network utp, got %s", server.RemoteAddr().Network())
+	}
+
+	// The accepting side echoes everything back and closes
+	go func() {
+		io.Copy(server, server)
+		server.Close()
+	}()
+
+	deadline := time.Now().Add(20 * time.Second)
+	dialed.SetDeadline(deadline)
+	go func() {
+		dialed.Write(data)
+	}()
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(dialed, received); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatal("Echoed data does not match")
+	}
+
+	// Closing our side ends the echo, which closes the other side
+	dialed.(*Conn).CloseWrite()
+	if n, err := dialed.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Expected EOF, got %d bytes, %v", n, err)
+	}
+	dialed.Close()
+}
+
+func TestTransfer(t *testing.T) {
+	a := newTestSocket(t, 0, 0)
+	b := newTestSocket(t, 0, 0)
+	transfer(t, a, b, newTestData(2<<20))
+}
+
+func TestTransferWithLossAndDelay(t *testing.T) {
+	a := newTestSocket(t, 0.05, 10*time.Millisecond)
+	b := newTestSocket(t, 0.05, 10*time.Millisecond)
+	transfer(t, a, b, newTestData(256<<10))
+}
+
+func TestLEDBATBacksOffOnDelay(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	now := time.Now()
+
+	// Without queuing delay the window grows
+	window := c.window
+	for i := 0; i < 10; i++ {
+		c.ledbat(5000, maxPayload, now)
+	}
+	if c.window <= window {
+		t.Errorf("Expected the window to grow from %.0f, got %.0f", window, c.window)
+	}
+	if c.delay != 0 {
+		t.Errorf("Expected no queuing delay, got %s", c.delay)
+	}
+
+	// 200ms above the base delay, twice the target, it shrinks
+	window = c.window
+	c.ledbat(5000+200000, maxPayload, now)
+	if c.delay != 200*time.Millisecond {
+		t.Errorf("Expected a queuing delay of 200ms, got %s", c.delay)
+	}
+	if c.window >= window {
+		t.Errorf("Expected the window to shrink from %.0f, got %.0f", window, c.window)
+	}
+	for i := 0; i < 1000; i++ {
+		c.ledbat(5000+200000, maxPayload, now)
+	}
+	if c.window != minWindow {
+		t.Errorf("Expected the window to reach %d, got %.0f", minWindow, c.window)
+	}
+
+	// A lower base delay after the window slides is adopted
+	c.ledbat(3000, maxPayload, now.Add(baseDelayWindow))
+	c.ledbat(4000, maxPayload, now.Add(2*baseDelayWindow))
+	if c.delay != time.Millisecond {
+		t.Errorf("Expected a queuing delay of 1ms, got %s", c.delay)
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	a := newTestSocket(t, 0, 0)
+	// Nothing answers on a socket that drops everything
+	b := newTestSocket(t, 1, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := a.DialContext(ctx, b.Addr().String()); err == nil {
+		t.Error("Expected the dial to time out")
+	}
+}
+
+func TestReset(t *testing.T) {
+	a := newTestSocket(t, 0, 0)
+	b := newTestSocket(t, 0, 0)
+	conn, err := a.Dial(b.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	server, err := b.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	// The other side forgets the connection, so our next packet is reset
+	server.(*Conn).fail(net.ErrClosed)
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Expected the connection to be reset, got %v", err)
+	}
+}
+
+func TestPacketConnSharesSocket(t *testing.T) {
+	s := newTestSocket(t, 0, 0)
+	pc := s.PacketConn()
+	defer pc.Close()
+
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer sender.Close()
+	sender.WriteTo([]byte("d1:y1:qe"), s.Addr())
+
+	pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 100)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if string(buf[:n]) != "d1:y1:qe" {
+		t.Errorf("Expected the DHT message, got %q", buf[:n])
+	}
+	if addr.String() != sender.LocalAddr().String() {
+		t.Errorf("Expected sender %s, got %s", sender.LocalAddr(), addr)
+	}
+}
+
+func TestDialerPolicy(t *testing.T) {
+	s := newTestSocket(t, 0, 0)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// Only TCP answers at tcpAddr, only uTP at utpAddr
+	tcpAddr := ln.Addr().String()
+	utpAddr := newTestSocket(t, 0, 0).Addr().String()
+	silent := newTestSocket(t, 1, 0)
+
+	testCases := []struct {
+		policy  Policy
+		addr    string
+		network string
+	}{
+		{TCPOnly, tcpAddr, "tcp"},
+		{TCPOnly, utpAddr, ""},
+		{PreferTCP, utpAddr, "utp"},
+		{PreferUTP, utpAddr, "utp"},
+		{PreferUTP, silent.Addr().String(), ""},
+		{UTPOnly, utpAddr, "utp"},
+	}
+	for _, tc := range testCases {
+		d := &Dialer{Socket: s, Policy: tc.policy, Timeout: 200 * time.Millisecond}
+		conn, err := d.Dial(tc.addr)
+		if tc.network == "" {
+			if err == nil {
+				t.Errorf("%s to %s: expected an error", tc.policy, tc.addr)
+				conn.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s to %s: Dial failed: %v", tc.policy, tc.addr, err)
+			continue
+		}
+		if conn.RemoteAddr().Network() != tc.network {
+			t.Errorf("%s to %s: expected network %s, got %s", tc.policy, tc.addr, tc.network, conn.RemoteAddr().Network())
+		}
+		conn.Close()
+	}
+
+	d := &Dialer{Policy: UTPOnly}
+	if _, err := d.Dial(utpAddr); err == nil {
+		t.Error("Expected an error for uTP without a socket")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{TCPOnly, PreferTCP, PreferUTP, UTPOnly} {
+		parsed, err := ParsePolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("Expected %s to parse back, got %s, %v", p, parsed, err)
+		}
+	}
+	if _, err := ParsePolicy("carrier-pigeon"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}